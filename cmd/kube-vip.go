@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/kube-vip/kube-vip/pkg/kubevip"
+	"github.com/kube-vip/kube-vip/pkg/loadbalancer"
 	"github.com/kube-vip/kube-vip/pkg/manager"
 	"github.com/kube-vip/kube-vip/pkg/packet"
 	"github.com/kube-vip/kube-vip/pkg/vip"
@@ -245,6 +246,7 @@ var kubeVipManager = &cobra.Command{
 		}
 
 		prometheus.MustRegister(mgr.PrometheusCollector()...)
+		prometheus.MustRegister(loadbalancer.PrometheusCollector()...)
 
 		// Start the service manager, this will watch the config Map and construct kube-vip services for it
 		err = mgr.Start()
@@ -81,6 +81,8 @@ func (cluster *Cluster) vipService(ctxArp, ctxDNS context.Context, c *kubevip.Co
 		lb, err := loadbalancer.NewIPVSLB(c.VIP, c.LoadBalancerPort)
 		if err != nil {
 			log.Errorf("Error creating IPVS LoadBalancer [%s]", err)
+		} else {
+			log.Infof("IPVS LoadBalancer service [%s] was %s", lb, lb.Origin())
 		}
 
 		go func() {
@@ -92,7 +94,7 @@ func (cluster *Cluster) vipService(ctxArp, ctxDNS context.Context, c *kubevip.Co
 		// Shutdown function that will wait on this signal, unless we call it ourselves
 		go func() {
 			<-signalChan
-			err = lb.RemoveIPVSLB()
+			err = lb.Close()
 			if err != nil {
 				log.Errorf("Error stopping IPVS LoadBalancer [%s]", err)
 			}
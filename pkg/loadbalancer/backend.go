@@ -0,0 +1,752 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/ipvs"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// Backend is a real server (IPVS destination) that the load balancer forwards traffic to
+type Backend struct {
+	Address string
+	Port    int
+	Weight  int
+	// FwdMethod is the forwarding method of the backend, when a backend is added by AddBackends or
+	// SyncBackends the zero value (Masquarade) is treated as unset and the forwarding method of the load
+	// balancer is used. A backend can only be masqueraded by a load balancer with another default
+	// forwarding method with AddBackendWithForwardMethod.
+	FwdMethod ipvs.ForwardType
+	// Tunnel is the tunnel of a backend that was added with AddBackendWithTunnel
+	Tunnel Tunnel
+	// Healthy is false when the backend has been quiesced by the health checker
+	Healthy bool
+	// AdditionalAddresses are the addresses of a multi-homed SCTP backend other than its primary Address
+	AdditionalAddresses []string
+	// UpperThreshold and LowerThreshold are the connection thresholds of the backend, they are set as the
+	// backend is added (by AddBackendWithThresholds, AddBackends or SyncBackends) or with SetBackendThresholds
+	UpperThreshold int
+	LowerThreshold int
+
+	// The connection counts are only populated by ListBackendsWithStats, they are point-in-time kernel
+	// counters summed across every port of the load balancer
+	ActiveConnections     int
+	InactiveConnections   int
+	PersistentConnections int
+}
+
+// ListBackends will return the backends that are currently registered with the IPVS service
+func (lb *IPVSLoadBalancer) ListBackends() ([]Backend, error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.listBackends(false)
+}
+
+// ListBackendsWithStats will return the backends in the same manner as ListBackends along with their
+// connection counts, this requires reading the destinations of every port of the load balancer
+func (lb *IPVSLoadBalancer) ListBackendsWithStats() ([]Backend, error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.listBackends(true)
+}
+
+// listBackends reads the IPVS destinations, the caller must hold the lock
+func (lb *IPVSLoadBalancer) listBackends(withStats bool) ([]Backend, error) {
+	dsts, err := lb.client.Destinations(lb.loadBalancerService)
+	if err != nil {
+		return nil, fmt.Errorf("error listing backends: %w", err)
+	}
+
+	backends := make([]Backend, 0, len(dsts))
+	for x := range dsts {
+		address := dsts[x].Address.Net(dsts[x].Family).String()
+		key := backendKey(address, int(dsts[x].Port))
+		backends = append(backends, Backend{
+			Address:             address,
+			Port:                int(dsts[x].Port),
+			Weight:              int(dsts[x].Weight),
+			FwdMethod:           dsts[x].FwdMethod,
+			Healthy:             !lb.isQuiesced(key),
+			AdditionalAddresses: lb.sctpAddresses[key],
+			UpperThreshold:      int(dsts[x].UpperThreshold),
+			LowerThreshold:      int(dsts[x].LowerThreshold),
+			Tunnel:              lb.desired[key].Tunnel,
+		})
+	}
+	if !withStats {
+		return backends, nil
+	}
+
+	index := make(map[string]int, len(backends))
+	for x := range backends {
+		index[backendKey(backends[x].Address, backends[x].Port)] = x
+	}
+	for _, svc := range lb.services() {
+		if svc != lb.loadBalancerService {
+			if dsts, err = lb.client.Destinations(svc); err != nil {
+				return nil, fmt.Errorf("error listing backends: %w", err)
+			}
+		}
+		for x := range dsts {
+			i, ok := index[backendKey(dsts[x].Address.Net(dsts[x].Family).String(), int(dsts[x].Port))]
+			if !ok {
+				continue
+			}
+			backends[i].ActiveConnections += int(dsts[x].ActiveConnections)
+			backends[i].InactiveConnections += int(dsts[x].InactiveConnections)
+			backends[i].PersistentConnections += int(dsts[x].PersistentConnections)
+		}
+	}
+	return backends, nil
+}
+
+// BackendError is the failure of an operation on a single backend
+type BackendError struct {
+	Backend Backend
+	Err     error
+}
+
+func (e BackendError) Error() string {
+	return fmt.Sprintf("[%s] %v", backendKey(e.Backend.Address, e.Backend.Port), e.Err)
+}
+
+func (e BackendError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned when one or more backends of a batch operation have failed, it can be
+// retrieved with errors.As to find exactly which backends failed
+type BatchError []BackendError
+
+func (e BatchError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for x := range e {
+		msgs = append(msgs, e[x].Error())
+	}
+	return fmt.Sprintf("%d backend operations failed: %s", len(e), strings.Join(msgs, ", "))
+}
+
+// Is allows errors.Is to match the error of any of the backends that failed
+func (e BatchError) Is(target error) bool {
+	for x := range e {
+		if errors.Is(e[x], target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Backends returns the backends that failed
+func (e BatchError) Backends() []Backend {
+	backends := make([]Backend, 0, len(e))
+	for x := range e {
+		backends = append(backends, e[x].Backend)
+	}
+	return backends
+}
+
+// AddBackends will add multiple backends with their forwarding methods (see Backend.FwdMethod) whilst
+// holding the lock once, the IPVS netlink API has no batch operation so each backend is still a separate request. Every
+// backend is attempted, any that fail are returned as a BatchError.
+func (lb *IPVSLoadBalancer) AddBackends(backends []Backend) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+
+	var failed BatchError
+	for x := range backends {
+		err := lb.addBackendWithThresholds(context.Background(), backends[x].Address, backends[x].Port, backends[x].Weight,
+			lb.forwardMethodOf(backends[x]), backends[x].UpperThreshold, backends[x].LowerThreshold)
+		if err != nil {
+			failed = append(failed, BackendError{Backend: backends[x], Err: err})
+		}
+	}
+	if len(failed) != 0 {
+		return failed
+	}
+	return nil
+}
+
+// ReplaceBackend will swap a registered backend for a new address and port (such as when the IP of a node
+// changes) without a window where the load balancer has one fewer backend, the new backend is added before
+// the old backend is removed. The new backend takes the weight, forwarding method and thresholds of the old
+// backend (only the Address and Port of the new Backend are used), a backend quiesced by the health checker
+// is replaced with its configured weight. If the old backend can't be removed then the new backend is removed
+// again, so that the backend isn't registered twice, and the error is returned.
+func (lb *IPVSLoadBalancer) ReplaceBackend(old, new Backend) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+
+	found, err := lb.findBackend(old.Address, old.Port)
+	if err != nil {
+		return err
+	}
+	ip, _, err := parseAddress(new.Address)
+	if err != nil {
+		return err
+	}
+	oldKey := backendKey(found.Address, found.Port)
+	newKey := backendKey(ip.String(), new.Port)
+	if oldKey == newKey {
+		return nil
+	}
+	if _, err = lb.findBackend(new.Address, new.Port); err == nil {
+		return fmt.Errorf("backend [%s]: %w, it can't replace [%s]", newKey, ErrAlreadyExists, oldKey)
+	}
+
+	replacement := found
+	replacement.Address, replacement.Port = ip.String(), new.Port
+	if h, ok := lb.health[oldKey]; ok && h.quiesced {
+		replacement.Weight = h.weight
+	}
+	err = lb.addBackendWithThresholds(context.Background(), replacement.Address, replacement.Port, replacement.Weight,
+		replacement.FwdMethod, replacement.UpperThreshold, replacement.LowerThreshold)
+	if err != nil {
+		return err
+	}
+	// removeBackend succeeds if the old backend has already been removed from IPVS, which leaves no duplicate
+	if err = lb.removeBackend(context.Background(), found.Address, found.Port); err != nil {
+		if rmErr := lb.removeBackend(context.Background(), replacement.Address, replacement.Port); rmErr != nil {
+			return fmt.Errorf("%w, unable to roll back the replacement backend [%v]", err, rmErr)
+		}
+		return err
+	}
+
+	lb.setDesired(replacement)
+	delete(lb.health, oldKey)
+	lb.logEntry(opUpdateBackend).WithFields(Fields{"backend": newKey, "replaced": oldKey}).Info("replaced backend")
+	return nil
+}
+
+// RemoveBackends will remove multiple backends whilst holding the lock once, a backend that isn't registered
+// is treated as removed so that a partial cleanup can be completed by calling it again (a missing service is
+// still an ErrServiceNotFound). Every backend is attempted, any that fail are returned as a BatchError (see
+// BatchError.Backends) so they can be retried.
+func (lb *IPVSLoadBalancer) RemoveBackends(backends []Backend) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+
+	var failed BatchError
+	for x := range backends {
+		err := lb.removeBackend(context.Background(), backends[x].Address, backends[x].Port)
+		if err != nil && !errors.Is(err, syscall.ENOENT) {
+			failed = append(failed, BackendError{Backend: backends[x], Err: err})
+		}
+	}
+	if len(failed) != 0 {
+		return failed
+	}
+	return nil
+}
+
+// ClearBackends will remove every backend whilst leaving the IPVS services in place, such as during a
+// leadership handoff so that the new leader can add its backends without the services being re-created.
+// The services keep their configuration and statistics, and existing connection entries are left to expire
+// in the kernel (unless the expire_nodest_conn sysctl is set, which drops them once their backend is gone).
+func (lb *IPVSLoadBalancer) ClearBackends() error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+
+	var errs []error
+	for _, svc := range lb.services() {
+		svc := svc
+		dsts, err := lb.client.Destinations(svc)
+		if err != nil {
+			errs = append(errs, newError(opRemoveBackend, svc, "", fmt.Errorf("error listing backends: %w", err)))
+			continue
+		}
+		for x := range dsts {
+			dst := dsts[x].Destination
+			key := backendKey(dst.Address.Net(dst.Family).String(), int(dst.Port))
+			err = lb.retry(context.Background(), opRemoveBackend, func() error { return lb.client.RemoveDestination(svc, dst) })
+			recordOperation(opRemoveBackend, err)
+			// Only a backend that has already gone (ENOENT) is removed, a missing service (ESRCH) is an error
+			if err != nil && !errors.Is(err, syscall.ENOENT) {
+				errs = append(errs, newError(opRemoveBackend, svc, key, err))
+				continue
+			}
+			delete(lb.desired, key)
+			delete(lb.health, key)
+			delete(lb.sctpAddresses, key)
+		}
+	}
+	lb.logEntry(opRemoveBackend).Info("cleared backends")
+	return utilerrors.NewAggregate(errs)
+}
+
+// weightOf returns the weight of a backend from the weight function (see WithWeightFunc), or the weight of
+// the backend if there is no weight function. A weight outside of the valid range is logged and the
+// default weight is used instead, so a faulty function can't prevent a backend from being registered.
+func (lb *IPVSLoadBalancer) weightOf(backend Backend) int {
+	if lb.weightFunc == nil {
+		return backend.Weight
+	}
+	weight := lb.weightFunc(backend)
+	if err := validateWeight(weight, 0); err != nil {
+		lb.logEntry(opAddBackend).WithField("backend", backendKey(backend.Address, backend.Port)).
+			Warnf("the weight function returned an invalid weight, using the default weight [%d] [%v]", lb.defaultWeight, err)
+		return lb.defaultWeight
+	}
+	return weight
+}
+
+// applyWeightFunc returns a copy of the backends with their weights from the weight function, the backends
+// are returned unchanged if there is no weight function
+func (lb *IPVSLoadBalancer) applyWeightFunc(backends []Backend) []Backend {
+	if lb.weightFunc == nil {
+		return backends
+	}
+	weighted := make([]Backend, len(backends))
+	for x := range backends {
+		weighted[x] = backends[x]
+		weighted[x].Weight = lb.weightOf(backends[x])
+	}
+	return weighted
+}
+
+// SyncResult lists the backends that were changed by SyncBackends, a backend is only listed once its
+// change has been applied so the result is accurate even when some of the changes failed
+type SyncResult struct {
+	Added   []Backend
+	Removed []Backend
+	Updated []Backend
+}
+
+// SyncBackends will reconcile the backends registered with the IPVS service against the desired set,
+// missing backends are added, backends that are no longer desired are removed and any backends with a
+// changed weight or forwarding method are updated. The weights are computed by the weight function if the
+// load balancer was created WithWeightFunc. All operations are attempted and any errors are returned as an aggregate
+// along with the changes that were applied.
+func (lb *IPVSLoadBalancer) SyncBackends(desired []Backend) (SyncResult, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+
+	var result SyncResult
+	current, err := lb.listBackends(false)
+	if err != nil {
+		return result, err
+	}
+
+	existing := make(map[string]Backend, len(current))
+	for x := range current {
+		existing[backendKey(current[x].Address, current[x].Port)] = current[x]
+	}
+
+	desired = lb.applyWeightFunc(desired)
+	var errs []error
+	wanted := make(map[string]bool, len(desired))
+	for x := range desired {
+		ip, _, err := parseAddress(desired[x].Address)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		key := backendKey(ip.String(), desired[x].Port)
+		if wanted[key] {
+			continue
+		}
+		wanted[key] = true
+
+		fwd := lb.forwardMethodOf(desired[x])
+		found, ok := existing[key]
+		if !ok {
+			err = lb.addBackendWithThresholds(context.Background(), desired[x].Address, desired[x].Port, desired[x].Weight,
+				fwd, desired[x].UpperThreshold, desired[x].LowerThreshold)
+			if err == nil {
+				result.Added = append(result.Added, desired[x])
+			}
+		} else if found.FwdMethod != fwd {
+			updated := found
+			updated.FwdMethod = fwd
+			if lb.isQuiesced(key) {
+				lb.health[key].weight = desired[x].Weight
+			} else {
+				updated.Weight = desired[x].Weight
+			}
+			err = lb.updateForwardMethod(found, updated)
+			if err == nil {
+				desiredBackend := updated
+				desiredBackend.Weight = desired[x].Weight
+				lb.setDesired(desiredBackend)
+				result.Updated = append(result.Updated, updated)
+			}
+		} else if lb.isQuiesced(key) {
+			// Leave the backend quiesced, but restore the desired weight once it is healthy
+			lb.health[key].weight = desired[x].Weight
+			lb.setDesiredWeight(key, desired[x].Weight)
+		} else if found.Weight != desired[x].Weight {
+			err = lb.updateBackend(found, desired[x].Weight)
+			if err == nil {
+				lb.setDesiredWeight(key, desired[x].Weight)
+				found.Weight = desired[x].Weight
+				result.Updated = append(result.Updated, found)
+			}
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for key, backend := range existing {
+		if wanted[key] {
+			continue
+		}
+		err = lb.removeBackend(context.Background(), backend.Address, backend.Port)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		result.Removed = append(result.Removed, backend)
+	}
+
+	lb.logEntry(opSyncBackends).WithFields(Fields{
+		"added":   len(result.Added),
+		"removed": len(result.Removed),
+		"updated": len(result.Updated),
+		"errors":  len(errs),
+	}).Infof("reconciled: +%d -%d ~%d", len(result.Added), len(result.Removed), len(result.Updated))
+	return result, utilerrors.NewAggregate(errs)
+}
+
+// UpdateBackendWeight will change the weight of an existing backend without affecting the connections
+// that IPVS is already tracking, a weight of 0 quiesces the backend so that it receives no new connections
+// whilst existing connections are preserved
+func (lb *IPVSLoadBalancer) UpdateBackendWeight(address string, port, weight int) error {
+	if err := validateWeight(weight, 0); err != nil {
+		return err
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.notifyWatchers()
+
+	backend, err := lb.findBackend(address, port)
+	if err != nil {
+		return err
+	}
+
+	key := backendKey(backend.Address, backend.Port)
+	if lb.isQuiesced(key) {
+		// The health checker will apply the weight once the backend is healthy again
+		lb.health[key].weight = weight
+		lb.setDesiredWeight(key, weight)
+		return nil
+	}
+	if err = lb.updateBackend(backend, weight); err != nil {
+		return err
+	}
+	lb.setDesiredWeight(key, weight)
+	return nil
+}
+
+// GetBackendWeight returns the current weight of a backend, or ErrBackendNotFound if it isn't registered.
+// The weight of a backend quiesced by the health checker is 0 even though its configured weight will be
+// restored once it is healthy.
+func (lb *IPVSLoadBalancer) GetBackendWeight(address string, port int) (int, error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	backend, err := lb.findBackend(address, port)
+	if err != nil {
+		return 0, err
+	}
+	return backend.Weight, nil
+}
+
+// SetBackendThresholds will set the connection thresholds of an existing backend, which IPVS uses for
+// overflow control to protect a backend (such as a cold control plane node) from too many connections.
+// Once the backend has more than the upper threshold of connections (active plus inactive) the kernel
+// marks it as overloaded and schedules no new connections to it, the overload is cleared once it falls
+// below the lower threshold (or three quarters of the upper threshold when the lower threshold is 0). An
+// upper threshold of 0 disables the limit, in which case the lower threshold must also be 0.
+func (lb *IPVSLoadBalancer) SetBackendThresholds(address string, port, upper, lower int) error {
+	if err := validateThresholds(upper, lower); err != nil {
+		return err
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.notifyWatchers()
+
+	backend, err := lb.findBackend(address, port)
+	if err != nil {
+		return err
+	}
+	backend.UpperThreshold, backend.LowerThreshold = upper, lower
+	if err = lb.updateDestination(opUpdateBackend, backend); err != nil {
+		return err
+	}
+	if desired, ok := lb.desired[backendKey(backend.Address, backend.Port)]; ok {
+		desired.UpperThreshold, desired.LowerThreshold = upper, lower
+		lb.desired[backendKey(backend.Address, backend.Port)] = desired
+	}
+	return nil
+}
+
+// validateThresholds returns an error if the connection thresholds of a backend are invalid
+func validateThresholds(upper, lower int) error {
+	if upper < 0 || lower < 0 || upper > MaxWeight || lower > MaxWeight {
+		return fmt.Errorf("invalid connection thresholds [%d/%d], must be between 0 and %d", upper, lower, MaxWeight)
+	}
+	if lower > upper {
+		return fmt.Errorf("invalid connection thresholds, the lower threshold [%d] must not exceed the upper threshold [%d]", lower, upper)
+	}
+	return nil
+}
+
+// drainPollInterval is how often the active connections of a draining backend are checked
+var drainPollInterval = time.Second
+
+// DrainBackend will gracefully remove a backend, the weight is set to 0 so that it receives no new
+// connections and the backend is only removed once its active connections have closed. If connections
+// remain once the timeout has passed then the backend is removed regardless and the connections are dropped.
+func (lb *IPVSLoadBalancer) DrainBackend(address string, port int, timeout time.Duration) error {
+	_, _, err := lb.drainBackend(address, port, timeout)
+	return err
+}
+
+// drainBackend drains and removes a backend as DrainBackend, it returns the active connections of the
+// backend once it was quiesced and those that remained (and were dropped) when it was removed
+func (lb *IPVSLoadBalancer) drainBackend(address string, port int, timeout time.Duration) (int, int, error) {
+	lb.mu.Lock()
+	backend, err := lb.quiesceBackend(address, port)
+	lb.mu.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	logEntry := lb.logEntry(opDrainBackend).WithField("backend", backendKey(backend.Address, backend.Port))
+	logEntry.Info("draining backend")
+
+	deadline := time.Now().Add(timeout)
+	active, err := lb.activeConnections(backend)
+	initial := active
+	for err == nil && active > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+		active, err = lb.activeConnections(backend)
+	}
+	if err != nil {
+		return initial, 0, err
+	}
+	if active > 0 {
+		logEntry.WithField("connections", active).Warn("backend drain timed out, dropping active connections")
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+	return initial, active, lb.removeBackend(context.Background(), backend.Address, backend.Port)
+}
+
+// DrainSummary is the outcome of draining the backends of a node, see DrainNode
+type DrainSummary struct {
+	// Backends are the backends of the node that were drained and removed
+	Backends []Backend
+	// Drained are the active connections that closed whilst the backends were draining and Dropped are
+	// those that remained once the timeout had passed
+	Drained int
+	Dropped int
+}
+
+// DrainNode will gracefully remove every backend of a node (such as when it is cordoned), each backend with
+// the address is drained as DrainBackend so that it receives no new connections and is removed once its
+// active connections have closed or the timeout has passed. The backends are drained concurrently so the
+// timeout bounds the whole drain. The summary covers the backends that were removed, any failures are
+// returned together. A node without any backends is not an error.
+func (lb *IPVSLoadBalancer) DrainNode(address string, timeout time.Duration) (DrainSummary, error) {
+	var summary DrainSummary
+	ip, _, err := parseAddress(address)
+	if err != nil {
+		return summary, err
+	}
+	backends, err := lb.ListBackends()
+	if err != nil {
+		return summary, err
+	}
+
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for x := range backends {
+		if !ip.Equal(net.ParseIP(backends[x].Address)) {
+			continue
+		}
+		backend := backends[x]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			initial, dropped, err := lb.drainBackend(backend.Address, backend.Port, timeout)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			summary.Backends = append(summary.Backends, backend)
+			if initial > dropped {
+				summary.Drained += initial - dropped
+			}
+			summary.Dropped += dropped
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(summary.Backends, func(i, j int) bool {
+		return backendKey(summary.Backends[i].Address, summary.Backends[i].Port) < backendKey(summary.Backends[j].Address, summary.Backends[j].Port)
+	})
+	return summary, utilerrors.NewAggregate(errs)
+}
+
+// quiesceBackend sets the weight of a backend to 0 so that it receives no new connections before it is
+// removed, the caller must hold the write lock
+func (lb *IPVSLoadBalancer) quiesceBackend(address string, port int) (Backend, error) {
+	backend, err := lb.findBackend(address, port)
+	if err != nil {
+		return backend, err
+	}
+	// Stop the health checker from restoring the weight of the backend
+	delete(lb.health, backendKey(backend.Address, backend.Port))
+	if err = lb.updateBackend(backend, 0); err != nil {
+		return backend, err
+	}
+	lb.setDesiredWeight(backendKey(backend.Address, backend.Port), 0)
+	return backend, nil
+}
+
+// activeConnections returns the active connections of a backend across every service
+func (lb *IPVSLoadBalancer) activeConnections(backend Backend) (int, error) {
+	backends, err := lb.ListBackendsWithStats()
+	if err != nil {
+		return 0, err
+	}
+	key := backendKey(backend.Address, backend.Port)
+	for x := range backends {
+		if backendKey(backends[x].Address, backends[x].Port) == key {
+			return backends[x].ActiveConnections, nil
+		}
+	}
+	return 0, nil
+}
+
+// HasBackend returns true if a backend is registered with the IPVS service
+func (lb *IPVSLoadBalancer) HasBackend(address string, port int) (bool, error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	_, err := lb.findBackend(address, port)
+	if errors.Is(err, ErrBackendNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// findBackend returns a registered backend, or ErrBackendNotFound if it isn't registered, the caller must
+// hold the lock
+func (lb *IPVSLoadBalancer) findBackend(address string, port int) (Backend, error) {
+	ip, _, err := parseAddress(address)
+	if err != nil {
+		return Backend{}, err
+	}
+	if err = validatePort(port); err != nil {
+		return Backend{}, err
+	}
+
+	backends, err := lb.listBackends(false)
+	if err != nil {
+		return Backend{}, err
+	}
+	key := backendKey(ip.String(), port)
+	for x := range backends {
+		if backendKey(backends[x].Address, backends[x].Port) == key {
+			return backends[x], nil
+		}
+	}
+	return Backend{}, fmt.Errorf("backend [%s]: %w", key, ErrBackendNotFound)
+}
+
+// updateBackend will change the weight of an existing backend, the caller must hold the write lock
+func (lb *IPVSLoadBalancer) updateBackend(backend Backend, weight int) error {
+	if err := validateWeight(weight, 0); err != nil {
+		return err
+	}
+	backend.Weight = weight
+	return lb.updateDestination(opUpdateBackend, backend)
+}
+
+// forwardMethodOf returns the forwarding method of a backend, the zero value (Masquarade) is treated as
+// unset and the forwarding method of the load balancer is used instead
+func (lb *IPVSLoadBalancer) forwardMethodOf(backend Backend) ipvs.ForwardType {
+	if backend.FwdMethod == ipvs.Masquarade {
+		return lb.forwardMethod
+	}
+	return backend.FwdMethod
+}
+
+// updateForwardMethod will change the forwarding method (and weight) of an existing backend to the updated
+// backend, editing the destination in place. If the kernel can't edit it (EOPNOTSUPP) then the destination
+// is removed and re-added, which resets its connections. The caller must hold the write lock.
+func (lb *IPVSLoadBalancer) updateForwardMethod(found, updated Backend) error {
+	if !forwardMethods[updated.FwdMethod] {
+		return newError(opUpdateBackend, lb.loadBalancerService, backendKey(found.Address, found.Port),
+			fmt.Errorf("unsupported forwarding method [%s]", updated.FwdMethod))
+	}
+	ip, family, err := parseAddress(found.Address)
+	if err != nil {
+		return err
+	}
+	// A backend of a different address family can only be tunnelled to
+	if family != lb.loadBalancerService.Family && updated.FwdMethod != ipvs.Tunnel {
+		return newError(opUpdateBackend, lb.loadBalancerService, backendKey(found.Address, found.Port), lb.familyMismatch(ip, family))
+	}
+
+	err = lb.updateDestination(opUpdateBackend, updated)
+	if !errors.Is(err, syscall.EOPNOTSUPP) {
+		return err
+	}
+	lb.logEntry(opUpdateBackend).WithField("backend", backendKey(found.Address, found.Port)).
+		Warnf("unable to edit the forwarding method in place, re-adding the backend as %s", updated.FwdMethod)
+	if err = lb.removeBackend(context.Background(), found.Address, found.Port); err != nil {
+		return err
+	}
+	return lb.addBackendWithThresholds(context.Background(), updated.Address, updated.Port, updated.Weight,
+		updated.FwdMethod, updated.UpperThreshold, updated.LowerThreshold)
+}
+
+// updateDestination will apply the weight, forwarding method and thresholds of an existing backend to
+// every service, the caller must hold the write lock
+func (lb *IPVSLoadBalancer) updateDestination(operation string, backend Backend) error {
+	dst, err := backendDestination(backend)
+	if err != nil {
+		return err
+	}
+	key := backendKey(dst.Address.Net(dst.Family).String(), backend.Port)
+	for _, svc := range lb.services() {
+		svc := svc
+		err = lb.retry(context.Background(), operation, func() error {
+			return lb.client.UpdateDestination(svc, dst)
+		})
+		if err != nil {
+			return newError(operation, svc, key, err)
+		}
+	}
+	return nil
+}
+
+// backendKey returns a key that identifies a backend by its address and port
+func backendKey(address string, port int) string {
+	return net.JoinHostPort(address, strconv.Itoa(port))
+}
@@ -0,0 +1,1239 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/ipvs"
+)
+
+func TestAddBackends(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+
+	err := lb.AddBackends([]Backend{
+		{Address: "10.0.0.1", Port: 6443, Weight: 1},
+		{Address: "not-an-address", Port: 6443, Weight: 1},
+		{Address: "10.0.0.2", Port: 6443, Weight: 2},
+		{Address: "10.0.0.3", Port: 0, Weight: 1},
+	})
+
+	var batchErr BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("AddBackends() error = %v, expected a BatchError", err)
+	}
+	failed := batchErr.Backends()
+	if len(failed) != 2 || failed[0].Address != "not-an-address" || failed[1].Address != "10.0.0.3" {
+		t.Errorf("AddBackends() failed backends = %+v", failed)
+	}
+
+	backends, _ := lb.ListBackends()
+	if len(backends) != 2 {
+		t.Errorf("AddBackends() registered %d backends, expected 2", len(backends))
+	}
+}
+
+func benchmarkBackends(n int) []Backend {
+	backends := make([]Backend, 0, n)
+	for x := 0; x < n; x++ {
+		backends = append(backends, Backend{Address: fmt.Sprintf("10.0.%d.%d", x/250, x%250+1), Port: 6443, Weight: 1})
+	}
+	return backends
+}
+
+func BenchmarkAddBackend(b *testing.B) {
+	backends := benchmarkBackends(100)
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		lb, _ := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443)
+		b.StartTimer()
+		for x := range backends {
+			_ = lb.AddBackendWithWeight(backends[x].Address, backends[x].Port, backends[x].Weight)
+		}
+	}
+}
+
+func BenchmarkAddBackends(b *testing.B) {
+	backends := benchmarkBackends(100)
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		lb, _ := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443)
+		b.StartTimer()
+		_ = lb.AddBackends(backends)
+	}
+}
+
+func TestRemoveBackends(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	backends := benchmarkBackends(4)
+	if err := lb.AddBackends(backends[:3]); err != nil {
+		t.Fatalf("AddBackends() error = %v", err)
+	}
+
+	// The last backend isn't registered, and removing the second fails
+	c.injectErrors("RemoveDestination", nil, syscall.EPERM)
+	err := lb.RemoveBackends(backends)
+	var batchErr BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("RemoveBackends() error = %v, expected a BatchError", err)
+	}
+	if failed := batchErr.Backends(); len(failed) != 1 || failed[0].Address != backends[1].Address {
+		t.Errorf("BatchError.Backends() = %+v, expected the second backend", failed)
+	}
+
+	if err = lb.RemoveBackends(batchErr.Backends()); err != nil {
+		t.Fatalf("RemoveBackends() retry error = %v", err)
+	}
+	if remaining, _ := lb.ListBackends(); len(remaining) != 0 {
+		t.Errorf("ListBackends() = %+v, expected every backend to be removed", remaining)
+	}
+
+	// A backend of a service that has been removed isn't treated as removed
+	if err = lb.AddBackends(backends[:1]); err != nil {
+		t.Fatalf("AddBackends() error = %v", err)
+	}
+	c.injectErrors("RemoveDestination", syscall.ESRCH)
+	if err = lb.RemoveBackends(backends[:1]); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("RemoveBackends() error = %v, expected ErrServiceNotFound", err)
+	}
+}
+
+func TestAddPortRollback(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	for _, address := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if err := lb.AddBackend(address, 6443); err != nil {
+			t.Fatalf("AddBackend() error = %v", err)
+		}
+	}
+
+	// The second backend fails to be copied to the new port
+	c.injectErrors("CreateDestination", nil, syscall.EPERM)
+	if err := lb.AddPort(8443); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("AddPort() error = %v, expected EPERM", err)
+	}
+	if len(c.services) != 1 {
+		t.Errorf("AddPort() left %d IPVS services, expected only the primary service", len(c.services))
+	}
+	if ports := lb.Snapshot().Ports; len(ports) != 1 {
+		t.Errorf("AddPort() registered the ports %v, expected only the primary port", ports)
+	}
+
+	c.injectErrors("Destinations", syscall.EPERM)
+	if err := lb.AddPort(8443); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("AddPort() error = %v, expected EPERM", err)
+	}
+	if len(c.services) != 1 {
+		t.Errorf("AddPort() left %d IPVS services, expected only the primary service", len(c.services))
+	}
+
+	// The port can be added once the backends can be copied
+	if err := lb.AddPort(8443); err != nil {
+		t.Fatalf("AddPort() error = %v", err)
+	}
+	svc := lb.loadBalancerService
+	svc.Port = 8443
+	if dsts, _ := c.Destinations(svc); len(dsts) != 3 {
+		t.Errorf("AddPort() copied %d backends, expected 3", len(dsts))
+	}
+}
+
+func TestRemoveBackendAllPorts(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	if err := lb.AddPort(8443); err != nil {
+		t.Fatalf("AddPort() error = %v", err)
+	}
+	for _, backend := range []Backend{{Address: "10.0.0.1", Port: 6443}, {Address: "10.0.0.1", Port: 10250}, {Address: "10.0.0.2", Port: 6443}} {
+		if err := lb.AddBackend(backend.Address, backend.Port); err != nil {
+			t.Fatalf("AddBackend() error = %v", err)
+		}
+	}
+
+	if err := lb.RemoveBackendAllPorts("10.0.0.1"); err != nil {
+		t.Fatalf("RemoveBackendAllPorts() error = %v", err)
+	}
+	for _, svc := range lb.services() {
+		dsts, _ := c.Destinations(svc)
+		if len(dsts) != 1 || dsts[0].Address.Net(dsts[0].Family).String() != "10.0.0.2" {
+			t.Errorf("port %d has backends %+v, expected only 10.0.0.2", svc.Port, dsts)
+		}
+	}
+	if backends := mustListBackends(t, lb); len(backends) != 1 {
+		t.Errorf("ListBackends() = %+v, expected only 10.0.0.2", backends)
+	}
+	if err := lb.RemoveBackendAllPorts("10.0.0.3"); err != nil {
+		t.Errorf("RemoveBackendAllPorts() of an address without backends error = %v", err)
+	}
+
+	// A backend that has already gone from a port is treated as removed
+	if err := lb.AddBackend("10.0.0.3", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	c.injectErrors("RemoveDestination", syscall.ENOENT)
+	if err := lb.RemoveBackendAllPorts("10.0.0.3"); err != nil {
+		t.Fatalf("RemoveBackendAllPorts() of a backend that has gone error = %v", err)
+	}
+	if backends := lb.Snapshot().Backends; len(backends) != 1 || backends[0].Address != "10.0.0.2" {
+		t.Errorf("Snapshot().Backends = %+v, expected the backend that has gone to be forgotten", backends)
+	}
+	// The injected failure left the backend registered with one port
+	if err := lb.RemoveBackendAllPorts("10.0.0.3"); err != nil {
+		t.Fatalf("RemoveBackendAllPorts() error = %v", err)
+	}
+
+	// The failures of every port are returned and the backend is kept until it has been removed
+	c.injectErrors("RemoveDestination", syscall.EPERM, syscall.EPERM)
+	err := lb.RemoveBackendAllPorts("10.0.0.2")
+	if !errors.Is(err, syscall.EPERM) || !strings.Contains(err.Error(), "192.168.0.1:8443") {
+		t.Fatalf("RemoveBackendAllPorts() error = %v, expected the failures of both ports", err)
+	}
+	if backends := mustListBackends(t, lb); len(backends) != 1 {
+		t.Errorf("ListBackends() = %+v, expected the backend to be kept", backends)
+	}
+	if err = lb.RemoveBackendAllPorts("10.0.0.2"); err != nil {
+		t.Fatalf("RemoveBackendAllPorts() error = %v", err)
+	}
+	if backends := mustListBackends(t, lb); len(backends) != 0 {
+		t.Errorf("ListBackends() = %+v, expected no backends", backends)
+	}
+}
+
+func TestClearBackends(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	if err := lb.AddPort(443); err != nil {
+		t.Fatalf("AddPort() error = %v", err)
+	}
+	if err := lb.AddBackends(benchmarkBackends(3)); err != nil {
+		t.Fatalf("AddBackends() error = %v", err)
+	}
+	c.services[fakeServiceKey(lb.loadBalancerService)].stats = ipvs.Stats{Connections: 3}
+
+	if err := lb.ClearBackends(); err != nil {
+		t.Fatalf("ClearBackends() error = %v", err)
+	}
+	for _, svc := range lb.services() {
+		if dsts, _ := c.Destinations(svc); len(dsts) != 0 {
+			t.Errorf("port %d has %d backends, expected none", svc.Port, len(dsts))
+		}
+	}
+	stats, err := lb.ServiceStats()
+	if err != nil {
+		t.Fatalf("ServiceStats() error = %v, expected the service to be kept", err)
+	}
+	if stats.Connections != 3 {
+		t.Errorf("ServiceStats() = %+v, expected the service statistics to be kept", stats)
+	}
+
+	if err = lb.AddBackend("10.0.1.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	if backends, _ := lb.ListBackends(); len(backends) != 1 {
+		t.Errorf("ListBackends() = %+v, expected the new backend", backends)
+	}
+
+	c.injectErrors("RemoveDestination", syscall.ESRCH)
+	if err = lb.ClearBackends(); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("ClearBackends() error = %v, expected ErrServiceNotFound", err)
+	}
+	if backends, _ := lb.ListBackends(); len(backends) != 1 {
+		t.Errorf("ListBackends() = %+v, expected the backend to be kept", backends)
+	}
+}
+
+func BenchmarkRemoveBackend(b *testing.B) {
+	backends := benchmarkBackends(100)
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		lb, _ := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443)
+		_ = lb.AddBackends(backends)
+		b.StartTimer()
+		for x := range backends {
+			_ = lb.RemoveBackend(backends[x].Address, backends[x].Port)
+		}
+	}
+}
+
+func BenchmarkRemoveBackends(b *testing.B) {
+	backends := benchmarkBackends(100)
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		lb, _ := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443)
+		_ = lb.AddBackends(backends)
+		b.StartTimer()
+		_ = lb.RemoveBackends(backends)
+	}
+}
+
+func TestDrainBackend(t *testing.T) {
+	drainPollInterval = time.Millisecond
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+
+	for _, address := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := lb.AddBackendWithWeight(address, 6443, 5); err != nil {
+			t.Fatalf("AddBackendWithWeight() error = %v", err)
+		}
+	}
+	// The second backend keeps its connections open beyond the timeout
+	c.setActiveConnections(ipvs.Destination{Address: ipvs.NewIP(net.ParseIP("10.0.0.2").To4()), Port: 6443, Family: ipvs.INET}, 2)
+
+	for _, address := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := lb.DrainBackend(address, 6443, 10*time.Millisecond); err != nil {
+			t.Fatalf("DrainBackend() error = %v", err)
+		}
+	}
+	if backends, _ := lb.ListBackends(); len(backends) != 0 {
+		t.Errorf("DrainBackend() left %d backends, expected 0", len(backends))
+	}
+
+	if err := lb.DrainBackend("10.0.0.3", 6443, time.Millisecond); !errors.Is(err, ErrBackendNotFound) {
+		t.Errorf("DrainBackend() of a missing backend error = %v, expected ErrBackendNotFound", err)
+	}
+}
+
+func TestDrainNode(t *testing.T) {
+	drainPollInterval = time.Millisecond
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	for _, backend := range []Backend{{Address: "10.0.0.1", Port: 6443}, {Address: "10.0.0.1", Port: 8443}, {Address: "10.0.0.2", Port: 6443}} {
+		if err := lb.AddBackend(backend.Address, backend.Port); err != nil {
+			t.Fatalf("AddBackend() error = %v", err)
+		}
+	}
+	// The connections of the first backend remain beyond the timeout whilst those of the second close
+	c.setActiveConnections(ipvs.Destination{Address: ipvs.NewIP(net.ParseIP("10.0.0.1").To4()), Port: 6443, Family: ipvs.INET}, 2)
+	closing := ipvs.Destination{Address: ipvs.NewIP(net.ParseIP("10.0.0.1").To4()), Port: 8443, Family: ipvs.INET}
+	c.setActiveConnections(closing, 3)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		c.setActiveConnections(closing, 0)
+	}()
+
+	summary, err := lb.DrainNode("10.0.0.1", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("DrainNode() error = %v", err)
+	}
+	if len(summary.Backends) != 2 || summary.Backends[0].Port != 6443 || summary.Backends[1].Port != 8443 {
+		t.Errorf("DrainNode() drained %+v, expected both backends of the node", summary.Backends)
+	}
+	if summary.Drained != 3 || summary.Dropped != 2 {
+		t.Errorf("DrainNode() drained %d and dropped %d connections, expected 3 and 2", summary.Drained, summary.Dropped)
+	}
+	backends := mustListBackends(t, lb)
+	if len(backends) != 1 || backends[0].Address != "10.0.0.2" {
+		t.Errorf("ListBackends() = %+v, expected only the backend of the other node", backends)
+	}
+
+	if summary, err = lb.DrainNode("10.0.0.3", time.Millisecond); err != nil || len(summary.Backends) != 0 {
+		t.Errorf("DrainNode() of a node without backends = %+v, %v, expected an empty summary", summary, err)
+	}
+	if _, err = lb.DrainNode("bogus", time.Millisecond); err == nil {
+		t.Errorf("DrainNode() of an invalid address should return an error")
+	}
+}
+
+func TestListBackendsWithStats(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	if err := lb.AddPort(8443); err != nil {
+		t.Fatalf("AddPort() error = %v", err)
+	}
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	c.setActiveConnections(ipvs.Destination{Address: ipvs.NewIP(net.ParseIP("10.0.0.1").To4()), Port: 6443, Family: ipvs.INET}, 2)
+
+	backends, _ := lb.ListBackends()
+	if backends[0].ActiveConnections != 0 {
+		t.Errorf("ListBackends() populated the connection counts")
+	}
+	backends, err := lb.ListBackendsWithStats()
+	if err != nil {
+		t.Fatalf("ListBackendsWithStats() error = %v", err)
+	}
+	// The active connections of both ports are summed
+	if backends[0].ActiveConnections != 4 {
+		t.Errorf("ListBackendsWithStats() active connections = %d, expected 4", backends[0].ActiveConnections)
+	}
+}
+
+func TestSyncBackendsResult(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	for _, address := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if err := lb.AddBackend(address, 6443); err != nil {
+			t.Fatalf("AddBackend() error = %v", err)
+		}
+	}
+
+	// The removal of 10.0.0.3 fails, so it isn't reported as removed
+	c.injectErrors("RemoveDestination", syscall.EPERM)
+	result, err := lb.SyncBackends([]Backend{
+		{Address: "10.0.0.1", Port: 6443, Weight: 1},
+		{Address: "10.0.0.2", Port: 6443, Weight: 5},
+		{Address: "10.0.0.4", Port: 6443, Weight: 1},
+		{Address: "10.0.0.5", Port: 6443, Weight: 1},
+	})
+	if err == nil {
+		t.Errorf("SyncBackends() should return the failed removal")
+	}
+	if len(result.Added) != 2 || len(result.Updated) != 1 || len(result.Removed) != 0 {
+		t.Errorf("SyncBackends() result = %+v, expected +2 -0 ~1", result)
+	}
+	if result.Updated[0].Address != "10.0.0.2" || result.Updated[0].Weight != 5 {
+		t.Errorf("SyncBackends() updated = %+v, expected 10.0.0.2 with weight 5", result.Updated[0])
+	}
+
+	result, err = lb.SyncBackends([]Backend{{Address: "10.0.0.1", Port: 6443, Weight: 1}})
+	if err != nil {
+		t.Fatalf("SyncBackends() error = %v", err)
+	}
+	if len(result.Added) != 0 || len(result.Updated) != 0 || len(result.Removed) != 4 {
+		t.Errorf("SyncBackends() result = %+v, expected +0 -4 ~0", result)
+	}
+}
+
+func TestSyncBackendsForwardMethods(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	forwardMethods := func() map[string]ipvs.ForwardType {
+		backends, err := lb.ListBackends()
+		if err != nil {
+			t.Fatalf("ListBackends() error = %v", err)
+		}
+		methods := map[string]ipvs.ForwardType{}
+		for x := range backends {
+			methods[backends[x].Address] = backends[x].FwdMethod
+		}
+		return methods
+	}
+
+	// An unset forwarding method uses the default of the load balancer (Local)
+	if err := lb.AddBackends([]Backend{
+		{Address: "10.0.0.1", Port: 6443, Weight: 1},
+		{Address: "10.0.0.2", Port: 6443, Weight: 1, FwdMethod: ipvs.DirectRoute},
+	}); err != nil {
+		t.Fatalf("AddBackends() error = %v", err)
+	}
+	result, err := lb.SyncBackends([]Backend{
+		{Address: "10.0.0.1", Port: 6443, Weight: 1},
+		{Address: "10.0.0.2", Port: 6443, Weight: 1, FwdMethod: ipvs.DirectRoute},
+		{Address: "10.0.0.3", Port: 6443, Weight: 1, FwdMethod: ipvs.Tunnel},
+	})
+	if err != nil {
+		t.Fatalf("SyncBackends() error = %v", err)
+	}
+	if len(result.Added) != 1 || len(result.Updated) != 0 {
+		t.Errorf("SyncBackends() result = %+v, expected +1 ~0", result)
+	}
+	want := map[string]ipvs.ForwardType{"10.0.0.1": ipvs.Local, "10.0.0.2": ipvs.DirectRoute, "10.0.0.3": ipvs.Tunnel}
+	if got := forwardMethods(); !reflect.DeepEqual(got, want) {
+		t.Errorf("forwarding methods = %v, expected %v", got, want)
+	}
+
+	// 10.0.0.1 is edited in place, the kernel can't edit 10.0.0.2 so it is re-added
+	c.injectErrors("UpdateDestination", nil, syscall.EOPNOTSUPP)
+	result, err = lb.SyncBackends([]Backend{
+		{Address: "10.0.0.1", Port: 6443, Weight: 1, FwdMethod: ipvs.DirectRoute},
+		{Address: "10.0.0.2", Port: 6443, Weight: 3},
+		{Address: "10.0.0.3", Port: 6443, Weight: 1, FwdMethod: ipvs.Tunnel},
+	})
+	if err != nil {
+		t.Fatalf("SyncBackends() error = %v", err)
+	}
+	if len(result.Added) != 0 || len(result.Updated) != 2 || len(result.Removed) != 0 {
+		t.Errorf("SyncBackends() result = %+v, expected +0 -0 ~2", result)
+	}
+	want = map[string]ipvs.ForwardType{"10.0.0.1": ipvs.DirectRoute, "10.0.0.2": ipvs.Local, "10.0.0.3": ipvs.Tunnel}
+	if got := forwardMethods(); !reflect.DeepEqual(got, want) {
+		t.Errorf("forwarding methods = %v, expected %v", got, want)
+	}
+	if weight, _ := lb.GetBackendWeight("10.0.0.2", 6443); weight != 3 {
+		t.Errorf("re-added backend weight = %d, expected 3", weight)
+	}
+
+	// The desired forwarding methods are what Reconcile restores
+	if result, err = lb.Reconcile(); err != nil || len(result.Updated) != 0 {
+		t.Errorf("Reconcile() = %+v, %v, expected no corrections", result, err)
+	}
+}
+
+func TestWeightBoundaries(t *testing.T) {
+	tests := []struct {
+		name      string
+		weight    int
+		addErr    bool
+		updateErr bool
+	}{
+		{"negative", -1, true, true},
+		{"zero", 0, false, false},
+		{"one", 1, false, false},
+		{"max", MaxWeight, false, false},
+		{"overflow", MaxWeight + 1, true, true},
+		{"uint32 overflow", math.MaxUint32 + 1, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLB(t, newFakeClient())
+			if err := lb.AddBackendWithWeight("10.0.0.1", 6443, tt.weight); (err != nil) != tt.addErr {
+				t.Errorf("AddBackendWithWeight() error = %v, wantErr %v", err, tt.addErr)
+			}
+
+			if err := lb.AddBackend("10.0.0.2", 6443); err != nil {
+				t.Fatalf("AddBackend() error = %v", err)
+			}
+			if err := lb.UpdateBackendWeight("10.0.0.2", 6443, tt.weight); (err != nil) != tt.updateErr {
+				t.Errorf("UpdateBackendWeight() error = %v, wantErr %v", err, tt.updateErr)
+			}
+
+			// The default weight must be positive
+			_, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithDefaultWeight(tt.weight))
+			if (err != nil) != (tt.addErr || tt.weight == 0) {
+				t.Errorf("WithDefaultWeight() error = %v, wantErr %v", err, tt.addErr)
+			}
+		})
+	}
+}
+
+func TestWithDefaultWeight(t *testing.T) {
+	lb, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithDefaultWeight(10))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	if backends, _ := lb.ListBackends(); backends[0].Weight != 10 {
+		t.Errorf("AddBackend() weight = %d, expected the default weight 10", backends[0].Weight)
+	}
+}
+
+func TestWithWeightFunc(t *testing.T) {
+	// The capacity (in CPUs) of each node
+	capacity := map[string]int{"10.0.0.1": 4, "10.0.0.2": 16, "10.0.0.3": -1}
+	lb, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithDefaultWeight(2), WithWeightFunc(func(backend Backend) int {
+		if cpus, ok := capacity[backend.Address]; ok {
+			return cpus * 1000
+		}
+		return backend.Weight
+	}))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+
+	if err = lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	if err = lb.AddBackendWithWeight("10.0.0.4", 6443, 7); err != nil {
+		t.Fatalf("AddBackendWithWeight() error = %v", err)
+	}
+	backends := backendsByKey(mustListBackends(t, lb))
+	if backends["10.0.0.1:6443"].Weight != 4000 || backends["10.0.0.4:6443"].Weight != 7 {
+		t.Errorf("ListBackends() = %+v, expected the computed weight and the explicit weight", backends)
+	}
+
+	desired := []Backend{{Address: "10.0.0.1", Port: 6443, Weight: 1}, {Address: "10.0.0.2", Port: 6443, Weight: 1},
+		{Address: "10.0.0.3", Port: 6443, Weight: 1}, {Address: "10.0.0.5", Port: 6443, Weight: 3}}
+	if _, err = lb.SyncBackends(desired); err != nil {
+		t.Fatalf("SyncBackends() error = %v", err)
+	}
+	if desired[1].Weight != 1 {
+		t.Errorf("SyncBackends() modified the desired backends")
+	}
+	backends = backendsByKey(mustListBackends(t, lb))
+	// The weight of the third node is negative so it has the default weight
+	want := map[string]int{"10.0.0.1:6443": 4000, "10.0.0.2:6443": 16000, "10.0.0.3:6443": 2, "10.0.0.5:6443": 3}
+	if len(backends) != len(want) {
+		t.Fatalf("SyncBackends() left %+v, expected %v", backends, want)
+	}
+	for key, weight := range want {
+		if backends[key].Weight != weight {
+			t.Errorf("backend [%s] weight = %d, expected %d", key, backends[key].Weight, weight)
+		}
+	}
+}
+
+func TestHasBackend(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+
+	tests := []struct {
+		address string
+		port    int
+		want    bool
+		wantErr bool
+	}{
+		{"10.0.0.1", 6443, true, false},
+		{"::ffff:10.0.0.1", 6443, true, false},
+		{"10.0.0.1", 8443, false, false},
+		{"10.0.0.2", 6443, false, false},
+		{"node-1", 6443, false, true},
+	}
+	for _, tt := range tests {
+		got, err := lb.HasBackend(tt.address, tt.port)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("HasBackend(%s, %d) = %v, %v, expected %v (wantErr %v)", tt.address, tt.port, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestStandbyBackend(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	if err := lb.AddBackendWithWeight("10.0.0.1", 6443, 0); err != nil {
+		t.Fatalf("AddBackendWithWeight() of a standby backend error = %v", err)
+	}
+	if backends, _ := lb.ListBackends(); len(backends) != 1 || backends[0].Weight != 0 {
+		t.Fatalf("ListBackends() = %+v, expected a single standby backend", backends)
+	}
+
+	// The standby is promoted and then removed
+	if err := lb.UpdateBackendWeight("10.0.0.1", 6443, 1); err != nil {
+		t.Fatalf("UpdateBackendWeight() error = %v", err)
+	}
+	if err := lb.UpdateBackendWeight("10.0.0.1", 6443, 0); err != nil {
+		t.Fatalf("UpdateBackendWeight() error = %v", err)
+	}
+	if err := lb.RemoveBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("RemoveBackend() of a standby backend error = %v", err)
+	}
+	if backends, _ := lb.ListBackends(); len(backends) != 0 {
+		t.Errorf("ListBackends() = %+v, expected no backends", backends)
+	}
+}
+
+func TestAddSCTPBackend(t *testing.T) {
+	lb, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 3868, WithProtocol("sctp"))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+
+	if err := lb.AddSCTPBackend("10.0.0.1", []string{"10.1.0.1"}, 3868, 1, ipvs.Masquarade); err == nil {
+		t.Errorf("AddSCTPBackend() with Masquarade should return an error")
+	}
+	if err := lb.AddSCTPBackend("10.0.0.1", []string{"10.1.0.1"}, 3868, 1, ipvs.DirectRoute); err != nil {
+		t.Fatalf("AddSCTPBackend() error = %v", err)
+	}
+	// Only the primary address is registered with IPVS
+	backends, _ := lb.ListBackends()
+	if len(backends) != 1 || len(backends[0].AdditionalAddresses) != 1 || backends[0].AdditionalAddresses[0] != "10.1.0.1" {
+		t.Fatalf("ListBackends() = %+v, expected 10.0.0.1 with the additional address 10.1.0.1", backends)
+	}
+	if err := lb.RemoveBackend("10.0.0.1", 3868); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+
+	// The additional addresses of a backend added by hostname are kept against its resolved address
+	r := &fakeResolver{hosts: map[string][]string{"node-1": {"10.0.0.2"}}}
+	lb, err = NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 3868, WithProtocol("sctp"), WithHostnameResolution(r, time.Minute))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if err = lb.AddSCTPBackend("node-1", []string{"10.1.0.2"}, 3868, 1, ipvs.DirectRoute); err != nil {
+		t.Fatalf("AddSCTPBackend() by hostname error = %v", err)
+	}
+	if backends, _ = lb.ListBackends(); len(backends) != 1 || backends[0].Address != "10.0.0.2" || len(backends[0].AdditionalAddresses) != 1 {
+		t.Errorf("ListBackends() = %+v, expected 10.0.0.2 with the additional address 10.1.0.2", backends)
+	}
+
+	tcp := newTestLB(t, newFakeClient())
+	if err := tcp.AddSCTPBackend("10.0.0.1", nil, 6443, 1, ipvs.DirectRoute); err == nil {
+		t.Errorf("AddSCTPBackend() on a tcp load balancer should return an error")
+	}
+}
+
+func TestAddBackendWithThresholds(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+
+	// The thresholds are set as the destination is created rather than by a later update
+	c.injectErrors("UpdateDestination", syscall.EPERM)
+	if err := lb.AddBackendWithThresholds("10.0.0.1", 6443, 1, 100, 50); err != nil {
+		t.Fatalf("AddBackendWithThresholds() error = %v", err)
+	}
+	if err := lb.AddBackends([]Backend{{Address: "10.0.0.2", Port: 6443, Weight: 1, UpperThreshold: 20}}); err != nil {
+		t.Fatalf("AddBackends() error = %v", err)
+	}
+	backends := backendsByKey(mustListBackends(t, lb))
+	if b := backends["10.0.0.1:6443"]; b.UpperThreshold != 100 || b.LowerThreshold != 50 {
+		t.Errorf("ListBackends() thresholds = %d/%d, expected 100/50", b.UpperThreshold, b.LowerThreshold)
+	}
+	if b := backends["10.0.0.2:6443"]; b.UpperThreshold != 20 || b.LowerThreshold != 0 {
+		t.Errorf("ListBackends() thresholds = %d/%d, expected 20/0", b.UpperThreshold, b.LowerThreshold)
+	}
+	if b := lb.Snapshot().Backends[0]; b.UpperThreshold != 100 || b.LowerThreshold != 50 {
+		t.Errorf("Snapshot() thresholds = %d/%d, expected the thresholds to be kept", b.UpperThreshold, b.LowerThreshold)
+	}
+
+	if err := lb.AddBackendWithThresholds("10.0.0.3", 6443, 1, 50, 100); err == nil {
+		t.Errorf("AddBackendWithThresholds() with the lower threshold above the upper threshold should return an error")
+	}
+	if err := lb.AddBackendWithThresholds("10.0.0.3", 6443, 1, -1, 0); err == nil {
+		t.Errorf("AddBackendWithThresholds() with a negative threshold should return an error")
+	}
+	if ok, _ := lb.HasBackend("10.0.0.3", 6443); ok {
+		t.Errorf("a backend with invalid thresholds was added")
+	}
+}
+
+func TestSetBackendThresholds(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		upper, lower int
+		wantErr      bool
+	}{
+		{"upper and lower", 100, 50, false},
+		{"upper only", 100, 0, false},
+		{"disabled", 0, 0, false},
+		{"lower above upper", 50, 100, true},
+		{"lower without upper", 0, 10, true},
+		{"negative", -1, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := lb.SetBackendThresholds("10.0.0.1", 6443, tt.upper, tt.lower)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetBackendThresholds() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			backends, _ := lb.ListBackends()
+			if backends[0].UpperThreshold != tt.upper || backends[0].LowerThreshold != tt.lower {
+				t.Errorf("ListBackends() thresholds = %d/%d, expected %d/%d", backends[0].UpperThreshold, backends[0].LowerThreshold, tt.upper, tt.lower)
+			}
+		})
+	}
+
+	if err := lb.SetBackendThresholds("10.0.0.1", 6443, 100, 50); err != nil {
+		t.Fatalf("SetBackendThresholds() error = %v", err)
+	}
+	if err := lb.UpdateBackendWeight("10.0.0.1", 6443, 5); err != nil {
+		t.Fatalf("UpdateBackendWeight() error = %v", err)
+	}
+	if backends, _ := lb.ListBackends(); backends[0].UpperThreshold != 100 || backends[0].LowerThreshold != 50 {
+		t.Errorf("UpdateBackendWeight() reset the thresholds to %d/%d", backends[0].UpperThreshold, backends[0].LowerThreshold)
+	}
+	if err := lb.SetBackendThresholds("10.0.0.2", 6443, 100, 50); !errors.Is(err, ErrBackendNotFound) {
+		t.Errorf("SetBackendThresholds() error = %v, expected ErrBackendNotFound", err)
+	}
+}
+
+func TestGetBackendWeight(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	if err := lb.AddBackendWithWeight("10.0.0.1", 6443, 3); err != nil {
+		t.Fatalf("AddBackendWithWeight() error = %v", err)
+	}
+	if weight, err := lb.GetBackendWeight("10.0.0.1", 6443); err != nil || weight != 3 {
+		t.Errorf("GetBackendWeight() = %d, %v, expected 3", weight, err)
+	}
+	if err := lb.UpdateBackendWeight("10.0.0.1", 6443, 7); err != nil {
+		t.Fatalf("UpdateBackendWeight() error = %v", err)
+	}
+	if weight, err := lb.GetBackendWeight("10.0.0.1", 6443); err != nil || weight != 7 {
+		t.Errorf("GetBackendWeight() = %d, %v, expected 7", weight, err)
+	}
+	if _, err := lb.GetBackendWeight("10.0.0.2", 6443); !errors.Is(err, ErrBackendNotFound) {
+		t.Errorf("GetBackendWeight() error = %v, expected ErrBackendNotFound", err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	for _, address := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if err := lb.AddBackendWithWeight(address, 6443, 2); err != nil {
+			t.Fatalf("AddBackendWithWeight() error = %v", err)
+		}
+	}
+	other, err := NewIPVSLBWithClient(c, "192.168.0.2", 6443)
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if err = other.AddBackend("10.0.1.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+
+	// Change the backends behind the load balancer, in the same manner as ipvsadm
+	svc := lb.loadBalancerService
+	dst := func(address string, weight uint32) ipvs.Destination {
+		return ipvs.Destination{Address: ipvs.NewIP(net.ParseIP(address).To4()), Port: 6443, Family: ipvs.INET, Weight: weight, FwdMethod: ipvs.Local}
+	}
+	if err = c.RemoveDestination(svc, dst("10.0.0.1", 0)); err != nil {
+		t.Fatalf("RemoveDestination() error = %v", err)
+	}
+	if err = c.UpdateDestination(svc, dst("10.0.0.2", 9)); err != nil {
+		t.Fatalf("UpdateDestination() error = %v", err)
+	}
+	if err = c.CreateDestination(svc, dst("10.0.0.4", 1)); err != nil {
+		t.Fatalf("CreateDestination() error = %v", err)
+	}
+
+	result, err := lb.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if len(result.Added) != 1 || result.Added[0].Address != "10.0.0.1" ||
+		len(result.Updated) != 1 || result.Updated[0].Address != "10.0.0.2" ||
+		len(result.Removed) != 1 || result.Removed[0].Address != "10.0.0.4" {
+		t.Errorf("Reconcile() = %+v, expected 10.0.0.1 re-added, 10.0.0.2 restored and 10.0.0.4 removed", result)
+	}
+	backends, _ := lb.ListBackends()
+	if len(backends) != 3 {
+		t.Fatalf("ListBackends() = %+v, expected the three backends", backends)
+	}
+	for _, backend := range backends {
+		if backend.Weight != 2 {
+			t.Errorf("backend [%s] weight = %d, expected 2", backend.Address, backend.Weight)
+		}
+	}
+	if backends, _ := other.ListBackends(); len(backends) != 1 {
+		t.Errorf("the backends of another load balancer were changed: %+v", backends)
+	}
+
+	if result, err = lb.Reconcile(); err != nil || len(result.Added)+len(result.Removed)+len(result.Updated) != 0 {
+		t.Errorf("Reconcile() = %+v, %v, expected no drift", result, err)
+	}
+}
+
+func TestReconcileTunnel(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	gue := Tunnel{Type: TunnelGUE, Port: 6080}
+	if err := lb.AddBackendWithTunnel("10.0.0.1", 6443, 2, gue); err != nil {
+		t.Fatalf("AddBackendWithTunnel() error = %v", err)
+	}
+	svc := c.services[fakeServiceKey(lb.loadBalancerService)]
+	key := fakeDestinationKey(ipvs.Destination{Address: ipvs.NewIP(net.ParseIP("10.0.0.1").To4()), Port: 6443, Family: ipvs.INET})
+	tunnel := func() Tunnel {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return svc.tunnels[key]
+	}
+
+	// A tunnelled backend removed outside of the load balancer is re-added with its tunnel
+	dst := svc.dsts[key]
+	if err := c.RemoveDestination(lb.loadBalancerService, dst); err != nil {
+		t.Fatalf("RemoveDestination() error = %v", err)
+	}
+	if result, err := lb.Reconcile(); err != nil || len(result.Added) != 1 {
+		t.Fatalf("Reconcile() = %+v, %v, expected the backend to be re-added", result, err)
+	}
+	if got := tunnel(); got != gue {
+		t.Errorf("Reconcile() re-added the backend with the tunnel %+v, expected %+v", got, gue)
+	}
+
+	// A changed backend is restored with its tunnel, as editing the destination resets the tunnel to IPIP
+	dst.Weight = 7
+	if err := c.UpdateDestination(lb.loadBalancerService, dst); err != nil {
+		t.Fatalf("UpdateDestination() error = %v", err)
+	}
+	c.mu.Lock()
+	delete(svc.tunnels, key)
+	c.mu.Unlock()
+	if result, err := lb.Reconcile(); err != nil || len(result.Updated) != 1 {
+		t.Fatalf("Reconcile() = %+v, %v, expected the backend to be restored", result, err)
+	}
+	if got := tunnel(); got != gue {
+		t.Errorf("Reconcile() restored the backend with the tunnel %+v, expected %+v", got, gue)
+	}
+
+	// A failure to set the tunnel is reported
+	if err := c.RemoveDestination(lb.loadBalancerService, dst); err != nil {
+		t.Fatalf("RemoveDestination() error = %v", err)
+	}
+	c.injectErrors("SetDestinationTunnel", syscall.EOPNOTSUPP)
+	if _, err := lb.Reconcile(); !errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Errorf("Reconcile() error = %v, expected the tunnel error", err)
+	}
+}
+
+func TestRunReconciler(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	clock := newFakeClock()
+	lb.clock = clock
+
+	if err := lb.RunReconciler(context.Background(), 0, func() []Backend { return nil }); err == nil {
+		t.Errorf("RunReconciler() accepted an interval of 0")
+	}
+
+	var mu sync.Mutex
+	desired := []Backend{{Address: "10.0.0.1", Port: 6443, Weight: 1}}
+	setDesired := func(backends ...Backend) {
+		mu.Lock()
+		defer mu.Unlock()
+		desired = backends
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- lb.RunReconciler(ctx, time.Second, func() []Backend {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]Backend(nil), desired...)
+		})
+	}()
+	synced := func(address string) func() bool {
+		return func() bool {
+			backends := mustListBackends(t, lb)
+			return len(backends) == 1 && backends[0].Address == address
+		}
+	}
+	// The backends are synced immediately and then every interval
+	waitFor(t, "the initial sync", synced("10.0.0.1"))
+	setDesired(Backend{Address: "10.0.0.2", Port: 6443, Weight: 1})
+	clock.advance(time.Second)
+	waitFor(t, "the next sync", synced("10.0.0.2"))
+
+	// A failing sync backs off until it succeeds, each sync lists the backends twice (once to sync them and
+	// once for the metrics)
+	c.injectErrors("Destinations", syscall.EPERM, syscall.EPERM, syscall.EPERM, syscall.EPERM)
+	setDesired(Backend{Address: "10.0.0.3", Port: 6443, Weight: 1})
+	clock.advance(time.Second)
+	waitFor(t, "the first back off", func() bool { return clock.interval() == 2*time.Second })
+	clock.advance(2 * time.Second)
+	waitFor(t, "the second back off", func() bool { return clock.interval() == 4*time.Second })
+	clock.advance(4 * time.Second)
+	waitFor(t, "the interval to be reset", func() bool { return clock.interval() == time.Second })
+	waitFor(t, "the sync after failing", synced("10.0.0.3"))
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("RunReconciler() error = %v, expected the context error", err)
+	}
+	if clock.interval() != 0 {
+		t.Errorf("RunReconciler() left its ticker running")
+	}
+}
+
+func TestMarshalRestoreState(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	if err := lb.AddBackendWithWeight("10.0.0.1", 6443, 3); err != nil {
+		t.Fatalf("AddBackendWithWeight() error = %v", err)
+	}
+	if err := lb.AddBackendWithForwardMethod("10.0.0.2", 6443, 1, ipvs.DirectRoute); err != nil {
+		t.Fatalf("AddBackendWithForwardMethod() error = %v", err)
+	}
+	if err := lb.SetBackendThresholds("10.0.0.2", 6443, 100, 10); err != nil {
+		t.Fatalf("SetBackendThresholds() error = %v", err)
+	}
+	gue := Tunnel{Type: TunnelGUE, Port: 6080}
+	if err := lb.AddBackendWithTunnel("10.0.0.4", 6443, 2, gue); err != nil {
+		t.Fatalf("AddBackendWithTunnel() error = %v", err)
+	}
+	data, err := lb.MarshalState()
+	if err != nil {
+		t.Fatalf("MarshalState() error = %v", err)
+	}
+	expected, _ := lb.ListBackends()
+
+	// Restart the process, the IPVS service outlives it but drifts whilst kube-vip is down
+	restarted := newTestLB(t, c)
+	if err = restarted.RemoveBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	if err = restarted.AddBackend("10.0.0.3", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	if err = restarted.RemoveBackend("10.0.0.4", 6443); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+
+	if err = restarted.RestoreState(data); err != nil {
+		t.Fatalf("RestoreState() error = %v", err)
+	}
+	backends, _ := restarted.ListBackends()
+	if fmt.Sprint(backendsByKey(backends)) != fmt.Sprint(backendsByKey(expected)) {
+		t.Errorf("ListBackends() = %+v, expected the restored backends %+v", backends, expected)
+	}
+	key := fakeDestinationKey(ipvs.Destination{Address: ipvs.NewIP(net.ParseIP("10.0.0.4").To4()), Port: 6443, Family: ipvs.INET})
+	if tunnel := c.services[fakeServiceKey(restarted.loadBalancerService)].tunnels[key]; tunnel != gue {
+		t.Errorf("restored tunnel = %+v, expected %+v", tunnel, gue)
+	}
+	roundTrip, err := restarted.MarshalState()
+	if err != nil {
+		t.Fatalf("MarshalState() error = %v", err)
+	}
+	if string(roundTrip) != string(data) {
+		t.Errorf("MarshalState() = %s, expected the restored state %s", roundTrip, data)
+	}
+
+	other, err := NewIPVSLBWithClient(c, "192.168.0.2", 6443)
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if err = other.RestoreState(data); err == nil {
+		t.Errorf("RestoreState() expected an error for the state of another VIP")
+	}
+	if err = restarted.RestoreState([]byte("{")); err == nil {
+		t.Errorf("RestoreState() expected an error for an invalid state")
+	}
+	if err = restarted.RestoreState([]byte(`{"version":1,"vip":"192.168.0.1","port":6443,"protocol":"tcp","scheduler":"rr","backends":[]}`)); err != nil {
+		t.Errorf("RestoreState() of a version 1 state error = %v", err)
+	}
+
+	// The additional addresses of a multi-homed SCTP backend are restored
+	sctp, err := NewIPVSLBWithClient(c, "192.168.0.3", 3868, WithProtocol("sctp"))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if err = sctp.AddSCTPBackend("10.0.0.1", []string{"10.1.0.1", "10.2.0.1"}, 3868, 1, ipvs.DirectRoute); err != nil {
+		t.Fatalf("AddSCTPBackend() error = %v", err)
+	}
+	if data, err = sctp.MarshalState(); err != nil {
+		t.Fatalf("MarshalState() error = %v", err)
+	}
+	restarted, err = NewIPVSLBWithClient(c, "192.168.0.3", 3868, WithProtocol("sctp"))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if err = restarted.RestoreState(data); err != nil {
+		t.Fatalf("RestoreState() error = %v", err)
+	}
+	if backends, _ = restarted.ListBackends(); len(backends) != 1 || fmt.Sprint(backends[0].AdditionalAddresses) != "[10.1.0.1 10.2.0.1]" {
+		t.Errorf("ListBackends() = %+v, expected the additional addresses to be restored", backends)
+	}
+}
+
+// backendsByKey returns the backends keyed by address and port
+func TestReplaceBackend(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	if err := lb.AddBackendWithForwardMethod("10.0.0.1", 6443, 4, ipvs.DirectRoute); err != nil {
+		t.Fatalf("AddBackendWithForwardMethod() error = %v", err)
+	}
+	if err := lb.SetBackendThresholds("10.0.0.1", 6443, 100, 80); err != nil {
+		t.Fatalf("SetBackendThresholds() error = %v", err)
+	}
+	if err := lb.AddBackend("10.0.0.2", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+
+	// The old backend can't be removed, so the replacement is rolled back
+	c.injectErrors("RemoveDestination", syscall.EPERM)
+	if err := lb.ReplaceBackend(Backend{Address: "10.0.0.1", Port: 6443}, Backend{Address: "10.0.0.3", Port: 6443}); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("ReplaceBackend() error = %v, want EPERM", err)
+	}
+	byKey := backendsByKey(mustListBackends(t, lb))
+	if _, ok := byKey["10.0.0.3:6443"]; ok || len(byKey) != 2 {
+		t.Errorf("ReplaceBackend() failure left %v, expected the replacement to be rolled back", byKey)
+	}
+
+	if err := lb.ReplaceBackend(Backend{Address: "10.0.0.1", Port: 6443}, Backend{Address: "10.0.0.3", Port: 6443}); err != nil {
+		t.Fatalf("ReplaceBackend() error = %v", err)
+	}
+	byKey = backendsByKey(mustListBackends(t, lb))
+	replaced, ok := byKey["10.0.0.3:6443"]
+	if _, stale := byKey["10.0.0.1:6443"]; stale || !ok || len(byKey) != 2 {
+		t.Fatalf("ReplaceBackend() left %v, expected 10.0.0.1 to be replaced by 10.0.0.3", byKey)
+	}
+	if replaced.Weight != 4 || replaced.FwdMethod != ipvs.DirectRoute || replaced.UpperThreshold != 100 || replaced.LowerThreshold != 80 {
+		t.Errorf("ReplaceBackend() = %+v, expected the weight, forwarding method and thresholds to be preserved", replaced)
+	}
+	if result, err := lb.Reconcile(); err != nil || len(result.Added)+len(result.Removed)+len(result.Updated) != 0 {
+		t.Errorf("Reconcile() = %+v, %v, expected the replacement to be the desired backend", result, err)
+	}
+
+	// The replacement must not already be registered, and the old backend must be
+	if err := lb.ReplaceBackend(Backend{Address: "10.0.0.3", Port: 6443}, Backend{Address: "10.0.0.2", Port: 6443}); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("ReplaceBackend() with a registered replacement error = %v, want ErrAlreadyExists", err)
+	}
+	if err := lb.ReplaceBackend(Backend{Address: "10.0.0.9", Port: 6443}, Backend{Address: "10.0.0.4", Port: 6443}); !errors.Is(err, ErrBackendNotFound) {
+		t.Errorf("ReplaceBackend() of an unknown backend error = %v, want ErrBackendNotFound", err)
+	}
+}
+
+func mustListBackends(t *testing.T, lb *IPVSLoadBalancer) []Backend {
+	t.Helper()
+	backends, err := lb.ListBackends()
+	if err != nil {
+		t.Fatalf("ListBackends() error = %v", err)
+	}
+	return backends
+}
+
+func TestSnapshot(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	if err := lb.AddBackendWithWeight("10.0.0.2", 6443, 3); err != nil {
+		t.Fatalf("AddBackendWithWeight() error = %v", err)
+	}
+	if err := lb.AddBackendWithForwardMethod("10.0.0.1", 6443, 5, ipvs.DirectRoute); err != nil {
+		t.Fatalf("AddBackendWithForwardMethod() error = %v", err)
+	}
+	if err := lb.AddPort(8443); err != nil {
+		t.Fatalf("AddPort() error = %v", err)
+	}
+	lb.health = map[string]*backendHealth{}
+	lb.applyHealth(Backend{Address: "10.0.0.2", Port: 6443, Weight: 3, FwdMethod: ipvs.Local}, fmt.Errorf("connection refused"), QuiescePolicy{FailureThreshold: 1}, 0)
+
+	before := time.Now()
+	s := lb.Snapshot()
+	if s.Time.Before(before) {
+		t.Errorf("Snapshot().Time = %s, expected the time of the snapshot", s.Time)
+	}
+	if s.Spec.Address != "192.168.0.1" || s.Spec.Scheduler != SchedulerRR || !reflect.DeepEqual(s.Ports, []int{6443, 8443}) {
+		t.Errorf("Snapshot() spec = %+v with ports %v", s.Spec, s.Ports)
+	}
+	if len(s.Backends) != 2 {
+		t.Fatalf("Snapshot().Backends = %+v, expected 2 backends", s.Backends)
+	}
+	if b := s.Backends[0]; b.Address != "10.0.0.1" || b.Weight != 5 || b.FwdMethod != ipvs.DirectRoute || !b.Healthy {
+		t.Errorf("Snapshot().Backends[0] = %+v, expected 10.0.0.1 with weight 5 by DirectRoute", b)
+	}
+	if b := s.Backends[1]; b.Address != "10.0.0.2" || b.Weight != 3 || b.Healthy {
+		t.Errorf("Snapshot().Backends[1] = %+v, expected the quiesced 10.0.0.2 with its configured weight 3", b)
+	}
+
+	// The snapshot is a copy that isn't changed by later changes, and IPVS isn't read
+	c.injectErrors("Destinations", syscall.EPERM)
+	if s = lb.Snapshot(); len(s.Backends) != 2 {
+		t.Errorf("Snapshot() read IPVS, %d backends", len(s.Backends))
+	}
+	if err := lb.RemoveBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	if len(s.Backends) != 2 || len(lb.Snapshot().Backends) != 1 {
+		t.Errorf("Snapshot() isn't a copy of the backends")
+	}
+}
+
+func backendsByKey(backends []Backend) map[string]Backend {
+	byKey := make(map[string]Backend, len(backends))
+	for _, backend := range backends {
+		byKey[backendKey(backend.Address, backend.Port)] = backend
+	}
+	return byKey
+}
+
+func TestListConnections(t *testing.T) {
+	table := `Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+TCP C0A80064 D431 C0A80001 192B 0A000001 192B ESTABLISHED     899
+TCP C0A80065 D432 C0A80001 192B 0A000002 192B FIN_WAIT        110
+UDP C0A80066 D433 C0A80001 192B 0A000001 192B UDP             290
+TCP C0A80067 D434 C0A80002 192B 0A000001 192B ESTABLISHED     899
+TCP C0A80068 D435 C0A80001 192B 0A000009 192B ESTABLISHED     899
+`
+	dir, err := ioutil.TempDir("", "kube-vip-test")
+	if err != nil {
+		t.Fatalf("unable to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ip_vs_conn")
+	if err = ioutil.WriteFile(path, []byte(table), 0600); err != nil {
+		t.Fatalf("unable to write the connection table: %v", err)
+	}
+	defer func(p string) { ipvsConnPath = p }(ipvsConnPath)
+	ipvsConnPath = path
+
+	lb := newTestLB(t, newFakeClient())
+	for _, address := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := lb.AddBackend(address, 6443); err != nil {
+			t.Fatalf("AddBackend() error = %v", err)
+		}
+	}
+
+	conns, err := lb.ListConnections(0)
+	if err != nil {
+		t.Fatalf("ListConnections() error = %v", err)
+	}
+	expected := []Connection{
+		{"tcp", Endpoint{"192.168.0.100", 54321}, Endpoint{"192.168.0.1", 6443}, Endpoint{"10.0.0.1", 6443}, "ESTABLISHED", 899 * time.Second},
+		{"tcp", Endpoint{"192.168.0.101", 54322}, Endpoint{"192.168.0.1", 6443}, Endpoint{"10.0.0.2", 6443}, "FIN_WAIT", 110 * time.Second},
+	}
+	if fmt.Sprint(conns) != fmt.Sprint(expected) {
+		t.Errorf("ListConnections() = %+v, expected %+v", conns, expected)
+	}
+
+	if conns, err = lb.ListConnections(1); err != nil || len(conns) != 1 {
+		t.Errorf("ListConnections(1) = %+v, %v, expected a single connection", conns, err)
+	}
+}
+
+func TestListConnectionsNetNS(t *testing.T) {
+	// The table must be read from the network namespace of the thread that inNetNS switched into
+	if !strings.HasPrefix(ipvsConnPath, "/proc/thread-self/") {
+		t.Errorf("ipvsConnPath = %q, expected the connection table of the calling thread", ipvsConnPath)
+	}
+}
+
+func TestAddBackendWithTunnel(t *testing.T) {
+	tests := []struct {
+		name    string
+		tunnel  Tunnel
+		wantErr bool
+	}{
+		{"ipip", Tunnel{Type: TunnelIPIP}, false},
+		{"gue", Tunnel{Type: TunnelGUE, Port: 6080}, false},
+		{"gre", Tunnel{Type: TunnelGRE}, false},
+		{"gue without a port", Tunnel{Type: TunnelGUE}, true},
+		{"gre with a port", Tunnel{Type: TunnelGRE, Port: 6080}, true},
+		{"unknown type", Tunnel{Type: 7}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient()
+			lb := newTestLB(t, c)
+			err := lb.AddBackendWithTunnel("10.0.0.1", 6443, 1, tt.tunnel)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddBackendWithTunnel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			backends, _ := lb.ListBackends()
+			if tt.wantErr {
+				if len(backends) != 0 {
+					t.Errorf("AddBackendWithTunnel() with an invalid tunnel registered %+v", backends)
+				}
+				return
+			}
+			if len(backends) != 1 || backends[0].FwdMethod != ipvs.Tunnel || backends[0].Tunnel != tt.tunnel {
+				t.Fatalf("ListBackends() = %+v, expected a tunnelled backend with %+v", backends, tt.tunnel)
+			}
+
+			s := c.services[fakeServiceKey(lb.loadBalancerService)]
+			applied, ok := s.tunnels[fakeDestinationKey(ipvs.Destination{
+				Address: ipvs.NewIP(net.ParseIP("10.0.0.1").To4()), Port: 6443, Family: ipvs.INET,
+			})]
+			// IPIP is the default so it isn't set
+			if tt.tunnel.Type == TunnelIPIP {
+				if ok {
+					t.Errorf("the IPIP tunnel shouldn't be set on the destination")
+				}
+			} else if applied != tt.tunnel {
+				t.Errorf("the destination tunnel = %+v, expected %+v", applied, tt.tunnel)
+			}
+		})
+	}
+
+	// A tunnel that can't be set removes the backend again
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	c.injectErrors("SetDestinationTunnel", syscall.EINVAL)
+	if err := lb.AddBackendWithTunnel("10.0.0.1", 6443, 1, Tunnel{Type: TunnelGRE}); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("AddBackendWithTunnel() error = %v, want EINVAL", err)
+	}
+	if ok, _ := lb.HasBackend("10.0.0.1", 6443); ok {
+		t.Errorf("AddBackendWithTunnel() failure left the backend registered")
+	}
+}
@@ -0,0 +1,76 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cloudflare/ipvs"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// opCleanup is the operation used in the cleanup logs
+const opCleanup = "cleanup"
+
+// CleanupOrphaned will remove the IPVS services on any of the VIPs left behind by a previous instance (such
+// as after a crash), so that the load balancers can be created from a clean slate on startup. Only services
+// on one of the VIPs are removed, services on any other address and firewall mark services are never touched.
+// It returns the number of services that were removed.
+func CleanupOrphaned(vips []string) (int, error) {
+	c, err := newIPVSClient()
+	if err != nil {
+		return 0, err
+	}
+	defer closeClient(c)
+	return CleanupOrphanedWithClient(c, vips)
+}
+
+// CleanupOrphanedWithClient will remove the IPVS services on any of the VIPs using an existing IPVS client,
+// see CleanupOrphaned
+func CleanupOrphanedWithClient(c Client, vips []string) (int, error) {
+	managed := make([]net.IP, 0, len(vips))
+	for _, vip := range vips {
+		ip, _, err := parseAddress(vip)
+		if err != nil {
+			return 0, err
+		}
+		managed = append(managed, ip)
+	}
+	if len(managed) == 0 {
+		return 0, nil
+	}
+
+	services, err := c.Services()
+	if err != nil {
+		return 0, fmt.Errorf("error listing IPVS services: %w", err)
+	}
+
+	var errs []error
+	removed := 0
+	for _, existing := range services {
+		svc := existing.Service
+		if !isManaged(svc, managed) {
+			continue
+		}
+		if err := c.RemoveService(svc); err != nil && !isNotFound(err) {
+			errs = append(errs, newError(opRemoveService, svc, "", err))
+			continue
+		}
+		removed++
+		serviceLog(defaultLogger, svc, opCleanup).Info("removed orphaned IPVS service")
+	}
+	return removed, utilerrors.NewAggregate(errs)
+}
+
+// isManaged returns true if an IPVS service is on one of the managed VIPs
+func isManaged(svc ipvs.Service, managed []net.IP) bool {
+	if svc.FWMark != 0 {
+		return false
+	}
+	address := svc.Address.Net(svc.Family)
+	for _, ip := range managed {
+		if address.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
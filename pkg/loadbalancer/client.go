@@ -0,0 +1,118 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// Client is the subset of the IPVS client used by the load balancer, ipvs.Client satisfies it and it
+// allows an alternative implementation (such as a fake in tests) to be passed to NewIPVSLBWithClient
+type Client interface {
+	Services() ([]ipvs.ServiceExtended, error)
+	Service(ipvs.Service) (ipvs.ServiceExtended, error)
+	CreateService(ipvs.Service) error
+	UpdateService(ipvs.Service) error
+	RemoveService(ipvs.Service) error
+
+	Destinations(ipvs.Service) ([]ipvs.DestinationExtended, error)
+	CreateDestination(ipvs.Service, ipvs.Destination) error
+	UpdateDestination(ipvs.Service, ipvs.Destination) error
+	RemoveDestination(ipvs.Service, ipvs.Destination) error
+}
+
+// ipvs.Client must always satisfy Client
+var _ Client = ipvs.Client(nil)
+
+// timeoutsClient can optionally be implemented by a Client to set the IPVS connection timeouts, otherwise
+// they are set directly over netlink
+type timeoutsClient interface {
+	SetTimeouts(Timeouts) error
+}
+
+// setTimeouts will set the IPVS connection timeouts using the client if it supports it
+func setTimeouts(c Client, timeouts Timeouts) error {
+	if tc, ok := c.(timeoutsClient); ok {
+		return tc.SetTimeouts(timeouts)
+	}
+	return setKernelTimeouts(uint32(timeouts.TCP/time.Second), uint32(timeouts.TCPFin/time.Second), uint32(timeouts.UDP/time.Second))
+}
+
+// SharedClient is an IPVS client (a single netlink socket) that can be shared by multiple load balancers.
+// It is reference counted, NewSharedClient returns a client holding one reference for the caller and every
+// load balancer created with it by NewIPVSLBWithClient takes another. Each Close (on the SharedClient or a
+// load balancer) releases one reference and the socket is only closed once every reference is released, so
+// closing one load balancer never closes the socket out from under the others.
+type SharedClient struct {
+	Client
+
+	mu   sync.Mutex
+	refs int
+}
+
+// NewSharedClient will create an IPVS client that can be shared by multiple load balancers, the caller
+// must Close it once it has finished creating load balancers
+func NewSharedClient() (*SharedClient, error) {
+	c, err := newIPVSClient()
+	if err != nil {
+		return nil, err
+	}
+	return newSharedClient(c), nil
+}
+
+// newSharedClient wraps a client so that it can be shared
+func newSharedClient(c Client) *SharedClient {
+	return &SharedClient{Client: c, refs: 1}
+}
+
+// acquire takes a reference to the client
+func (s *SharedClient) acquire() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs == 0 {
+		return fmt.Errorf("the shared IPVS client has been closed")
+	}
+	s.refs++
+	return nil
+}
+
+// Close releases a reference to the client, the underlying client is closed once the last reference is released
+func (s *SharedClient) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs == 0 {
+		return nil
+	}
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	return closeClient(s.Client)
+}
+
+// SetTimeouts sets the IPVS connection timeouts using the underlying client
+func (s *SharedClient) SetTimeouts(timeouts Timeouts) error {
+	return setTimeouts(s.Client, timeouts)
+}
+
+// StartSyncDaemon starts the connection sync daemon using the underlying client
+func (s *SharedClient) StartSyncDaemon(state uint32, iface string) error {
+	return startSyncDaemon(s.Client, state, iface)
+}
+
+// StopSyncDaemon stops the connection sync daemon using the underlying client
+func (s *SharedClient) StopSyncDaemon(state uint32) error {
+	return stopSyncDaemon(s.Client, state)
+}
+
+// ZeroService zeroes the counters of a service using the underlying client
+func (s *SharedClient) ZeroService(svc ipvs.Service) error {
+	return zeroService(s.Client, svc)
+}
+
+// SetDestinationTunnel sets the tunnel of a destination using the underlying client
+func (s *SharedClient) SetDestinationTunnel(svc ipvs.Service, dst ipvs.Destination, tunnel Tunnel) error {
+	return setTunnel(s.Client, svc, dst, tunnel)
+}
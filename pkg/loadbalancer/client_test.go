@@ -0,0 +1,282 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// fakeClient is an in-memory implementation of Client, returning the same errno values as the kernel
+type fakeClient struct {
+	mu       sync.Mutex
+	services map[string]*fakeService
+	timeouts Timeouts
+	// daemons are the interfaces of the running connection sync daemons, keyed by state
+	daemons map[uint32]string
+	// errs are returned by the next calls of a method, ahead of the usual behaviour
+	errs map[string][]error
+}
+
+type fakeService struct {
+	svc   ipvs.Service
+	dsts  map[string]ipvs.Destination
+	stats ipvs.Stats
+	// active are the active connections of each destination
+	active map[string]uint32
+	// tunnels are the tunnels set on each destination
+	tunnels map[string]Tunnel
+}
+
+var _ Client = &fakeClient{}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{services: map[string]*fakeService{}, errs: map[string][]error{}}
+}
+
+// injectErrors sets errors to be returned by the next calls of a method
+func (f *fakeClient) injectErrors(method string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[method] = append(f.errs[method], errs...)
+}
+
+// nextError returns the next injected error of a method, the caller must hold the lock
+func (f *fakeClient) nextError(method string) error {
+	if len(f.errs[method]) == 0 {
+		return nil
+	}
+	err := f.errs[method][0]
+	f.errs[method] = f.errs[method][1:]
+	return err
+}
+
+func fakeServiceKey(svc ipvs.Service) string {
+	return fmt.Sprintf("%d/%d/%x/%d/%d", svc.Family, svc.Protocol, svc.Address, svc.Port, svc.FWMark)
+}
+
+func fakeDestinationKey(dst ipvs.Destination) string {
+	return fmt.Sprintf("%d/%x/%d", dst.Family, dst.Address, dst.Port)
+}
+
+func (f *fakeClient) Info() (ipvs.Info, error) {
+	return ipvs.Info{Version: [3]int{1, 2, 1}}, nil
+}
+
+func (f *fakeClient) Services() ([]ipvs.ServiceExtended, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var svcs []ipvs.ServiceExtended
+	for _, s := range f.services {
+		svcs = append(svcs, ipvs.ServiceExtended{Service: s.svc})
+	}
+	return svcs, nil
+}
+
+func (f *fakeClient) Service(svc ipvs.Service) (ipvs.ServiceExtended, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.services[fakeServiceKey(svc)]
+	if !ok {
+		return ipvs.ServiceExtended{}, syscall.ESRCH
+	}
+	return ipvs.ServiceExtended{Service: s.svc, Stats64: s.stats}, nil
+}
+
+func (f *fakeClient) CreateService(svc ipvs.Service) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.nextError("CreateService"); err != nil {
+		return err
+	}
+	key := fakeServiceKey(svc)
+	if _, ok := f.services[key]; ok {
+		return syscall.EEXIST
+	}
+	f.services[key] = &fakeService{svc: svc, dsts: map[string]ipvs.Destination{}, active: map[string]uint32{}}
+	return nil
+}
+
+func (f *fakeClient) UpdateService(svc ipvs.Service) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.nextError("UpdateService"); err != nil {
+		return err
+	}
+	s, ok := f.services[fakeServiceKey(svc)]
+	if !ok {
+		return syscall.ESRCH
+	}
+	s.svc = svc
+	return nil
+}
+
+func (f *fakeClient) RemoveService(svc ipvs.Service) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.nextError("RemoveService"); err != nil {
+		return err
+	}
+	key := fakeServiceKey(svc)
+	if _, ok := f.services[key]; !ok {
+		return syscall.ESRCH
+	}
+	delete(f.services, key)
+	return nil
+}
+
+func (f *fakeClient) Destinations(svc ipvs.Service) ([]ipvs.DestinationExtended, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.nextError("Destinations"); err != nil {
+		return nil, err
+	}
+	s, ok := f.services[fakeServiceKey(svc)]
+	if !ok {
+		return nil, syscall.ESRCH
+	}
+	var dsts []ipvs.DestinationExtended
+	for key, dst := range s.dsts {
+		dsts = append(dsts, ipvs.DestinationExtended{Destination: dst, ActiveConnections: s.active[key]})
+	}
+	return dsts, nil
+}
+
+func (f *fakeClient) CreateDestination(svc ipvs.Service, dst ipvs.Destination) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.nextError("CreateDestination"); err != nil {
+		return err
+	}
+	s, ok := f.services[fakeServiceKey(svc)]
+	if !ok {
+		return syscall.ESRCH
+	}
+	key := fakeDestinationKey(dst)
+	if _, ok := s.dsts[key]; ok {
+		return syscall.EEXIST
+	}
+	s.dsts[key] = dst
+	return nil
+}
+
+func (f *fakeClient) UpdateDestination(svc ipvs.Service, dst ipvs.Destination) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.nextError("UpdateDestination"); err != nil {
+		return err
+	}
+	s, ok := f.services[fakeServiceKey(svc)]
+	if !ok {
+		return syscall.ESRCH
+	}
+	key := fakeDestinationKey(dst)
+	if _, ok := s.dsts[key]; !ok {
+		return syscall.ENOENT
+	}
+	s.dsts[key] = dst
+	return nil
+}
+
+func (f *fakeClient) RemoveDestination(svc ipvs.Service, dst ipvs.Destination) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.nextError("RemoveDestination"); err != nil {
+		return err
+	}
+	s, ok := f.services[fakeServiceKey(svc)]
+	if !ok {
+		return syscall.ESRCH
+	}
+	key := fakeDestinationKey(dst)
+	if _, ok := s.dsts[key]; !ok {
+		return syscall.ENOENT
+	}
+	delete(s.dsts, key)
+	delete(s.tunnels, key)
+	return nil
+}
+
+func (f *fakeClient) SetDestinationTunnel(svc ipvs.Service, dst ipvs.Destination, tunnel Tunnel) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.nextError("SetDestinationTunnel"); err != nil {
+		return err
+	}
+	s, ok := f.services[fakeServiceKey(svc)]
+	if !ok {
+		return syscall.ESRCH
+	}
+	key := fakeDestinationKey(dst)
+	if _, ok := s.dsts[key]; !ok {
+		return syscall.ENOENT
+	}
+	if s.tunnels == nil {
+		s.tunnels = map[string]Tunnel{}
+	}
+	s.tunnels[key] = tunnel
+	return nil
+}
+
+func (f *fakeClient) SetTimeouts(timeouts Timeouts) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.nextError("SetTimeouts"); err != nil {
+		return err
+	}
+	f.timeouts = timeouts
+	return nil
+}
+
+func (f *fakeClient) ZeroService(svc ipvs.Service) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.nextError("ZeroService"); err != nil {
+		return err
+	}
+	s, ok := f.services[fakeServiceKey(svc)]
+	if !ok {
+		return syscall.ESRCH
+	}
+	s.stats = ipvs.Stats{}
+	return nil
+}
+
+func (f *fakeClient) StartSyncDaemon(state uint32, iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.nextError("StartSyncDaemon"); err != nil {
+		return err
+	}
+	if _, ok := f.daemons[state]; ok {
+		return syscall.EEXIST
+	}
+	if f.daemons == nil {
+		f.daemons = map[uint32]string{}
+	}
+	f.daemons[state] = iface
+	return nil
+}
+
+func (f *fakeClient) StopSyncDaemon(state uint32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.nextError("StopSyncDaemon"); err != nil {
+		return err
+	}
+	if _, ok := f.daemons[state]; !ok {
+		return syscall.ESRCH
+	}
+	delete(f.daemons, state)
+	return nil
+}
+
+// setActiveConnections sets the active connections of a destination on every service
+func (f *fakeClient) setActiveConnections(dst ipvs.Destination, active uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.services {
+		s.active[fakeDestinationKey(dst)] = active
+	}
+}
@@ -0,0 +1,151 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ipvsConnPath is the IPVS connection table exposed by the kernel, it is read through thread-self as
+// /proc/net follows the network namespace of the process rather than that of the calling thread
+var ipvsConnPath = "/proc/thread-self/net/ip_vs_conn"
+
+// Endpoint is an address and port of a connection
+type Endpoint struct {
+	Address string
+	Port    int
+}
+
+func (e Endpoint) String() string {
+	return backendKey(e.Address, e.Port)
+}
+
+// Connection is an entry of the IPVS connection table
+type Connection struct {
+	// Protocol is tcp, udp or sctp
+	Protocol string
+	// Client is the source of the connection, VIP is its destination and Backend is the backend IPVS
+	// scheduled it to
+	Client  Endpoint
+	VIP     Endpoint
+	Backend Endpoint
+	// State is the IPVS state of the connection (such as ESTABLISHED or FIN_WAIT)
+	State string
+	// Expires is the time until the entry expires unless there is further traffic
+	Expires time.Duration
+}
+
+// ListConnections returns the entries of the IPVS connection table that belong to the load balancer, which
+// shows the clients that are pinned to each backend. The whole table is read (as the kernel doesn't filter
+// it) so this may be expensive on a busy system, the number of entries returned is capped by the limit
+// (0 returns every entry). For a firewall mark service the entries are matched by their backend.
+func (lb *IPVSLoadBalancer) ListConnections(limit int) ([]Connection, error) {
+	if limit < 0 {
+		return nil, fmt.Errorf("invalid connection limit [%d], must be 0 (unlimited) or positive", limit)
+	}
+
+	lb.mu.RLock()
+	fwmark := lb.loadBalancerService.FWMark != 0
+	protocol := lb.protocolName()
+	vips := map[string]bool{}
+	for _, svc := range lb.services() {
+		vips[backendKey(svc.Address.Net(svc.Family).String(), int(svc.Port))] = true
+	}
+	backends := map[string]bool{}
+	current, err := lb.listBackends(false)
+	for x := range current {
+		backends[backendKey(current[x].Address, current[x].Port)] = true
+	}
+	netns := lb.netns
+	lb.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var conns []Connection
+	err = inNetNS(netns, func() error {
+		f, err := os.Open(ipvsConnPath)
+		if err != nil {
+			return fmt.Errorf("error reading the IPVS connection table: %w", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			conn, ok := parseConnection(scanner.Text())
+			if !ok || !backends[conn.Backend.String()] {
+				continue
+			}
+			if !fwmark && (conn.Protocol != protocol || !vips[conn.VIP.String()]) {
+				continue
+			}
+			conns = append(conns, conn)
+			if limit > 0 && len(conns) >= limit {
+				return nil
+			}
+		}
+		return scanner.Err()
+	})
+	return conns, err
+}
+
+// parseConnection parses an entry of the IPVS connection table, such as:
+//
+//	Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+//	TCP C0A80064 D431 C0A80001 192B 0A000001 192B ESTABLISHED     899
+//
+// IPv4 addresses are hexadecimal whilst IPv6 addresses are in their usual form, the ports are hexadecimal.
+// False is returned for the header or a line that can't be parsed.
+func parseConnection(line string) (Connection, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 9 {
+		return Connection{}, false
+	}
+
+	var endpoints [3]Endpoint
+	for x := range endpoints {
+		address, ok := parseConnectionAddress(fields[1+x*2])
+		if !ok {
+			return Connection{}, false
+		}
+		port, err := strconv.ParseUint(fields[2+x*2], 16, 16)
+		if err != nil {
+			return Connection{}, false
+		}
+		endpoints[x] = Endpoint{Address: address, Port: int(port)}
+	}
+	expires, err := strconv.Atoi(fields[8])
+	if err != nil {
+		return Connection{}, false
+	}
+
+	return Connection{
+		Protocol: strings.ToLower(fields[0]),
+		Client:   endpoints[0],
+		VIP:      endpoints[1],
+		Backend:  endpoints[2],
+		State:    fields[7],
+		Expires:  time.Duration(expires) * time.Second,
+	}, true
+}
+
+// parseConnectionAddress parses an address of the IPVS connection table
+func parseConnectionAddress(field string) (string, bool) {
+	if len(field) == 8 && !strings.Contains(field, ":") {
+		b, err := hex.DecodeString(field)
+		if err != nil {
+			return "", false
+		}
+		return net.IP(b).String(), true
+	}
+	ip, _, err := parseAddress(field)
+	if err != nil {
+		return "", false
+	}
+	return ip.String(), true
+}
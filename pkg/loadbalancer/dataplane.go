@@ -0,0 +1,29 @@
+package loadbalancer
+
+// DataPlane is the interface of the store of backends behind a VIP, it has the operations that callers
+// (such as the node watcher and the Debouncer) use to manage the backends without depending on how they are
+// programmed into the kernel. *IPVSLoadBalancer is the only data plane today, the interface makes the seam
+// explicit so that an alternative (such as nftables or eBPF) or FakeLoadBalancer in tests can be used
+// without changing the callers.
+type DataPlane interface {
+	// AddBackend and AddBackendWithWeight add a backend, adding an existing backend is a no-op
+	AddBackend(address string, port int) error
+	AddBackendWithWeight(address string, port, weight int) error
+	// RemoveBackend removes a backend
+	RemoveBackend(address string, port int) error
+	// UpdateBackendWeight changes the weight of a registered backend
+	UpdateBackendWeight(address string, port, weight int) error
+	// HasBackend returns true if the backend is registered
+	HasBackend(address string, port int) (bool, error)
+	// ListBackends returns the registered backends
+	ListBackends() ([]Backend, error)
+	// SyncBackends makes the registered backends match the desired backends
+	SyncBackends(desired []Backend) (SyncResult, error)
+	// Close removes the VIP and its backends from the data plane and releases its resources
+	Close() error
+	// String describes the data plane and its VIP for logging
+	String() string
+}
+
+// *IPVSLoadBalancer must always satisfy DataPlane
+var _ DataPlane = &IPVSLoadBalancer{}
@@ -0,0 +1,140 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// opDebounce is the operation used in the debouncer logs
+const opDebounce = "debounce"
+
+// Debouncer coalesces rapid adds and removes of the same backend (such as a node flapping between NotReady
+// and Ready) so that only the net change is applied to the data plane. Each add or remove is delayed by
+// the window, and any further add or remove of the backend within the window replaces it and restarts the
+// window. Once the window has passed without further changes the backend is added (or removed) only if it
+// isn't already registered (or is registered), so a flap that ends where it started changes nothing.
+type Debouncer struct {
+	lb     DataPlane
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*debouncedBackend
+	stopped bool
+}
+
+// debouncedBackend is the pending change of a backend
+type debouncedBackend struct {
+	address string
+	port    int
+	add     bool
+	timer   *time.Timer
+}
+
+// NewDebouncer returns a Debouncer that applies the changes of backends to the load balancer once they have
+// settled for the window
+func NewDebouncer(lb DataPlane, window time.Duration) (*Debouncer, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid debounce window [%s], must be a positive duration", window)
+	}
+	return &Debouncer{lb: lb, window: window, pending: map[string]*debouncedBackend{}}, nil
+}
+
+// AddBackend will add the backend with the default weight once the window has passed, unless it is removed
+// again within the window. Only an invalid address or port is returned, a failure to add the backend is logged.
+func (d *Debouncer) AddBackend(address string, port int) error {
+	return d.schedule(address, port, true)
+}
+
+// RemoveBackend will remove the backend once the window has passed, unless it is added again within the
+// window. Only an invalid address or port is returned, a failure to remove the backend is logged.
+func (d *Debouncer) RemoveBackend(address string, port int) error {
+	return d.schedule(address, port, false)
+}
+
+// schedule records the latest change of a backend and restarts its window
+func (d *Debouncer) schedule(address string, port int, add bool) error {
+	ip, _, err := parseAddress(address)
+	if err != nil {
+		return err
+	}
+	if err = validatePort(port); err != nil {
+		return err
+	}
+	key := backendKey(ip.String(), port)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return fmt.Errorf("the debouncer has been stopped")
+	}
+
+	if p, ok := d.pending[key]; ok {
+		p.timer.Stop()
+	}
+	p := &debouncedBackend{address: ip.String(), port: port, add: add}
+	p.timer = time.AfterFunc(d.window, func() {
+		if err := d.fire(key, p); err != nil {
+			defaultLogger.WithFields(Fields{"backend": key, "operation": opDebounce}).Errorf("unable to apply the debounced change [%v]", err)
+		}
+	})
+	d.pending[key] = p
+	return nil
+}
+
+// fire applies the pending change of a backend once its window has passed, unless it has been replaced
+func (d *Debouncer) fire(key string, p *debouncedBackend) error {
+	d.mu.Lock()
+	if d.pending[key] != p {
+		d.mu.Unlock()
+		return nil
+	}
+	delete(d.pending, key)
+	d.mu.Unlock()
+	return d.apply(p)
+}
+
+// apply adds or removes a backend if it isn't already in the desired state
+func (d *Debouncer) apply(p *debouncedBackend) error {
+	registered, err := d.lb.HasBackend(p.address, p.port)
+	if err != nil {
+		return err
+	}
+	switch {
+	case p.add && !registered:
+		return d.lb.AddBackend(p.address, p.port)
+	case !p.add && registered:
+		return d.lb.RemoveBackend(p.address, p.port)
+	}
+	return nil
+}
+
+// Flush will immediately apply every pending change without waiting for the windows to pass
+func (d *Debouncer) Flush() error {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = map[string]*debouncedBackend{}
+	d.mu.Unlock()
+
+	var errs []error
+	for _, p := range pending {
+		p.timer.Stop()
+		if err := d.apply(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// Stop will discard every pending change, any further changes are rejected
+func (d *Debouncer) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, p := range d.pending {
+		p.timer.Stop()
+	}
+	d.pending = map[string]*debouncedBackend{}
+	d.stopped = true
+}
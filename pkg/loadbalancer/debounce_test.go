@@ -0,0 +1,110 @@
+package loadbalancer
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingLoadBalancer counts the backends that are added and removed
+type countingLoadBalancer struct {
+	*FakeLoadBalancer
+
+	mu            sync.Mutex
+	adds, removes int
+}
+
+func (c *countingLoadBalancer) AddBackend(address string, port int) error {
+	c.mu.Lock()
+	c.adds++
+	c.mu.Unlock()
+	return c.FakeLoadBalancer.AddBackend(address, port)
+}
+
+func (c *countingLoadBalancer) RemoveBackend(address string, port int) error {
+	c.mu.Lock()
+	c.removes++
+	c.mu.Unlock()
+	return c.FakeLoadBalancer.RemoveBackend(address, port)
+}
+
+func (c *countingLoadBalancer) counts() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.adds, c.removes
+}
+
+func TestDebouncer(t *testing.T) {
+	tests := []struct {
+		name        string
+		registered  bool
+		events      []bool
+		wantAdds    int
+		wantRemoves int
+	}{
+		{"flap ending added", false, []bool{true, false, true, false, true}, 1, 0},
+		{"flap ending removed", false, []bool{true, false, true, false}, 0, 0},
+		{"flap of a registered backend", true, []bool{false, true, false, true}, 0, 0},
+		{"removed", true, []bool{false, false}, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := &countingLoadBalancer{FakeLoadBalancer: NewFakeLoadBalancer()}
+			if tt.registered {
+				_ = lb.FakeLoadBalancer.AddBackend("10.0.0.1", 6443)
+			}
+			d, err := NewDebouncer(lb, time.Hour)
+			if err != nil {
+				t.Fatalf("NewDebouncer() error = %v", err)
+			}
+			defer d.Stop()
+
+			for _, add := range tt.events {
+				if add {
+					err = d.AddBackend("10.0.0.1", 6443)
+				} else {
+					err = d.RemoveBackend("10.0.0.1", 6443)
+				}
+				if err != nil {
+					t.Fatalf("debounced change error = %v", err)
+				}
+			}
+			if adds, removes := lb.counts(); adds+removes != 0 {
+				t.Fatalf("%d adds and %d removes were applied within the window", adds, removes)
+			}
+			if err = d.Flush(); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+			if adds, removes := lb.counts(); adds != tt.wantAdds || removes != tt.wantRemoves {
+				t.Errorf("%d adds and %d removes were applied, expected %d and %d", adds, removes, tt.wantAdds, tt.wantRemoves)
+			}
+		})
+	}
+}
+
+func TestDebouncerWindow(t *testing.T) {
+	lb := &countingLoadBalancer{FakeLoadBalancer: NewFakeLoadBalancer()}
+	d, err := NewDebouncer(lb, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewDebouncer() error = %v", err)
+	}
+	defer d.Stop()
+
+	for x := 0; x < 5; x++ {
+		_ = d.RemoveBackend("10.0.0.1", 6443)
+		_ = d.AddBackend("10.0.0.1", 6443)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if ok, _ := lb.HasBackend("10.0.0.1", 6443); ok {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if adds, removes := lb.counts(); adds != 1 || removes != 0 {
+		t.Errorf("%d adds and %d removes were applied, expected a single add once the window passed", adds, removes)
+	}
+	if _, err = NewDebouncer(lb, 0); err == nil {
+		t.Errorf("NewDebouncer() expected an error for a zero window")
+	}
+}
@@ -0,0 +1,235 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// WithDryRun creates the load balancer without touching IPVS, every change that would be applied is
+// logged instead and the IPVS table is simulated in memory so that ListBackends returns the state that
+// would have been applied. A load balancer in dry-run mode doesn't need the IPVS kernel module.
+func WithDryRun() Option {
+	return func(lb *IPVSLoadBalancer) error {
+		lb.dryRun = true
+		return nil
+	}
+}
+
+// isDryRun returns true if the options enable dry-run mode, so that the IPVS client is never created
+func isDryRun(opts []Option) bool {
+	return optionsOf(opts).dryRun
+}
+
+// dryRunClient is an in-memory Client that logs the changes it would make to IPVS, it returns the same
+// errno values as the kernel so that the load balancer behaves the same as it would against IPVS
+type dryRunClient struct {
+	mu       sync.Mutex
+	services map[string]*dryRunService
+	logger   Logger
+}
+
+type dryRunService struct {
+	svc  ipvs.Service
+	dsts map[string]ipvs.Destination
+}
+
+var _ Client = &dryRunClient{}
+
+// newDryRunClient returns a dry-run client that logs to the logger, or the default logger if it is nil
+func newDryRunClient(logger Logger) *dryRunClient {
+	if logger == nil {
+		logger = defaultLogger
+	}
+	return &dryRunClient{services: map[string]*dryRunService{}, logger: logger}
+}
+
+func dryRunServiceKey(svc ipvs.Service) string {
+	return fmt.Sprintf("%d/%d/%x/%d/%d", svc.Family, svc.Protocol, svc.Address, svc.Port, svc.FWMark)
+}
+
+func dryRunDestinationKey(dst ipvs.Destination) string {
+	return fmt.Sprintf("%d/%x/%d", dst.Family, dst.Address, dst.Port)
+}
+
+// log returns a log entry for a change that would be applied to a service
+func (d *dryRunClient) log(svc ipvs.Service, operation string) Logger {
+	return serviceLog(d.logger, svc, operation).WithField("dry_run", true)
+}
+
+// destinationLog returns a log entry for a change that would be applied to a destination
+func (d *dryRunClient) destinationLog(svc ipvs.Service, dst ipvs.Destination, operation string) Logger {
+	return d.log(svc, operation).WithFields(Fields{
+		"backend": backendKey(dst.Address.Net(dst.Family).String(), int(dst.Port)),
+		"weight":  dst.Weight,
+	})
+}
+
+func (d *dryRunClient) Services() ([]ipvs.ServiceExtended, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var svcs []ipvs.ServiceExtended
+	for _, s := range d.services {
+		svcs = append(svcs, ipvs.ServiceExtended{Service: s.svc})
+	}
+	return svcs, nil
+}
+
+func (d *dryRunClient) Service(svc ipvs.Service) (ipvs.ServiceExtended, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.services[dryRunServiceKey(svc)]
+	if !ok {
+		return ipvs.ServiceExtended{}, syscall.ESRCH
+	}
+	return ipvs.ServiceExtended{Service: s.svc}, nil
+}
+
+func (d *dryRunClient) CreateService(svc ipvs.Service) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := dryRunServiceKey(svc)
+	if _, ok := d.services[key]; ok {
+		return syscall.EEXIST
+	}
+	d.services[key] = &dryRunService{svc: svc, dsts: map[string]ipvs.Destination{}}
+	d.log(svc, opCreateService).WithField("scheduler", svc.Scheduler).Info("would create IPVS service")
+	return nil
+}
+
+func (d *dryRunClient) UpdateService(svc ipvs.Service) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.services[dryRunServiceKey(svc)]
+	if !ok {
+		return syscall.ESRCH
+	}
+	s.svc = svc
+	d.log(svc, "update_service").WithField("scheduler", svc.Scheduler).Info("would update IPVS service")
+	return nil
+}
+
+func (d *dryRunClient) RemoveService(svc ipvs.Service) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := dryRunServiceKey(svc)
+	if _, ok := d.services[key]; !ok {
+		return syscall.ESRCH
+	}
+	delete(d.services, key)
+	d.log(svc, opRemoveService).Info("would remove IPVS service")
+	return nil
+}
+
+func (d *dryRunClient) Destinations(svc ipvs.Service) ([]ipvs.DestinationExtended, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.services[dryRunServiceKey(svc)]
+	if !ok {
+		return nil, syscall.ESRCH
+	}
+	var dsts []ipvs.DestinationExtended
+	for _, dst := range s.dsts {
+		dsts = append(dsts, ipvs.DestinationExtended{Destination: dst})
+	}
+	return dsts, nil
+}
+
+func (d *dryRunClient) CreateDestination(svc ipvs.Service, dst ipvs.Destination) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.services[dryRunServiceKey(svc)]
+	if !ok {
+		return syscall.ESRCH
+	}
+	key := dryRunDestinationKey(dst)
+	if _, ok := s.dsts[key]; ok {
+		return syscall.EEXIST
+	}
+	s.dsts[key] = dst
+	d.destinationLog(svc, dst, opAddBackend).Info("would add backend")
+	return nil
+}
+
+func (d *dryRunClient) UpdateDestination(svc ipvs.Service, dst ipvs.Destination) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.services[dryRunServiceKey(svc)]
+	if !ok {
+		return syscall.ESRCH
+	}
+	key := dryRunDestinationKey(dst)
+	if _, ok := s.dsts[key]; !ok {
+		return syscall.ENOENT
+	}
+	s.dsts[key] = dst
+	d.destinationLog(svc, dst, opUpdateBackend).Info("would update backend")
+	return nil
+}
+
+func (d *dryRunClient) RemoveDestination(svc ipvs.Service, dst ipvs.Destination) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.services[dryRunServiceKey(svc)]
+	if !ok {
+		return syscall.ESRCH
+	}
+	key := dryRunDestinationKey(dst)
+	if _, ok := s.dsts[key]; !ok {
+		return syscall.ENOENT
+	}
+	delete(s.dsts, key)
+	d.destinationLog(svc, dst, opRemoveBackend).Info("would remove backend")
+	return nil
+}
+
+// SetTimeouts logs the IPVS connection timeouts that would be set
+func (d *dryRunClient) SetTimeouts(timeouts Timeouts) error {
+	d.logger.WithFields(Fields{
+		"tcp":     timeouts.TCP,
+		"tcp_fin": timeouts.TCPFin,
+		"udp":     timeouts.UDP,
+		"dry_run": true,
+	}).Info("would set IPVS connection timeouts")
+	return nil
+}
+
+// ZeroService logs the counters that would be zeroed
+func (d *dryRunClient) ZeroService(svc ipvs.Service) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.services[dryRunServiceKey(svc)]; !ok {
+		return syscall.ESRCH
+	}
+	d.log(svc, opResetStats).Info("would zero the IPVS counters")
+	return nil
+}
+
+// StartSyncDaemon logs the connection sync daemon that would be started
+func (d *dryRunClient) StartSyncDaemon(state uint32, iface string) error {
+	d.logger.WithFields(Fields{"state": state, "interface": iface, "dry_run": true}).Info("would start the IPVS connection sync daemon")
+	return nil
+}
+
+// StopSyncDaemon logs the connection sync daemon that would be stopped
+func (d *dryRunClient) StopSyncDaemon(state uint32) error {
+	d.logger.WithFields(Fields{"state": state, "dry_run": true}).Info("would stop the IPVS connection sync daemon")
+	return nil
+}
+
+// SetDestinationTunnel logs the tunnel that would be set on a destination
+func (d *dryRunClient) SetDestinationTunnel(svc ipvs.Service, dst ipvs.Destination, tunnel Tunnel) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.services[dryRunServiceKey(svc)]
+	if !ok {
+		return syscall.ESRCH
+	}
+	if _, ok := s.dsts[dryRunDestinationKey(dst)]; !ok {
+		return syscall.ENOENT
+	}
+	d.destinationLog(svc, dst, opUpdateBackend).WithFields(Fields{"tunnel": tunnel.Type.String(), "tunnel_port": tunnel.Port}).Info("would set backend tunnel")
+	return nil
+}
@@ -0,0 +1,108 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// ErrAlreadyExists is matched (with errors.Is) by errors where IPVS reports that the service or
+// backend already exists
+var ErrAlreadyExists = errors.New("already exists")
+
+// ErrBackendNotFound is returned when an operation targets a backend that isn't registered
+var ErrBackendNotFound = errors.New("backend not found")
+
+// ErrFamilyMismatch is returned when the address family of a backend (IPv4 or IPv6) doesn't match the VIP
+var ErrFamilyMismatch = errors.New("address family mismatch")
+
+// ErrServiceNotFound is matched (with errors.Is) by errors where IPVS reports that the service of the load
+// balancer no longer exists, such as when it has been removed (or removed and re-created by another load
+// balancer) since this load balancer created it. The backends need to be re-synced with a new load balancer.
+var ErrServiceNotFound = errors.New("IPVS service not found")
+
+// opDescriptions are the human readable descriptions of the operations used in error messages
+var opDescriptions = map[string]string{
+	opCreateService: "creating IPVS service",
+	opRemoveService: "removing IPVS service",
+	opUpdateService: "updating IPVS service",
+	opAddBackend:    "adding backend",
+	opRemoveBackend: "removing backend",
+	opUpdateBackend: "updating backend",
+	opReconcile:     "reconciling backends",
+}
+
+// Error is returned when an operation on the IPVS service or one of its backends fails, it can be
+// retrieved with errors.As to find the operation and target. The kernel errno can be matched against
+// the sentinel errors of this package (such as ErrAlreadyExists), whilst still unwrapping to the cause.
+type Error struct {
+	// Op is the operation that failed, such as "add_backend"
+	Op string
+	// VIP and Port identify the IPVS service, or FWMark for a firewall mark service
+	VIP    string
+	Port   int
+	FWMark uint32
+	// Backend is the address and port of the backend, it is empty for operations on the service
+	Backend string
+	// Err is the cause of the failure
+	Err error
+}
+
+func (e *Error) Error() string {
+	desc, ok := opDescriptions[e.Op]
+	if !ok {
+		desc = e.Op
+	}
+	service := backendKey(e.VIP, e.Port)
+	if e.FWMark != 0 {
+		service = fmt.Sprintf("fwmark %d", e.FWMark)
+	}
+	if e.Backend != "" {
+		return fmt.Sprintf("error %s [%s] of [%s]: %v", desc, e.Backend, service, e.Err)
+	}
+	return fmt.Sprintf("error %s [%s]: %v", desc, service, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is allows errors.Is to match the sentinel errors against the underlying errno
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrAlreadyExists:
+		return errors.Is(e.Err, syscall.EEXIST)
+	case ErrServiceNotFound:
+		return errors.Is(e.Err, syscall.ESRCH)
+	}
+	return false
+}
+
+// newError returns an Error for an operation on a service (and backend), nil is returned unchanged
+func newError(op string, svc ipvs.Service, backend string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if svc.FWMark != 0 {
+		return &Error{Op: op, FWMark: svc.FWMark, Backend: backend, Err: err}
+	}
+	return &Error{
+		Op:      op,
+		VIP:     svc.Address.Net(svc.Family).String(),
+		Port:    int(svc.Port),
+		Backend: backend,
+		Err:     err,
+	}
+}
+
+// isExists returns true if the error is due to an IPVS service or backend already existing
+func isExists(err error) bool {
+	return errors.Is(err, ErrAlreadyExists) || errors.Is(err, syscall.EEXIST)
+}
+
+// isNotFound returns true if the error is due to an IPVS service (ESRCH) or backend (ENOENT) not existing
+func isNotFound(err error) bool {
+	return errors.Is(err, syscall.ESRCH) || errors.Is(err, syscall.ENOENT)
+}
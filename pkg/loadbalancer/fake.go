@@ -0,0 +1,225 @@
+package loadbalancer
+
+import (
+	"sort"
+	"sync"
+)
+
+// LoadBalancer is the interface of an IPVS load balancer used to manage its backends, it is the DataPlane
+// along with the removal of its IPVS services. It is satisfied by *IPVSLoadBalancer and by FakeLoadBalancer
+// so that code managing the backends can be tested without IPVS.
+type LoadBalancer interface {
+	DataPlane
+	RemoveIPVSLB() error
+}
+
+// *IPVSLoadBalancer must always satisfy LoadBalancer
+var _ LoadBalancer = &IPVSLoadBalancer{}
+
+// FakeLoadBalancer is an in-memory LoadBalancer for tests, it validates the backends in the same manner as
+// the IPVS load balancer but doesn't touch the kernel. The zero value is ready to use.
+type FakeLoadBalancer struct {
+	mu       sync.Mutex
+	backends map[string]Backend
+	removed  bool
+}
+
+// FakeLoadBalancer must always satisfy LoadBalancer (and so DataPlane)
+var _ LoadBalancer = &FakeLoadBalancer{}
+
+// NewFakeLoadBalancer returns an in-memory load balancer with the backends already registered
+func NewFakeLoadBalancer(backends ...Backend) *FakeLoadBalancer {
+	f := &FakeLoadBalancer{}
+	for _, backend := range backends {
+		f.set(backend)
+	}
+	return f
+}
+
+// set registers a backend, the caller must hold the lock
+func (f *FakeLoadBalancer) set(backend Backend) {
+	if f.backends == nil {
+		f.backends = map[string]Backend{}
+	}
+	backend.Healthy = true
+	f.backends[backendKey(backend.Address, backend.Port)] = backend
+}
+
+// fakeBackendKey validates a backend and returns its key and normalised address
+func fakeBackendKey(address string, port int) (string, string, error) {
+	ip, _, err := parseAddress(address)
+	if err != nil {
+		return "", "", err
+	}
+	if err = validatePort(port); err != nil {
+		return "", "", err
+	}
+	return backendKey(ip.String(), port), ip.String(), nil
+}
+
+// AddBackend will add a backend with the default weight
+func (f *FakeLoadBalancer) AddBackend(address string, port int) error {
+	return f.AddBackendWithWeight(address, port, DefaultWeight)
+}
+
+// AddBackendWithWeight will add a backend with a weight, adding an existing backend is a no-op
+func (f *FakeLoadBalancer) AddBackendWithWeight(address string, port, weight int) error {
+	if err := validateWeight(weight, 0); err != nil {
+		return err
+	}
+	key, ip, err := fakeBackendKey(address, port)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.removed {
+		return ErrServiceNotFound
+	}
+	if _, ok := f.backends[key]; !ok {
+		f.set(Backend{Address: ip, Port: port, Weight: weight})
+	}
+	return nil
+}
+
+// RemoveBackend will remove a backend, removing a backend that isn't registered is a no-op
+func (f *FakeLoadBalancer) RemoveBackend(address string, port int) error {
+	key, _, err := fakeBackendKey(address, port)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.removed {
+		return ErrServiceNotFound
+	}
+	delete(f.backends, key)
+	return nil
+}
+
+// UpdateBackendWeight will change the weight of a backend, ErrBackendNotFound is returned if it isn't registered
+func (f *FakeLoadBalancer) UpdateBackendWeight(address string, port, weight int) error {
+	if err := validateWeight(weight, 0); err != nil {
+		return err
+	}
+	key, _, err := fakeBackendKey(address, port)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.removed {
+		return ErrServiceNotFound
+	}
+	backend, ok := f.backends[key]
+	if !ok {
+		return ErrBackendNotFound
+	}
+	backend.Weight = weight
+	f.backends[key] = backend
+	return nil
+}
+
+// HasBackend returns true if the backend is registered
+func (f *FakeLoadBalancer) HasBackend(address string, port int) (bool, error) {
+	key, _, err := fakeBackendKey(address, port)
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.removed {
+		return false, ErrServiceNotFound
+	}
+	_, ok := f.backends[key]
+	return ok, nil
+}
+
+// ListBackends returns the registered backends sorted by address and port
+func (f *FakeLoadBalancer) ListBackends() ([]Backend, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.removed {
+		return nil, ErrServiceNotFound
+	}
+
+	keys := make([]string, 0, len(f.backends))
+	for key := range f.backends {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	backends := make([]Backend, 0, len(keys))
+	for _, key := range keys {
+		backends = append(backends, f.backends[key])
+	}
+	return backends, nil
+}
+
+// SyncBackends will make the registered backends match the desired backends in the same manner as the
+// IPVS load balancer
+func (f *FakeLoadBalancer) SyncBackends(desired []Backend) (SyncResult, error) {
+	var result SyncResult
+	wanted := make(map[string]Backend, len(desired))
+	for _, backend := range desired {
+		if err := validateWeight(backend.Weight, 0); err != nil {
+			return result, err
+		}
+		key, ip, err := fakeBackendKey(backend.Address, backend.Port)
+		if err != nil {
+			return result, err
+		}
+		if _, ok := wanted[key]; !ok {
+			backend.Address = ip
+			wanted[key] = backend
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.removed {
+		return result, ErrServiceNotFound
+	}
+	for key, backend := range wanted {
+		existing, ok := f.backends[key]
+		if !ok {
+			f.set(backend)
+			result.Added = append(result.Added, backend)
+		} else if existing.Weight != backend.Weight || existing.FwdMethod != backend.FwdMethod {
+			existing.Weight = backend.Weight
+			existing.FwdMethod = backend.FwdMethod
+			f.backends[key] = existing
+			result.Updated = append(result.Updated, existing)
+		}
+	}
+	for key, backend := range f.backends {
+		if _, ok := wanted[key]; !ok {
+			delete(f.backends, key)
+			result.Removed = append(result.Removed, backend)
+		}
+	}
+	return result, nil
+}
+
+// RemoveIPVSLB removes every backend, any further changes return ErrServiceNotFound
+func (f *FakeLoadBalancer) RemoveIPVSLB() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.backends = nil
+	f.removed = true
+	return nil
+}
+
+// Close removes the load balancer in the same manner as RemoveIPVSLB
+func (f *FakeLoadBalancer) Close() error {
+	return f.RemoveIPVSLB()
+}
+
+// String returns a description of the fake load balancer
+func (f *FakeLoadBalancer) String() string {
+	return "fake load balancer"
+}
@@ -0,0 +1,48 @@
+package loadbalancer
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFakeLoadBalancer(t *testing.T) {
+	var lb LoadBalancer = NewFakeLoadBalancer(Backend{Address: "10.0.0.1", Port: 6443, Weight: 1})
+
+	if err := lb.AddBackendWithWeight("10.0.0.2", 6443, 5); err != nil {
+		t.Fatalf("AddBackendWithWeight() error = %v", err)
+	}
+	if err := lb.AddBackend("not-an-ip", 6443); err == nil {
+		t.Errorf("AddBackend() expected an error for an invalid address")
+	}
+	if err := lb.RemoveBackend("10.0.0.3", 6443); err != nil {
+		t.Errorf("RemoveBackend() of a missing backend error = %v, expected nil", err)
+	}
+	if ok, _ := lb.HasBackend("10.0.0.2", 6443); !ok {
+		t.Errorf("HasBackend() = false, expected the added backend")
+	}
+
+	result, err := lb.SyncBackends([]Backend{
+		{Address: "10.0.0.2", Port: 6443, Weight: 2},
+		{Address: "10.0.0.3", Port: 6443, Weight: 1},
+	})
+	if err != nil {
+		t.Fatalf("SyncBackends() error = %v", err)
+	}
+	if len(result.Added) != 1 || len(result.Removed) != 1 || len(result.Updated) != 1 {
+		t.Errorf("SyncBackends() = %+v, expected one added, removed and updated backend", result)
+	}
+	backends, _ := lb.ListBackends()
+	if len(backends) != 2 || backends[0].Address != "10.0.0.2" || backends[0].Weight != 2 {
+		t.Errorf("ListBackends() = %+v, expected the synced backends", backends)
+	}
+
+	if err := lb.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := lb.AddBackend("10.0.0.1", 6443); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("AddBackend() error = %v, expected ErrServiceNotFound once closed", err)
+	}
+	if ok, err := lb.HasBackend("10.0.0.2", 6443); ok || !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("HasBackend() = %t, %v, expected ErrServiceNotFound once closed", ok, err)
+	}
+}
@@ -0,0 +1,86 @@
+//go:build go1.18
+// +build go1.18
+
+package loadbalancer
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// fuzzAddresses are the seed addresses, including the representations that normalise to the same address
+// and malformed node addresses
+var fuzzAddresses = []string{
+	"10.0.0.1", "010.0.0.1", "::ffff:10.0.0.1", "fd00::1", "[fd00::1]", "fe80::1%eth0", "0.0.0.0", "::",
+	"255.255.255.255", "10.0.0.256", "10.0.0", "10.0.0.1:6443", "node-1", "", " ", "\x00", "10.0.0.1\n",
+}
+
+// fuzzPorts are the seed ports, including those that overflow a uint16
+var fuzzPorts = []int{6443, 0, 1, 65535, 65536, 65536 + 6443, -1, -65536 + 6443, 1 << 32}
+
+func FuzzNewIPVSLB(f *testing.F) {
+	for _, address := range fuzzAddresses {
+		for _, port := range fuzzPorts {
+			f.Add(address, port)
+		}
+	}
+	f.Fuzz(func(t *testing.T, address string, port int) {
+		lb, err := NewIPVSLBWithClient(newFakeClient(), address, port)
+		if err != nil {
+			if lb != nil {
+				t.Fatalf("NewIPVSLBWithClient(%q, %d) returned a load balancer with the error %v", address, port, err)
+			}
+			return
+		}
+		if port < 1 || port > 65535 {
+			t.Fatalf("NewIPVSLBWithClient(%q, %d) accepted an invalid port", address, port)
+		}
+		if lb.Port != port || int(lb.loadBalancerService.Port) != port {
+			t.Fatalf("NewIPVSLBWithClient(%q, %d) created the service on port %d", address, port, lb.loadBalancerService.Port)
+		}
+		if ip, _, err := parseAddress(address); err != nil || !lb.Address().Equal(ip) {
+			t.Fatalf("NewIPVSLBWithClient(%q, %d) created the service on [%s]", address, port, lb.Address())
+		}
+	})
+}
+
+func FuzzAddRemoveBackend(f *testing.F) {
+	for _, address := range fuzzAddresses {
+		for _, port := range fuzzPorts {
+			f.Add(address, port)
+		}
+	}
+	f.Fuzz(func(t *testing.T, address string, port int) {
+		lb := newTestLB(t, newFakeClient())
+		var lbErr *Error
+
+		err := lb.AddBackend(address, port)
+		if err != nil {
+			if !errors.As(err, &lbErr) {
+				t.Fatalf("AddBackend(%q, %d) error = %v, expected an *Error", address, port, err)
+			}
+			if backends := mustListBackends(t, lb); len(backends) != 0 {
+				t.Fatalf("AddBackend(%q, %d) failed but registered %+v", address, port, backends)
+			}
+		} else {
+			if port < 1 || port > 65535 || net.ParseIP(normalizeAddress(address)) == nil {
+				t.Fatalf("AddBackend(%q, %d) accepted an invalid backend", address, port)
+			}
+			backends := mustListBackends(t, lb)
+			if len(backends) != 1 || backends[0].Port != port {
+				t.Fatalf("AddBackend(%q, %d) registered %+v", address, port, backends)
+			}
+		}
+
+		if err = lb.RemoveBackend(address, port); err != nil {
+			if !errors.As(err, &lbErr) {
+				t.Fatalf("RemoveBackend(%q, %d) error = %v, expected an *Error", address, port, err)
+			}
+			return
+		}
+		if backends := mustListBackends(t, lb); len(backends) != 0 {
+			t.Fatalf("RemoveBackend(%q, %d) left %+v", address, port, backends)
+		}
+	})
+}
@@ -0,0 +1,330 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// opHealthCheck is the operation used in the health checker logs
+const opHealthCheck = "health_check"
+
+// HealthCheckConfig configures the active health checking of backends
+type HealthCheckConfig struct {
+	// Interval is the time between probes of every backend
+	Interval time.Duration
+	// Timeout is the time a single probe is allowed to take
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failed probes before a backend is quiesced, it is
+	// only used when no Policy is set
+	FailureThreshold int
+	// Policy decides the weight of a backend from its probe results, the default is a QuiescePolicy
+	// with the FailureThreshold
+	Policy HealthPolicy
+	// Prober probes each backend, the default depends on the protocol of the load balancer (a TCPProber,
+	// UDPProber or SCTPProber). A firewall mark service matches every protocol so it requires a Prober.
+	Prober Prober
+	// GracePeriod is how long a backend must have been failing its probes before its weight is reduced,
+	// so that a single missed probe doesn't drop a node. The default of 0 applies the Policy immediately.
+	GracePeriod time.Duration
+	// MaxBackoff enables backing off when every backend fails its probe (with at least two backends), as
+	// that is more likely to be a blip of the network than of every backend. The weights are left unchanged
+	// rather than flapping every backend to zero, and the interval doubles on each such round up to the
+	// MaxBackoff. The interval is reset once any backend passes its probe. The default of 0 disables it.
+	MaxBackoff time.Duration
+}
+
+// clock is the source of time of the health checker, it is replaced by the tests
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+}
+
+// ticker delivers the ticks of a clock
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock of the system
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) ticker { return realTicker{time.NewTicker(d)} }
+
+// realTicker is a ticker of the system clock
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// HealthPolicy decides the weight of a backend after each health check probe, it is given the current
+// weight of the backend, the weight it is configured with (which is restored once it is healthy) and the
+// number of consecutive failed probes (0 once a probe has passed)
+type HealthPolicy interface {
+	Weight(current, configured, failures int) int
+}
+
+// QuiescePolicy quiesces a backend (weight 0) once it has failed the threshold of consecutive probes and
+// restores its weight once it passes a probe
+type QuiescePolicy struct {
+	FailureThreshold int
+}
+
+// Weight returns the weight of a backend after a probe
+func (p QuiescePolicy) Weight(current, configured, failures int) int {
+	switch {
+	case failures == 0:
+		return configured
+	case failures >= p.FailureThreshold:
+		return 0
+	}
+	return current
+}
+
+// DecayPolicy halves the weight of a backend on each consecutive failed probe, so that traffic moves
+// gradually away from a degraded backend, and restores its weight once it passes a probe
+type DecayPolicy struct{}
+
+// Weight returns the weight of a backend after a probe
+func (DecayPolicy) Weight(current, configured, failures int) int {
+	if failures == 0 {
+		return configured
+	}
+	return current / 2
+}
+
+// backendHealth is the health check state of a single backend
+type backendHealth struct {
+	failures int
+	// failingSince is the time of the first of the consecutive failed probes
+	failingSince time.Time
+	// quiesced is true whilst the health checker has reduced the weight of the backend
+	quiesced bool
+	// weight is the weight to restore once a quiesced backend recovers
+	weight int
+}
+
+// StartHealthCheck will begin periodically probing every backend, a backend that fails the configured
+// number of consecutive probes is quiesced (weight 0) rather than removed, and the original weight is
+// restored once it passes a probe again. The health checker runs until StopHealthCheck is called.
+func (lb *IPVSLoadBalancer) StartHealthCheck(config HealthCheckConfig) error {
+	return lb.StartHealthCheckContext(context.Background(), config)
+}
+
+// StartHealthCheckContext will begin health checking the backends as StartHealthCheck, the health checker
+// runs until the context is done or StopHealthCheck is called
+func (lb *IPVSLoadBalancer) StartHealthCheckContext(ctx context.Context, config HealthCheckConfig) error {
+	if config.Interval <= 0 || config.Timeout <= 0 {
+		return fmt.Errorf("health check interval and timeout must be positive durations")
+	}
+	if config.GracePeriod < 0 {
+		return fmt.Errorf("invalid health check grace period [%s], must not be negative", config.GracePeriod)
+	}
+	if config.MaxBackoff != 0 && config.MaxBackoff < config.Interval {
+		return fmt.Errorf("invalid health check maximum backoff [%s], must not be less than the interval [%s]", config.MaxBackoff, config.Interval)
+	}
+	if config.Policy == nil {
+		if config.FailureThreshold < 1 {
+			return fmt.Errorf("invalid health check failure threshold [%d], must be at least 1", config.FailureThreshold)
+		}
+		config.Policy = QuiescePolicy{FailureThreshold: config.FailureThreshold}
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if config.Prober == nil {
+		config.Prober = defaultProber(lb.protocolName(), lb.sourceAddress)
+		if config.Prober == nil {
+			return fmt.Errorf("health checking a firewall mark service requires a Prober")
+		}
+	}
+	if lb.healthCancel != nil {
+		return fmt.Errorf("health checking is already running")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	lb.health = map[string]*backendHealth{}
+	lb.probeUnsupported = false
+	lb.healthCancel = cancel
+	lb.healthDone = done
+
+	go func() {
+		defer close(done)
+		lb.healthCheckLoop(ctx, config)
+
+		// The health checker can be started again once its context is done
+		lb.mu.Lock()
+		if lb.healthDone == done {
+			lb.healthCancel, lb.healthDone = nil, nil
+		}
+		lb.mu.Unlock()
+		cancel()
+	}()
+	return nil
+}
+
+// healthCheckLoop probes the backends on each tick until the context is done, backing off whilst every
+// backend fails its probe
+func (lb *IPVSLoadBalancer) healthCheckLoop(ctx context.Context, config HealthCheckConfig) {
+	interval := config.Interval
+	t := lb.clock.NewTicker(interval)
+	defer func() { t.Stop() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C():
+		}
+
+		next := config.Interval
+		if lb.runHealthCheck(config) && config.MaxBackoff > 0 {
+			next = interval * 2
+			if next > config.MaxBackoff {
+				next = config.MaxBackoff
+			}
+			lb.logEntry(opHealthCheck).WithField("interval", next).Warn("every backend has failed its health check, leaving the weights unchanged and backing off")
+		}
+		if next != interval {
+			t.Stop()
+			interval = next
+			t = lb.clock.NewTicker(interval)
+		}
+	}
+}
+
+// StopHealthCheck will stop the health checker (if running) and wait for it to exit, any quiesced
+// backends are left with a zero weight but are no longer treated as quiesced
+func (lb *IPVSLoadBalancer) StopHealthCheck() {
+	lb.mu.Lock()
+	cancel, done := lb.healthCancel, lb.healthDone
+	lb.healthCancel, lb.healthDone = nil, nil
+	lb.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+
+	// The health state is only meaningful whilst the health checker is running
+	lb.mu.Lock()
+	lb.health = map[string]*backendHealth{}
+	lb.mu.Unlock()
+}
+
+// runHealthCheck probes all of the backends and updates their weights with the results, true is returned
+// if every backend failed its probe (which leaves the weights unchanged when backing off is enabled)
+func (lb *IPVSLoadBalancer) runHealthCheck(config HealthCheckConfig) bool {
+	backends, err := lb.ListBackends()
+	if err != nil {
+		lb.logEntry(opHealthCheck).Errorf("health check unable to list backends [%v]", err)
+		return false
+	}
+
+	results := make([]error, len(backends))
+	var wg sync.WaitGroup
+	for x := range backends {
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+			defer cancel()
+			results[x] = config.Prober.Probe(ctx, backends[x].Address, backends[x].Port)
+		}(x)
+	}
+	wg.Wait()
+
+	probed, failed := 0, 0
+	for x := range results {
+		if !errors.Is(results[x], ErrProbeUnsupported) {
+			probed++
+			if results[x] != nil {
+				failed++
+			}
+		}
+	}
+	outage := probed > 1 && failed == probed
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if outage && config.MaxBackoff > 0 {
+		return true
+	}
+	for x := range backends {
+		if errors.Is(results[x], ErrProbeUnsupported) {
+			// The health of the backend is unknown, so it is left unchanged rather than quiesced
+			if !lb.probeUnsupported {
+				lb.logEntry(opHealthCheck).Warnf("unable to health check the backends, they are left unchanged [%v]", results[x])
+				lb.probeUnsupported = true
+			}
+			continue
+		}
+		lb.applyHealth(backends[x], results[x], config.Policy, config.GracePeriod)
+	}
+	return outage
+}
+
+// applyHealth updates the health state of a backend with a probe result and applies the weight decided
+// by the policy, the weight of a failing backend isn't reduced until it has been failing for the grace
+// period. The caller must hold the write lock.
+func (lb *IPVSLoadBalancer) applyHealth(backend Backend, result error, policy HealthPolicy, grace time.Duration) {
+	key := backendKey(backend.Address, backend.Port)
+	logEntry := lb.logEntry(opHealthCheck).WithField("backend", key)
+	h, ok := lb.health[key]
+	if !ok {
+		h = &backendHealth{}
+		lb.health[key] = h
+	}
+	if !h.quiesced {
+		h.weight = backend.Weight
+	}
+
+	now := lb.clock.Now()
+	if result == nil {
+		h.failures = 0
+	} else {
+		if h.failures == 0 {
+			h.failingSince = now
+		}
+		h.failures++
+	}
+	weight := policy.Weight(backend.Weight, h.weight, h.failures)
+	if weight < 0 {
+		weight = 0
+	}
+	if result != nil && weight < backend.Weight && now.Sub(h.failingSince) < grace {
+		logEntry.WithField("failures", h.failures).Debugf("backend has failed health checks [%v] within the grace period", result)
+		return
+	}
+	if weight == backend.Weight {
+		h.quiesced = weight != h.weight
+		return
+	}
+
+	if err := lb.updateBackend(backend, weight); err != nil {
+		logEntry.Errorf("health check unable to change the backend weight [%v]", err)
+		return
+	}
+	h.quiesced = weight != h.weight
+	switch {
+	case !h.quiesced:
+		logEntry.WithField("weight", weight).Info("backend is healthy, restored weight")
+	case weight == 0:
+		logEntry.WithField("failures", h.failures).Warnf("backend has failed health checks [%v], quiescing", result)
+	default:
+		logEntry.WithFields(Fields{"failures": h.failures, "weight": weight}).Warnf("backend has failed health checks [%v], reducing weight", result)
+	}
+}
+
+// isQuiesced returns true if a backend has been quiesced by the health checker, the caller must hold the lock
+func (lb *IPVSLoadBalancer) isQuiesced(key string) bool {
+	h, ok := lb.health[key]
+	return ok && h.quiesced
+}
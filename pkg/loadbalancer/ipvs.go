@@ -1,12 +1,21 @@
 package loadbalancer
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/cloudflare/ipvs"
-	log "github.com/sirupsen/logrus"
+	"github.com/mdlayher/netlink/nlenc"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 )
 
 /*
@@ -28,93 +37,1377 @@ the nodes from the IPVS load-balancer.
 */
 
 const (
+	// ROUNDROBIN is the round-robin scheduler
+	//
+	// Deprecated: use SchedulerRR
 	ROUNDROBIN = "rr"
+
+	// DefaultWeight is the weight of backends that are added without a weight, unless the load balancer
+	// is created WithDefaultWeight
+	DefaultWeight = 1
+
+	// MaxWeight is the largest weight accepted by IPVS, the kernel rejects weights beyond the range of a
+	// signed 32-bit integer
+	MaxWeight = math.MaxInt32
+)
+
+// Scheduler is an IPVS scheduling algorithm
+type Scheduler string
+
+// The IPVS scheduling algorithms that the load balancer can be created with
+const (
+	SchedulerRR    Scheduler = "rr"    // round-robin
+	SchedulerWRR   Scheduler = "wrr"   // weighted round-robin
+	SchedulerLC    Scheduler = "lc"    // least-connection
+	SchedulerWLC   Scheduler = "wlc"   // weighted least-connection
+	SchedulerSH    Scheduler = "sh"    // source hashing
+	SchedulerDH    Scheduler = "dh"    // destination hashing
+	SchedulerLBLC  Scheduler = "lblc"  // locality-based least-connection
+	SchedulerLBLCR Scheduler = "lblcr" // locality-based least-connection with replication
+	SchedulerOVF   Scheduler = "ovf"   // overflow-connection, the highest weight backend until it is full
+	SchedulerFO    Scheduler = "fo"    // weighted failover, the highest weight available backend
 )
 
+// schedulers are the IPVS scheduling algorithms that the load balancer can be created with
+var schedulers = map[Scheduler]bool{
+	SchedulerRR:    true,
+	SchedulerWRR:   true,
+	SchedulerLC:    true,
+	SchedulerWLC:   true,
+	SchedulerSH:    true,
+	SchedulerDH:    true,
+	SchedulerLBLC:  true,
+	SchedulerLBLCR: true,
+	SchedulerOVF:   true,
+	SchedulerFO:    true,
+}
+
+// protocols maps the supported protocol names to their IPVS protocol
+var protocols = map[string]ipvs.Protocol{
+	"tcp":  ipvs.TCP,
+	"udp":  ipvs.UDP,
+	"sctp": ipvs.SCTP,
+}
+
+// forwardMethods are the IPVS forwarding methods that can be used for backends
+var forwardMethods = map[ipvs.ForwardType]bool{
+	ipvs.Masquarade:  true,
+	ipvs.Local:       true,
+	ipvs.Tunnel:      true,
+	ipvs.DirectRoute: true,
+}
+
 type IPVSLoadBalancer struct {
-	client              ipvs.Client
+	// mu guards the client and service, mutating operations take the write lock whilst reads such
+	// as ListBackends can proceed under the read lock
+	mu sync.RWMutex
+
+	client              Client
 	loadBalancerService ipvs.Service
 	Port                int
+	scheduler           Scheduler
+	protocol            ipvs.Protocol
+	forwardMethod       ipvs.ForwardType
+	sourceAddress       net.IP
+	defaultWeight       int
+	weightFunc          WeightFunc
+	backendPort         int
+	strict              bool
+	persistenceTimeout  time.Duration
+	persistenceNetmask  int
+	timeouts            Timeouts
+	schedulerFlags      ipvs.Flags
+	dryRun              bool
+	netns               string
+	retryAttempts       int
+	retryDelay          time.Duration
+	bootRetryAttempts   int
+	bootRetryDelay      time.Duration
+	operationTimeout    time.Duration
+	adoptionTimeout     time.Duration
+	removeGracePeriod   time.Duration
+	conflictMode        ConflictMode
+	origin              ServiceOrigin
+	registered          bool
+	topologyValidation  bool
+	logger              Logger
+	resolver            *hostResolver
+	onServiceRecreated  func(vip string, port int)
+	onNoBackends        func(vip string, port int)
+	initialBackends     []Backend
+
+	// portServices are the IPVS services for any additional ports of the VIP, they share the same
+	// backends as the loadBalancerService
+	portServices map[int]ipvs.Service
+
+	// desired are the backends as they were last applied by the load balancer, keyed by backend address
+	// and port, Reconcile corrects any drift of IPVS from them
+	desired map[string]Backend
+
+	// sctpAddresses are the additional addresses of multi-homed SCTP backends, keyed by backend
+	sctpAddresses map[string][]string
+
+	// health is the state of the active health checker, keyed by backend address and port
+	health       map[string]*backendHealth
+	healthCancel context.CancelFunc
+	healthDone   chan struct{}
+	clock        clock
+	// probeUnsupported is set once the health checker has logged that its probe isn't supported
+	probeUnsupported bool
+
+	// watchers receive the backends whenever they are changed
+	watchers map[chan []Backend]struct{}
+
+	// syncRole and syncInterface are of the connection sync daemon whilst it is running, see
+	// StartConnectionSync
+	syncRole      string
+	syncInterface string
+
+	// hasBackends is true whilst the primary service has backends, so that the removal of the last
+	// backend is only reported once
+	hasBackends bool
+
+	// ownsClient is true when the load balancer is responsible for closing the client
+	ownsClient bool
+	closed     bool
+	// done is closed once the load balancer has been closed
+	done chan struct{}
 }
 
-func NewIPVSLB(address string, port int) (*IPVSLoadBalancer, error) {
+// NewIPVSLB will create an IPVS service for the address and port, by default the service is tcp with the
+// round-robin scheduler which can be changed WithProtocol and WithScheduler
+func NewIPVSLB(address string, port int, opts ...Option) (*IPVSLoadBalancer, error) {
+	return NewIPVSLBContext(context.Background(), address, port, opts...)
+}
 
-	// Create IPVS client
-	c, err := ipvs.New()
+// NewIPVSLBContext will create an IPVS service in the same manner as NewIPVSLB, returning the context
+// error if the context is done before the IPVS service has been created
+func NewIPVSLBContext(ctx context.Context, address string, port int, opts ...Option) (*IPVSLoadBalancer, error) {
+	svc, err := addressService(address, port)
 	if err != nil {
-		return nil, fmt.Errorf("error creating IPVS client: %v", err)
+		return nil, err
 	}
+	return openIPVSLB(ctx, svc, opts...)
+}
 
-	// Generate out API Server LoadBalancer instance
-	svc := ipvs.Service{
-		Family:    ipvs.INET,
-		Protocol:  ipvs.TCP,
-		Port:      uint16(port),
-		Address:   ipvs.NewIP(net.ParseIP(address)),
-		Scheduler: ROUNDROBIN,
-	}
-	err = c.CreateService(svc)
-	// If we've an error it could be that the IPVS lb instance has been left from a previous leadership
-	if err != nil && strings.Contains(err.Error(), "file exists") {
-		log.Warnf("load balancer for API server already exists, attempting to remove and re-create")
-		err = c.RemoveService(svc)
+// NewIPVSLBWithClient will create an IPVS service in the same manner as NewIPVSLB using an existing
+// client, this allows the load balancer to be used without a real IPVS kernel module (such as in tests).
+// The caller keeps ownership of the client and Close will not close it, unless it is a SharedClient in
+// which case the load balancer holds a reference that is released by Close.
+func NewIPVSLBWithClient(c Client, address string, port int, opts ...Option) (*IPVSLoadBalancer, error) {
+	svc, err := addressService(address, port)
+	if err != nil {
+		return nil, err
+	}
+	return newIPVSLBWithClient(c, svc, opts...)
+}
+
+// NewIPVSLBFwmark will create an IPVS service that matches traffic by the firewall mark (set by iptables)
+// rather than the VIP and port, this allows a single service to front the traffic of multiple VIPs. The
+// family (ipvs.INET or ipvs.INET6) is the address family of the marked traffic and the backends. The
+// service matches every protocol, so it can't be created WithProtocol.
+func NewIPVSLBFwmark(fwmark uint32, family ipvs.AddressFamily, opts ...Option) (*IPVSLoadBalancer, error) {
+	svc, err := fwmarkService(fwmark, family)
+	if err != nil {
+		return nil, err
+	}
+	return openIPVSLB(context.Background(), svc, opts...)
+}
+
+// NewIPVSLBFwmarkWithClient will create a firewall mark IPVS service in the same manner as NewIPVSLBFwmark
+// using an existing client, the ownership of the client is the same as NewIPVSLBWithClient
+func NewIPVSLBFwmarkWithClient(c Client, fwmark uint32, family ipvs.AddressFamily, opts ...Option) (*IPVSLoadBalancer, error) {
+	svc, err := fwmarkService(fwmark, family)
+	if err != nil {
+		return nil, err
+	}
+	return newIPVSLBWithClient(c, svc, opts...)
+}
+
+// addressService returns the identity of an IPVS service that matches traffic by address and port, the
+// protocol is set once the options have been applied
+func addressService(address string, port int) (ipvs.Service, error) {
+	ip, family, err := parseAddress(address)
+	if err != nil {
+		return ipvs.Service{}, err
+	}
+	if err = validatePort(port); err != nil {
+		return ipvs.Service{}, err
+	}
+	return ipvs.Service{
+		Family:  family,
+		Port:    uint16(port),
+		Address: ipvs.NewIP(ip),
+	}, nil
+}
+
+// fwmarkService returns the identity of an IPVS service that matches traffic by firewall mark
+func fwmarkService(fwmark uint32, family ipvs.AddressFamily) (ipvs.Service, error) {
+	if fwmark == 0 {
+		return ipvs.Service{}, fmt.Errorf("invalid firewall mark [0], must be a non-zero value")
+	}
+	if family != ipvs.INET && family != ipvs.INET6 {
+		return ipvs.Service{}, fmt.Errorf("unknown address family [%s], expected ipvs.INET or ipvs.INET6", family)
+	}
+	return ipvs.Service{Family: family, FWMark: fwmark}, nil
+}
+
+// newOwnedClient creates the IPVS client that is owned by a load balancer
+var newOwnedClient = func() (Client, error) { return newIPVSClient() }
+
+// openIPVSLB will create a new IPVS client (unless in dry-run mode) that is owned by the load balancer
+func openIPVSLB(ctx context.Context, svc ipvs.Service, opts ...Option) (*IPVSLoadBalancer, error) {
+	if isDryRun(opts) {
+		lb, err := newIPVSLB(ctx, newDryRunClient(optionsOf(opts).logger), svc, opts...)
 		if err != nil {
-			return nil, fmt.Errorf("error re-creating IPVS service: %v", err)
+			return nil, err
 		}
-		err = c.CreateService(svc)
-		if err != nil {
-			return nil, fmt.Errorf("error re-creating IPVS service: %v", err)
+		lb.ownsClient = true
+		return lb, nil
+	}
+
+	// Create IPVS client, the client is handed over to the caller so that it is closed rather than leaked
+	// if the caller has given up waiting for it
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type opened struct {
+		c   Client
+		err error
+	}
+	result := make(chan opened)
+	netns := optionsOf(opts).netns
+	go func() {
+		var c Client
+		err := inNetNS(netns, func() (err error) {
+			c, err = newOwnedClient()
+			return err
+		})
+		select {
+		case result <- opened{c: c, err: err}:
+		case <-ctx.Done():
+			if err == nil {
+				_ = closeClient(c)
+			}
+		}
+	}()
+
+	var c Client
+	select {
+	case r := <-result:
+		if r.err != nil {
+			return nil, r.err
 		}
-	} else if err != nil {
-		return nil, fmt.Errorf("error creating IPVS service: %v", err)
+		c = r.c
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	lb, err := newIPVSLB(ctx, c, svc, opts...)
+	if err != nil {
+		_ = closeClient(c)
+		return nil, err
+	}
+	lb.ownsClient = true
+	return lb, nil
+}
+
+// newIPVSLBWithClient will create the load balancer with an existing client, taking a reference if
+// it is a SharedClient
+func newIPVSLBWithClient(c Client, svc ipvs.Service, opts ...Option) (*IPVSLoadBalancer, error) {
+	if isDryRun(opts) {
+		// The existing client is left untouched
+		c = newDryRunClient(optionsOf(opts).logger)
+	}
+	shared, ok := c.(*SharedClient)
+	if !ok {
+		return newIPVSLB(context.Background(), c, svc, opts...)
+	}
+
+	if err := shared.acquire(); err != nil {
+		return nil, err
+	}
+	lb, err := newIPVSLB(context.Background(), c, svc, opts...)
+	if err != nil {
+		_ = shared.Close()
+		return nil, err
+	}
+	lb.ownsClient = true
+	return lb, nil
+}
+
+// newIPVSLB will create the IPVS service for the load balancer using an existing client, the service is
+// identified either by its address and port or by its firewall mark
+func newIPVSLB(ctx context.Context, c Client, svc ipvs.Service, opts ...Option) (*IPVSLoadBalancer, error) {
+	if svc.FWMark != 0 && (svc.Port != 0 || svc.Address != (ipvs.IP{})) {
+		return nil, fmt.Errorf("an IPVS service is identified by either its firewall mark or its address and port, not both")
 	}
 
 	lb := &IPVSLoadBalancer{
-		Port:                port,
-		client:              c,
-		loadBalancerService: svc,
+		Port:              int(svc.Port),
+		client:            c,
+		scheduler:         SchedulerRR,
+		forwardMethod:     ipvs.Local,
+		defaultWeight:     DefaultWeight,
+		portServices:      map[int]ipvs.Service{},
+		desired:           map[string]Backend{},
+		retryAttempts:     defaultRetryAttempts,
+		retryDelay:        defaultRetryDelay,
+		bootRetryAttempts: defaultBootRetryAttempts,
+		bootRetryDelay:    defaultBootRetryDelay,
+		logger:            defaultLogger,
+		clock:             realClock{},
+		done:              make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(lb); err != nil {
+			return nil, err
+		}
+	}
+	scheduler := lb.scheduler
+	switch {
+	case svc.FWMark != 0 && lb.protocol != 0:
+		return nil, fmt.Errorf("a firewall mark service matches every protocol, it can't be created with the [%s] protocol", strings.ToLower(lb.protocol.String()))
+	case svc.FWMark == 0 && lb.protocol == 0:
+		svc.Protocol = ipvs.TCP
+	case svc.FWMark == 0:
+		svc.Protocol = lb.protocol
+	}
+	if lb.schedulerFlags&(shPort|shFallback) != 0 && scheduler != SchedulerSH {
+		return nil, fmt.Errorf("the sh-port and sh-fallback flags are only used by the source hashing (sh) scheduler, IPVS would silently ignore them with the [%s] scheduler", scheduler)
+	}
+	if lb.schedulerFlags&ipvs.ServiceOnePacket != 0 && svc.FWMark == 0 && svc.Protocol != ipvs.UDP {
+		return nil, fmt.Errorf("the one-packet scheduling (ops) flag is only used by udp services, IPVS would silently ignore it for [%s]", strings.ToLower(svc.Protocol.String()))
+	}
+
+	if lb.sourceAddress != nil {
+		if err := lb.validateSourceAddress(svc.Family); err != nil {
+			return nil, err
+		}
+	}
+	if lb.operationTimeout > 0 {
+		c = &timeoutClient{Client: c, timeout: lb.operationTimeout, netns: lb.netns}
+		lb.client = c
+	}
+
+	if lb.timeouts != (Timeouts{}) {
+		err := runWithContext(ctx, func() error {
+			return inNetNS(lb.netns, func() error { return setTimeouts(c, lb.timeouts) })
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error setting IPVS connection timeouts: %w", err)
+		}
+	}
+
+	// Generate out API Server LoadBalancer instance
+	svc.Scheduler = string(scheduler)
+	svc.Flags = lb.schedulerFlags
+	if lb.persistenceTimeout > 0 {
+		svc.Flags |= ipvs.ServicePersistent
+		svc.Timeout = uint32(lb.persistenceTimeout / time.Second)
+	}
+	if lb.persistenceNetmask != 0 {
+		if lb.persistenceTimeout == 0 {
+			return nil, fmt.Errorf("the persistence netmask requires persistence to be enabled WithPersistence")
+		}
+		netmask, err := persistenceNetmask(lb.persistenceNetmask, svc.Family)
+		if err != nil {
+			return nil, err
+		}
+		svc.Netmask = netmask
+	}
+	if err := lb.createServiceOnBoot(ctx, svc); err != nil {
+		return nil, err
+	}
+
+	lb.loadBalancerService = svc
+	// An adopted service may already have backends, they are kept rather than treated as drift
+	if current, err := lb.listBackends(false); err == nil {
+		for x := range current {
+			lb.setDesired(current[x])
+		}
+		lb.hasBackends = len(current) != 0
+	}
+	if len(lb.initialBackends) != 0 {
+		if err := lb.AddBackends(lb.initialBackends); err != nil {
+			if rmErr := lb.RemoveIPVSLB(); rmErr != nil {
+				return nil, fmt.Errorf("error adding the initial backends [%w], unable to remove the IPVS service [%v]", err, rmErr)
+			}
+			return nil, fmt.Errorf("error adding the initial backends, the IPVS service has been removed: %w", err)
+		}
+	}
+	if lb.registered {
+		lb.register()
 	}
 	// Return our created load-balancer
 	return lb, nil
 }
 
-func (lb *IPVSLoadBalancer) RemoveIPVSLB() error {
-	err := lb.client.RemoveService(lb.loadBalancerService)
+// ServiceOrigin is how the IPVS service of a load balancer came to exist when the load balancer was created
+type ServiceOrigin int
+
+const (
+	// ServiceCreated is a service that didn't exist and was created
+	ServiceCreated ServiceOrigin = iota
+	// ServiceAdopted is an existing service with a matching spec that was adopted, its backends and
+	// connections were preserved
+	ServiceAdopted
+	// ServiceRecreated is a conflicting service that was removed and re-created, its connections were lost
+	ServiceRecreated
+)
+
+func (o ServiceOrigin) String() string {
+	switch o {
+	case ServiceCreated:
+		return "created"
+	case ServiceAdopted:
+		return "adopted"
+	case ServiceRecreated:
+		return "recreated"
+	}
+	return fmt.Sprintf("ServiceOrigin(%d)", int(o))
+}
+
+// Origin returns whether the IPVS service was created, adopted or re-created when the load balancer was
+// created, so that startup code can report whether the connections to the VIP were preserved
+func (lb *IPVSLoadBalancer) Origin() ServiceOrigin {
+	return lb.origin
+}
+
+// createService will create the IPVS service, if the service already exists (it could have been left
+// from a previous leadership) then it is handled by the conflict mode, by default a service that matches
+// the desired spec is adopted so that existing connections are preserved, otherwise it is removed and
+// re-created
+func (lb *IPVSLoadBalancer) createService(ctx context.Context, svc ipvs.Service) error {
+	err := lb.retry(ctx, opCreateService, func() error { return lb.client.CreateService(svc) })
+	if err == nil {
+		lb.serviceLog(svc, opCreateService).Info("created IPVS service")
+		lb.origin = ServiceCreated
+		return nil
+	}
+	if !isExists(err) {
+		return newError(opCreateService, svc, "", schedulerError(svc, err))
+	}
+
+	if lb.conflictMode != ConflictRecreate {
+		done, err := lb.waitForAdoption(ctx, svc)
+		if done || err != nil {
+			return err
+		}
+	}
+	if lb.conflictMode == ConflictFail {
+		lb.serviceLog(svc, opCreateService).Error("load balancer for API server already exists with a different spec, leaving it in place")
+		return newError(opCreateService, svc, "", fmt.Errorf("a conflicting IPVS service with a different spec exists: %w", syscall.EEXIST))
+	}
+
+	// Capture the conflicting service so that it can be restored if it can't be re-created
+	previous, prevErr := lb.client.Service(svc)
+	var previousDsts []ipvs.DestinationExtended
+	if prevErr == nil {
+		previousDsts, prevErr = lb.client.Destinations(svc)
+	}
+
+	lb.serviceLog(svc, opCreateService).Warn("load balancer for API server already exists, attempting to remove and re-create")
+	err = lb.retry(ctx, opRemoveService, func() error { return lb.client.RemoveService(svc) })
 	if err != nil {
-		return fmt.Errorf("error removing existing IPVS service: %v", err)
+		return newError(opRemoveService, svc, "", err)
+	}
+	err = lb.retry(ctx, opCreateService, func() error { return lb.client.CreateService(svc) })
+	if err != nil {
+		err = newError(opCreateService, svc, "", schedulerError(svc, err))
+		if prevErr != nil {
+			lb.serviceLog(svc, opCreateService).Errorf("the conflicting IPVS service was removed but couldn't be re-created [%v], the VIP is unserved", err)
+			return err
+		}
+		return lb.restoreService(previous.Service, previousDsts, err)
+	}
+	lb.origin = ServiceRecreated
+	if lb.onServiceRecreated != nil {
+		lb.onServiceRecreated(svc.Address.Net(svc.Family).String(), int(svc.Port))
 	}
 	return nil
+}
+
+// schedulerError explains the ENOENT returned by IPVS when a service is created (or edited) with a scheduler
+// that the kernel doesn't support, such as ovf or fo on an older kernel, other errors are returned unchanged
+func schedulerError(svc ipvs.Service, err error) error {
+	if !errors.Is(err, syscall.ENOENT) {
+		return err
+	}
+	return fmt.Errorf("the IPVS scheduler [%s] isn't supported by the kernel, the ip_vs_%s module may be unavailable: %w", svc.Scheduler, svc.Scheduler, err)
+}
+
+// restoreService will restore a conflicting service (and its backends) that was removed but couldn't be
+// re-created, so that the VIP continues to be served by the previous spec. The cause of the failure is
+// always returned.
+func (lb *IPVSLoadBalancer) restoreService(svc ipvs.Service, dsts []ipvs.DestinationExtended, cause error) error {
+	logEntry := lb.serviceLog(svc, opCreateService)
+	err := lb.retry(context.Background(), opCreateService, func() error { return lb.client.CreateService(svc) })
+	if err != nil {
+		logEntry.Errorf("the conflicting IPVS service was removed but couldn't be re-created [%v] or restored [%v], the VIP is unserved", cause, err)
+		return fmt.Errorf("%w, unable to restore the previous IPVS service [%v]", cause, err)
+	}
+	for x := range dsts {
+		dst := dsts[x].Destination
+		err = lb.retry(context.Background(), opAddBackend, func() error { return lb.client.CreateDestination(svc, dst) })
+		if err != nil && !isExists(err) {
+			logEntry.Errorf("unable to restore backend [%s] of the previous IPVS service [%v]", backendKey(dst.Address.Net(dst.Family).String(), int(dst.Port)), err)
+		}
+	}
+	logEntry.Warnf("the conflicting IPVS service couldn't be re-created [%v], the previous service has been restored", cause)
+	return fmt.Errorf("%w, the previous IPVS service has been restored", cause)
+}
+
+// adoptionPollInterval is how often a conflicting service is checked whilst waiting for it to be adoptable
+var adoptionPollInterval = 100 * time.Millisecond
+
+// waitForAdoption will adopt an existing service if it matches the desired spec, when the load balancer has
+// an adoption timeout it waits for a conflicting service to become adoptable or to disappear (in which case
+// the service is created). False is returned if the service still needs to be removed and re-created.
+func (lb *IPVSLoadBalancer) waitForAdoption(ctx context.Context, svc ipvs.Service) (bool, error) {
+	deadline := time.Now().Add(lb.adoptionTimeout)
+	for {
+		var existing ipvs.ServiceExtended
+		err := runWithContext(ctx, func() (err error) {
+			existing, err = lb.client.Service(svc)
+			return err
+		})
+		if err == nil && serviceMatches(existing.Service, svc) {
+			lb.serviceLog(svc, opCreateService).Info("load balancer for API server already exists with a matching spec, adopting it")
+			lb.origin = ServiceAdopted
+			return true, nil
+		}
+		if isNotFound(err) {
+			// The conflicting service has gone, so it can be created
+			err = lb.retry(ctx, opCreateService, func() error { return lb.client.CreateService(svc) })
+			if err == nil {
+				lb.serviceLog(svc, opCreateService).Info("created IPVS service")
+				lb.origin = ServiceCreated
+				return true, nil
+			}
+			if !isExists(err) {
+				return false, newError(opCreateService, svc, "", schedulerError(svc, err))
+			}
+		}
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if !time.Now().Before(deadline) {
+			if lb.adoptionTimeout > 0 {
+				lb.serviceLog(svc, opCreateService).WithField("timeout", lb.adoptionTimeout).Warn("conflicting IPVS service didn't become adoptable before the timeout")
+			}
+			return false, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(adoptionPollInterval):
+		}
+	}
+}
 
+// serviceMatches returns true if an existing IPVS service has the same spec as the desired service, the
+// kernel sets the hashed flag on every service so it is ignored
+func serviceMatches(existing, desired ipvs.Service) bool {
+	return existing.Address == desired.Address &&
+		existing.Port == desired.Port &&
+		existing.Family == desired.Family &&
+		existing.Protocol == desired.Protocol &&
+		existing.FWMark == desired.FWMark &&
+		existing.Scheduler == desired.Scheduler &&
+		existing.Timeout == desired.Timeout &&
+		// A service that was created without a netmask (zero) may have the netmask defaulted by the kernel
+		(desired.Netmask == ipvs.IPMask{} || existing.Netmask == desired.Netmask) &&
+		existing.Flags&^ipvs.ServiceHashed == desired.Flags&^ipvs.ServiceHashed
 }
 
+// String returns a description of the load balancer (such as "tcp 192.168.0.1:6443 (rr)"), it only uses
+// the configuration of the load balancer so it can be called at any time without reading IPVS
+func (lb *IPVSLoadBalancer) String() string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.describe()
+}
+
+// Describe returns the description of the load balancer in the same manner as String along with the
+// number of backends that are currently registered with IPVS
+func (lb *IPVSLoadBalancer) Describe() (string, error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	backends, err := lb.listBackends(false)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s with %d backends", lb.describe(), len(backends)), nil
+}
+
+// describe returns the description of the load balancer, the caller must hold the lock
+func (lb *IPVSLoadBalancer) describe() string {
+	svc := lb.loadBalancerService
+	if svc.FWMark != 0 {
+		return fmt.Sprintf("fwmark %d (%s)", svc.FWMark, lb.scheduler)
+	}
+
+	ports := make([]string, 0, len(lb.portServices)+1)
+	for _, s := range lb.services() {
+		ports = append(ports, strconv.Itoa(int(s.Port)))
+	}
+	address := net.JoinHostPort(svc.Address.Net(svc.Family).String(), strings.Join(ports, ","))
+	return fmt.Sprintf("%s %s (%s)", lb.protocolName(), address, lb.scheduler)
+}
+
+// Scheduler returns the IPVS scheduling algorithm used by the load balancer
+func (lb *IPVSLoadBalancer) Scheduler() Scheduler {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.scheduler
+}
+
+// UpdateScheduler will change the IPVS scheduling algorithm of every port of the load balancer, the
+// services are edited in place so the backends and their connections are preserved. If the kernel doesn't
+// support editing a service (EOPNOTSUPP) then the service is removed and re-created with its backends
+// instead, which drops the existing connections. An empty scheduler is round-robin (rr).
+func (lb *IPVSLoadBalancer) UpdateScheduler(scheduler Scheduler) error {
+	if scheduler == "" {
+		scheduler = SchedulerRR
+	}
+	if !schedulers[scheduler] {
+		return fmt.Errorf("unknown IPVS scheduler [%s]", scheduler)
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.schedulerFlags&(shPort|shFallback) != 0 && scheduler != SchedulerSH {
+		return fmt.Errorf("the sh-port and sh-fallback flags are only used by the source hashing (sh) scheduler, IPVS would silently ignore them with the [%s] scheduler", scheduler)
+	}
+	if scheduler == lb.scheduler {
+		return nil
+	}
+
+	for _, svc := range lb.services() {
+		updated := svc
+		updated.Scheduler = string(scheduler)
+		err := lb.retry(context.Background(), opUpdateService, func() error { return lb.client.UpdateService(updated) })
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			lb.serviceLog(svc, opUpdateService).Warn("IPVS service can't be edited in place, re-creating it to change the scheduler")
+			err = lb.recreateService(svc, updated)
+		}
+		recordOperation(opUpdateService, err)
+		if err != nil {
+			return newError(opUpdateService, svc, "", schedulerError(updated, err))
+		}
+		lb.setService(updated)
+		lb.serviceLog(updated, opUpdateService).WithField("scheduler", scheduler).Info("changed the IPVS scheduler")
+	}
+	lb.scheduler = scheduler
+	return nil
+}
+
+// recreateService will remove an IPVS service and create it with a new spec along with its backends,
+// the caller must hold the write lock
+func (lb *IPVSLoadBalancer) recreateService(svc, updated ipvs.Service) error {
+	dsts, err := lb.client.Destinations(svc)
+	if err != nil {
+		return fmt.Errorf("error listing backends: %w", err)
+	}
+	err = lb.retry(context.Background(), opRemoveService, func() error { return lb.client.RemoveService(svc) })
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	err = lb.retry(context.Background(), opCreateService, func() error { return lb.client.CreateService(updated) })
+	if err != nil {
+		return err
+	}
+	for x := range dsts {
+		dst := dsts[x].Destination
+		err = lb.retry(context.Background(), opAddBackend, func() error { return lb.client.CreateDestination(updated, dst) })
+		if err != nil && !isExists(err) {
+			return fmt.Errorf("error re-adding backend [%s]: %w", backendKey(dst.Address.Net(dst.Family).String(), int(dst.Port)), err)
+		}
+	}
+	return nil
+}
+
+// UpdateVIP will move the load balancer to a new VIP of the same address family, such as when the network
+// is re-addressed. The IPVS services of the new VIP are created (for every port) with the backends of the
+// load balancer before the services of the previous VIP are removed, so the VIP is never served without
+// backends. If any of the new services can't be created then those that were created are removed and the
+// load balancer is left on the previous VIP. Connections to the previous VIP can't be preserved, IPVS
+// tracks connections by the address of the service so they are dropped when its services are removed.
+func (lb *IPVSLoadBalancer) UpdateVIP(address string) error {
+	ip, family, err := parseAddress(address)
+	if err != nil {
+		return err
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	current := lb.loadBalancerService
+	if current.FWMark != 0 {
+		return fmt.Errorf("a firewall mark service has no VIP, the firewall mark rules must be changed instead")
+	}
+	if family != current.Family {
+		return fmt.Errorf("%w, the new VIP [%s] is %s but the load balancer is %s", ErrFamilyMismatch, ip, familyName(family), familyName(current.Family))
+	}
+	if current.Address.Net(current.Family).Equal(ip) {
+		return nil
+	}
+
+	logEntry := lb.serviceLog(current, opUpdateService).WithField("vip", ip.String())
+	var created []ipvs.Service
+	for _, svc := range lb.services() {
+		updated := svc
+		updated.Address = ipvs.NewIP(ip)
+		err = lb.moveService(svc, updated)
+		if err != nil {
+			recordOperation(opUpdateService, err)
+			for x := range created {
+				svc := created[x]
+				if rerr := lb.retry(context.Background(), opRemoveService, func() error { return lb.client.RemoveService(svc) }); rerr != nil && !isNotFound(rerr) {
+					lb.serviceLog(svc, opRemoveService).Errorf("unable to roll back the IPVS service of the new VIP [%v]", rerr)
+				}
+			}
+			return newError(opUpdateService, updated, "", err)
+		}
+		created = append(created, updated)
+	}
+
+	var errs []error
+	for _, svc := range lb.services() {
+		svc := svc
+		err = lb.retry(context.Background(), opRemoveService, func() error { return lb.client.RemoveService(svc) })
+		if err != nil && !isNotFound(err) {
+			errs = append(errs, newError(opRemoveService, svc, "", err))
+		}
+	}
+	for x := range created {
+		lb.setService(created[x])
+	}
+	recordOperation(opUpdateService, nil)
+	if len(errs) != 0 {
+		logEntry.Warn("moved the load balancer to the new VIP, but the IPVS services of the previous VIP couldn't be removed")
+		return fmt.Errorf("the load balancer has moved to the new VIP [%s] but the previous VIP couldn't be removed: %w", ip, utilerrors.NewAggregate(errs))
+	}
+	logEntry.Info("moved the load balancer to the new VIP")
+	return nil
+}
+
+// moveService will create the IPVS service of a new VIP with the backends of the existing service, a
+// service that already exists for the new VIP isn't adopted. The service is removed again if any of its
+// backends can't be added. The caller must hold the write lock.
+func (lb *IPVSLoadBalancer) moveService(svc, updated ipvs.Service) error {
+	dsts, err := lb.client.Destinations(svc)
+	if err != nil {
+		return fmt.Errorf("error listing backends: %w", err)
+	}
+	err = lb.retry(context.Background(), opCreateService, func() error { return lb.client.CreateService(updated) })
+	if err != nil {
+		return err
+	}
+	for x := range dsts {
+		dst := dsts[x].Destination
+		err = lb.retry(context.Background(), opAddBackend, func() error { return lb.client.CreateDestination(updated, dst) })
+		if err != nil && !isExists(err) {
+			_ = lb.retry(context.Background(), opRemoveService, func() error { return lb.client.RemoveService(updated) })
+			return fmt.Errorf("error adding backend [%s]: %w", backendKey(dst.Address.Net(dst.Family).String(), int(dst.Port)), err)
+		}
+	}
+	return nil
+}
+
+// setService replaces the IPVS service of one of the ports of the load balancer, the caller must hold
+// the write lock
+func (lb *IPVSLoadBalancer) setService(svc ipvs.Service) {
+	if int(svc.Port) == lb.Port {
+		lb.loadBalancerService = svc
+		return
+	}
+	lb.portServices[int(svc.Port)] = svc
+}
+
+// Protocol returns the protocol (tcp, udp or sctp) used by the load balancer, a firewall mark service
+// matches every protocol and returns an empty string
+func (lb *IPVSLoadBalancer) Protocol() string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.protocolName()
+}
+
+// protocolName returns the protocol of the load balancer in the same manner as Protocol, the caller must
+// hold the lock
+func (lb *IPVSLoadBalancer) protocolName() string {
+	if lb.loadBalancerService.FWMark != 0 {
+		return ""
+	}
+	return strings.ToLower(lb.loadBalancerService.Protocol.String())
+}
+
+// Address returns the VIP of the load balancer, its port is the Port of the load balancer. The address
+// is a copy so it can be modified by the caller, nil is returned for a firewall mark service as it matches
+// packets by their mark rather than a VIP.
+func (lb *IPVSLoadBalancer) Address() net.IP {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.address()
+}
+
+// address returns a copy of the VIP of the load balancer (nil for a firewall mark service), the caller must
+// hold the lock
+func (lb *IPVSLoadBalancer) address() net.IP {
+	if lb.loadBalancerService.FWMark != 0 {
+		return nil
+	}
+	ip := lb.loadBalancerService.Address.Net(lb.loadBalancerService.Family)
+	return append(net.IP(nil), ip...)
+}
+
+// ServiceSpec is the configuration of the IPVS service of a load balancer, as returned by ServiceSpec
+type ServiceSpec struct {
+	// Address and Port identify the service, or FWMark for a firewall mark service
+	Address string
+	Port    int
+	FWMark  uint32
+	// Protocol is tcp, udp or sctp, it is empty for a firewall mark service
+	Protocol  string
+	Family    ipvs.AddressFamily
+	Scheduler Scheduler
+	Flags     ipvs.Flags
+	// PersistenceTimeout is set when the service is persistent
+	PersistenceTimeout time.Duration
+	// PersistenceNetmask is the prefix length that persistence groups clients by, it is set when the service
+	// is persistent (the whole address unless it was created WithPersistenceNetmask)
+	PersistenceNetmask int
+	// Timeouts are the IPVS connection timeouts that were set when the load balancer was created
+	Timeouts Timeouts
+}
+
+// ServiceSpec returns a copy of the spec of the IPVS service that the load balancer created (or adopted)
+// for its primary port, it only uses the configuration of the load balancer and doesn't read IPVS
+func (lb *IPVSLoadBalancer) ServiceSpec() ServiceSpec {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.serviceSpec()
+}
+
+// serviceSpec returns the spec of the primary IPVS service, the caller must hold the lock
+func (lb *IPVSLoadBalancer) serviceSpec() ServiceSpec {
+	svc := lb.loadBalancerService
+	spec := ServiceSpec{
+		Port:      int(svc.Port),
+		FWMark:    svc.FWMark,
+		Protocol:  lb.protocolName(),
+		Family:    svc.Family,
+		Scheduler: lb.scheduler,
+		Flags:     svc.Flags,
+		Timeouts:  lb.timeouts,
+	}
+	if svc.FWMark == 0 {
+		spec.Address = svc.Address.Net(svc.Family).String()
+	}
+	if svc.Flags&ipvs.ServicePersistent != 0 {
+		spec.PersistenceTimeout = time.Duration(svc.Timeout) * time.Second
+		spec.PersistenceNetmask = netmaskPrefixLength(svc.Netmask, svc.Family)
+	}
+	return spec
+}
+
+// ForwardMethod returns the default forwarding method used for new backends
+func (lb *IPVSLoadBalancer) ForwardMethod() ipvs.ForwardType {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.forwardMethod
+}
+
+// SourceAddress returns the local address that traffic to the backends should be sent from (see
+// WithSourceAddress), or nil if the kernel chooses it
+func (lb *IPVSLoadBalancer) SourceAddress() net.IP {
+	if lb.sourceAddress == nil {
+		return nil
+	}
+	return append(net.IP(nil), lb.sourceAddress...)
+}
+
+// validateSourceAddress returns an error if the source address isn't of the address family of the VIP or
+// isn't assigned to an interface within the network namespace of the load balancer
+func (lb *IPVSLoadBalancer) validateSourceAddress(family ipvs.AddressFamily) error {
+	_, sourceFamily, _ := parseAddress(lb.sourceAddress.String())
+	if sourceFamily != family {
+		return fmt.Errorf("%w, the source address [%s] is %s but the load balancer is %s", ErrFamilyMismatch, lb.sourceAddress, familyName(sourceFamily), familyName(family))
+	}
+	var addrs []net.Addr
+	err := inNetNS(lb.netns, func() (err error) {
+		addrs, err = net.InterfaceAddrs()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list the local addresses to validate the source address: %w", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(lb.sourceAddress) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the source address [%s] isn't assigned to a local interface", lb.sourceAddress)
+}
+
+// SetForwardMethod will change the default forwarding method used for new backends, the default is
+// ipvs.Local which is used with the kube-vip TCP forwarder described above
+func (lb *IPVSLoadBalancer) SetForwardMethod(fwd ipvs.ForwardType) error {
+	if !forwardMethods[fwd] {
+		return fmt.Errorf("unsupported forwarding method [%s]", fwd)
+	}
+	lb.mu.Lock()
+	lb.forwardMethod = fwd
+	lb.mu.Unlock()
+	return nil
+}
+
+// Close will stop the health checker and the connection sync daemon, remove the IPVS services and close
+// the IPVS client (if it is owned by the load balancer). It is safe to call Close multiple times, callers
+// should defer lb.Close() once the load balancer has been created.
+func (lb *IPVSLoadBalancer) Close() error {
+	lb.StopHealthCheck()
+
+	lb.mu.Lock()
+	closed := lb.closed
+	if !closed {
+		lb.closed = true
+		close(lb.done)
+	}
+	lb.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	var errs []error
+	if err := lb.StopConnectionSync(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := lb.RemoveIPVSLB(); err != nil {
+		errs = append(errs, err)
+	}
+	if lb.ownsClient {
+		if err := closeClient(lb.client); err != nil {
+			errs = append(errs, fmt.Errorf("error closing IPVS client: %w", err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// closeClient will close the netlink socket of an IPVS client, the ipvs.Client interface doesn't
+// include Close although the implementation provides it
+func closeClient(c Client) error {
+	if closer, ok := c.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// RemoveIPVSLB will remove the IPVS service for every port of the load balancer, services that have
+// already been removed are ignored
+func (lb *IPVSLoadBalancer) RemoveIPVSLB() error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.registered {
+		lb.deregister()
+	}
+
+	var errs []error
+	for _, svc := range lb.services() {
+		svc := svc
+		err := lb.retry(context.Background(), opRemoveService, func() error { return lb.client.RemoveService(svc) })
+		if err != nil && !isNotFound(err) {
+			errs = append(errs, newError(opRemoveService, svc, "", err))
+			recordOperation(opRemoveService, err)
+			continue
+		}
+		recordOperation(opRemoveService, nil)
+		backendsGauge.Delete(lb.serviceLabels(int(svc.Port)))
+		lb.serviceLog(svc, opRemoveService).Info("removed IPVS service")
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// AddBackend will add a backend with the default weight of the load balancer
 func (lb *IPVSLoadBalancer) AddBackend(address string, port int) error {
+	return lb.AddBackendContext(context.Background(), address, port)
+}
+
+// AddBackendDefault will add a backend on the backend port of the load balancer (see WithBackendPort) with
+// the default weight
+func (lb *IPVSLoadBalancer) AddBackendDefault(address string) error {
+	if lb.backendPort == 0 {
+		return fmt.Errorf("the load balancer has no backend port, it must be created WithBackendPort")
+	}
+	return lb.AddBackend(address, lb.backendPort)
+}
+
+// AddBackendContext will add a backend with the default weight of the load balancer (or the weight from the
+// weight function, see WithWeightFunc), returning the context error if the context is done before the
+// backend has been added
+func (lb *IPVSLoadBalancer) AddBackendContext(ctx context.Context, address string, port int) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+	weight := lb.weightOf(Backend{Address: address, Port: port, Weight: lb.defaultWeight, FwdMethod: lb.forwardMethod})
+	return lb.addBackend(ctx, address, port, weight, lb.forwardMethod)
+}
+
+// AddBackendWithWeight will add a backend with a relative weight, which is used by the weighted
+// schedulers (wrr, wlc) to send more connections to backends with a higher weight. A weight of 0
+// registers the backend as a standby, it receives no connections until it is promoted by changing its
+// weight with UpdateBackendWeight.
+func (lb *IPVSLoadBalancer) AddBackendWithWeight(address string, port, weight int) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+	return lb.addBackend(context.Background(), address, port, weight, lb.forwardMethod)
+}
+
+// AddBackendWithForwardMethod will add a backend with a weight and a specific forwarding method
+// (Masquarade, Local, Tunnel or DirectRoute) instead of the load balancer default
+func (lb *IPVSLoadBalancer) AddBackendWithForwardMethod(address string, port, weight int, fwd ipvs.ForwardType) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+	return lb.addBackend(context.Background(), address, port, weight, fwd)
+}
+
+// AddBackendWithThresholds will add a backend with a weight and connection thresholds (see
+// SetBackendThresholds), the thresholds are set as the backend is created so that a cold-starting backend
+// is never flooded with connections before they apply
+func (lb *IPVSLoadBalancer) AddBackendWithThresholds(address string, port, weight, upper, lower int) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+	return lb.addBackendWithThresholds(context.Background(), address, port, weight, lb.forwardMethod, upper, lower)
+}
+
+// addBackend creates the IPVS destination without connection thresholds, the caller must hold the write lock
+func (lb *IPVSLoadBalancer) addBackend(ctx context.Context, address string, port, weight int, fwd ipvs.ForwardType) error {
+	return lb.addBackendWithThresholds(ctx, address, port, weight, fwd, 0, 0)
+}
+
+// addBackendWithThresholds creates the IPVS destination with its connection thresholds, the caller must
+// hold the write lock
+func (lb *IPVSLoadBalancer) addBackendWithThresholds(ctx context.Context, address string, port, weight int, fwd ipvs.ForwardType, upper, lower int) (err error) {
+	defer func() {
+		recordOperation(opAddBackend, err)
+		err = newError(opAddBackend, lb.loadBalancerService, backendKey(address, port), err)
+	}()
+
+	if err = validateWeight(weight, 0); err != nil {
+		return err
+	}
+	if err = validateThresholds(upper, lower); err != nil {
+		return err
+	}
+	if !forwardMethods[fwd] {
+		return fmt.Errorf("unsupported forwarding method [%s]", fwd)
+	}
+
+	resolved, err := lb.resolveBackend(ctx, address, false)
+	if err != nil {
+		return err
+	}
+	ip, family, err := parseAddress(resolved)
+	if err != nil {
+		return err
+	}
+	if err = validatePort(port); err != nil {
+		return err
+	}
+	if lb.backendPort != 0 && port != lb.backendPort {
+		return fmt.Errorf("backend port [%d] conflicts with the backend port [%d] of the load balancer", port, lb.backendPort)
+	}
+	// IPVS only supports a backend of a different address family when the traffic is tunnelled to it
+	if family != lb.loadBalancerService.Family && fwd != ipvs.Tunnel {
+		return lb.familyMismatch(ip, family)
+	}
+	if lb.topologyValidation {
+		if err = lb.validateTopology(ip, fwd); err != nil {
+			return err
+		}
+	}
+
 	dst := ipvs.Destination{
-		Address:   ipvs.NewIP(net.ParseIP(address)),
-		Port:      uint16(port),
-		Family:    ipvs.INET,
-		Weight:    1,
-		FwdMethod: ipvs.Local,
+		Address:        ipvs.NewIP(ip),
+		Port:           uint16(port),
+		Family:         family,
+		Weight:         uint32(weight),
+		FwdMethod:      fwd,
+		UpperThreshold: uint32(upper),
+		LowerThreshold: uint32(lower),
 	}
 
-	err := lb.client.CreateDestination(lb.loadBalancerService, dst)
-	// Swallow error of existing back end, the node watcher may attempt to apply
-	// the same back end multiple times
-	if err != nil && !strings.Contains(err.Error(), "file exists") {
-		return fmt.Errorf("error creating backend: %v", err)
+	for _, svc := range lb.services() {
+		svc := svc
+		err = lb.retry(ctx, opAddBackend, func() error {
+			return lb.client.CreateDestination(svc, dst)
+		})
+		// Swallow error of existing back end, the node watcher may attempt to apply
+		// the same back end multiple times
+		if err != nil && (lb.strict || !isExists(err)) {
+			return err
+		}
 	}
+	lb.setDesired(Backend{Address: ip.String(), Port: port, Weight: weight, FwdMethod: fwd, UpperThreshold: upper, LowerThreshold: lower})
+	lb.logEntry(opAddBackend).WithFields(Fields{"backend": backendKey(ip.String(), port), "weight": weight}).Debug("added backend")
 	return nil
 }
 
+// RemoveBackend will remove a backend from every port of the load balancer, removing a backend that
+// isn't registered succeeds so that removal is idempotent (in the same manner as adding an existing
+// backend) whilst any other error is returned
 func (lb *IPVSLoadBalancer) RemoveBackend(address string, port int) error {
+	return lb.RemoveBackendContext(context.Background(), address, port)
+}
+
+// RemoveBackendContext will remove a backend, returning the context error if the context is done
+// before the backend has been removed
+func (lb *IPVSLoadBalancer) RemoveBackendContext(ctx context.Context, address string, port int) error {
+	if lb.removeGracePeriod > 0 {
+		if err := lb.quiesceBeforeRemoval(ctx, address, port); err != nil {
+			return err
+		}
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+	return lb.removeBackend(ctx, address, port)
+}
+
+// quiesceBeforeRemoval quiesces a backend and waits for the grace period before it is removed (see
+// WithRemoveGracePeriod), a backend that isn't registered is left to removeBackend to report. The context
+// error is returned if the context is done within the grace period, leaving the backend quiesced.
+func (lb *IPVSLoadBalancer) quiesceBeforeRemoval(ctx context.Context, address string, port int) error {
+	lb.mu.Lock()
+	backend, err := lb.quiesceBackend(address, port)
+	if err == nil {
+		lb.notifyWatchers()
+	}
+	lb.mu.Unlock()
+	if errors.Is(err, ErrBackendNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lb.logEntry(opRemoveBackend).WithFields(Fields{"backend": backendKey(backend.Address, backend.Port), "grace": lb.removeGracePeriod}).
+		Debug("quiesced backend before removal")
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(lb.removeGracePeriod):
+	}
+	return nil
+}
+
+// removeBackend removes the IPVS destination, the caller must hold the write lock
+func (lb *IPVSLoadBalancer) removeBackend(ctx context.Context, address string, port int) (err error) {
+	defer func() {
+		recordOperation(opRemoveBackend, err)
+		err = newError(opRemoveBackend, lb.loadBalancerService, backendKey(address, port), err)
+	}()
+
+	resolved, err := lb.resolveBackend(ctx, address, true)
+	if err != nil {
+		return err
+	}
+	ip, family, err := parseAddress(resolved)
+	if err != nil {
+		return err
+	}
+	if err = validatePort(port); err != nil {
+		return err
+	}
+	// Only a tunnelled backend can be of a different address family, so it must already be registered
+	if _, ok := lb.desired[backendKey(ip.String(), port)]; !ok && family != lb.loadBalancerService.Family {
+		return lb.familyMismatch(ip, family)
+	}
+
+	// Destinations are identified by their address and port, the weight and forwarding method
+	// aren't needed to remove them
 	dst := ipvs.Destination{
-		Address: ipvs.NewIP(net.ParseIP(address)),
+		Address: ipvs.NewIP(ip),
 		Port:    uint16(port),
-		Family:  ipvs.INET,
-		Weight:  1,
+		Family:  family,
 	}
-	err := lb.client.RemoveDestination(lb.loadBalancerService, dst)
-	if err != nil {
-		return fmt.Errorf("error removing backend: %v", err)
+	for _, svc := range lb.services() {
+		svc := svc
+		err = lb.retry(ctx, opRemoveBackend, func() error {
+			return lb.client.RemoveDestination(svc, dst)
+		})
+		// A destination that doesn't exist (ENOENT) has already been removed, so removal is idempotent
+		if err != nil && !errors.Is(err, syscall.ENOENT) {
+			return err
+		}
+	}
+	err = nil
+	delete(lb.sctpAddresses, backendKey(ip.String(), port))
+	delete(lb.health, backendKey(ip.String(), port))
+	delete(lb.desired, backendKey(ip.String(), port))
+	lb.logEntry(opRemoveBackend).WithField("backend", backendKey(ip.String(), port)).Debug("removed backend")
+	return nil
+}
+
+// familyMismatch returns an ErrFamilyMismatch for a backend of a different address family to the VIP
+func (lb *IPVSLoadBalancer) familyMismatch(ip net.IP, family ipvs.AddressFamily) error {
+	svc := lb.loadBalancerService
+	vip := svc.Address.Net(svc.Family).String()
+	if svc.FWMark != 0 {
+		vip = fmt.Sprintf("fwmark %d", svc.FWMark)
+	}
+	return fmt.Errorf("%w, backend [%s] is %s but the VIP [%s] is %s, only the Tunnel forwarding method supports mixing address families",
+		ErrFamilyMismatch, ip, familyName(family), vip, familyName(svc.Family))
+}
+
+// familyName returns the name of an address family
+func familyName(family ipvs.AddressFamily) string {
+	if family == ipvs.INET6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// parseAddress will parse an IPv4 or IPv6 address and return it along with the matching IPVS address family,
+// equivalent representations of an address (such as 10.0.0.1, ::ffff:10.0.0.1 and 010.0.0.1) all return the
+// same IPv4 address so that they identify the same backend
+func parseAddress(address string) (net.IP, ipvs.AddressFamily, error) {
+	ip := net.ParseIP(normalizeAddress(address))
+	if ip == nil {
+		return nil, 0, fmt.Errorf("unable to parse IP address [%s]", address)
+	}
+	if ip.To4() == nil {
+		return ip, ipvs.INET6, nil
+	}
+	return ip.To4(), ipvs.INET, nil
+}
+
+// normalizeAddress removes the formatting that net.ParseIP doesn't accept from an address, surrounding
+// whitespace and brackets are removed and the leading zeros of each IPv4 octet are removed (they are
+// treated as decimal rather than octal)
+func normalizeAddress(address string) string {
+	address = strings.TrimSpace(address)
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+
+	octets := strings.Split(address, ".")
+	if len(octets) != 4 {
+		return address
+	}
+	for x := range octets {
+		octet, err := strconv.Atoi(octets[x])
+		if err != nil || strings.HasPrefix(octets[x], "+") || strings.HasPrefix(octets[x], "-") {
+			return address
+		}
+		octets[x] = strconv.Itoa(octet)
+	}
+	return strings.Join(octets, ".")
+}
+
+// validateWeight ensures that a weight is within the range of min to MaxWeight, so that it can't be
+// truncated when it is passed to IPVS
+func validateWeight(weight, min int) error {
+	if weight < min || weight > MaxWeight {
+		return fmt.Errorf("invalid backend weight [%d], must be between %d and %d", weight, min, MaxWeight)
 	}
 	return nil
 }
+
+// validatePort ensures that a port is within the valid range of 1-65535
+func validatePort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port [%d], must be between 1 and 65535", port)
+	}
+	return nil
+}
+
+// inNetNS will run fn within the network namespace at the path, or the current namespace if the path is empty
+func inNetNS(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+	return runInNetNS(path, fn)
+}
+
+// runWithContext will run fn and wait for it to complete or for the context to be done, the IPVS client
+// has no support for contexts so on cancellation fn is left to complete in the background
+func runWithContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- fn()
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// logEntry returns a log entry with the structured fields that identify the load balancer and the operation
+func (lb *IPVSLoadBalancer) logEntry(operation string) Logger {
+	return lb.serviceLog(lb.loadBalancerService, operation)
+}
+
+// serviceLog returns a log entry of the load balancer for an IPVS service and the operation
+func (lb *IPVSLoadBalancer) serviceLog(svc ipvs.Service, operation string) Logger {
+	return serviceLog(lb.logger, svc, operation)
+}
+
+// serviceLog returns a log entry with the structured fields that identify an IPVS service and the operation
+func serviceLog(logger Logger, svc ipvs.Service, operation string) Logger {
+	if svc.FWMark != 0 {
+		return logger.WithFields(Fields{
+			"fwmark":    svc.FWMark,
+			"operation": operation,
+		})
+	}
+	return logger.WithFields(Fields{
+		"vip":       svc.Address.Net(svc.Family).String(),
+		"port":      svc.Port,
+		"protocol":  strings.ToLower(svc.Protocol.String()),
+		"operation": operation,
+	})
+}
+
+// persistenceNetmask returns the IPVS netmask of a persistence prefix length, IPVS expects the mask of an
+// IPv4 service but the prefix length of an IPv6 service
+func persistenceNetmask(prefixLength int, family ipvs.AddressFamily) (ipvs.IPMask, error) {
+	var netmask ipvs.IPMask
+	if family == ipvs.INET6 {
+		nlenc.PutUint32(netmask[:], uint32(prefixLength))
+		return netmask, nil
+	}
+	if prefixLength > 32 {
+		return netmask, fmt.Errorf("%w, the persistence netmask [/%d] is longer than an IPv4 address", ErrFamilyMismatch, prefixLength)
+	}
+	copy(netmask[:], net.CIDRMask(prefixLength, 32))
+	return netmask, nil
+}
+
+// netmaskPrefixLength returns the prefix length of an IPVS netmask, a netmask that isn't set is the whole address
+func netmaskPrefixLength(netmask ipvs.IPMask, family ipvs.AddressFamily) int {
+	if family == ipvs.INET6 {
+		if length := int(nlenc.Uint32(netmask[:])); length != 0 {
+			return length
+		}
+		return 128
+	}
+	if netmask == (ipvs.IPMask{}) {
+		return 32
+	}
+	ones, _ := net.IPMask(netmask[:]).Size()
+	return ones
+}
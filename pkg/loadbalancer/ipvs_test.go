@@ -0,0 +1,1586 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/ipvs"
+)
+
+func newTestLB(t *testing.T, c Client) *IPVSLoadBalancer {
+	t.Helper()
+	lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443)
+	if err != nil {
+		t.Fatalf("unable to create load balancer: %v", err)
+	}
+	return lb
+}
+
+func TestAddRemoveBackend(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	if lb.Scheduler() != SchedulerRR {
+		t.Errorf("Scheduler() = %s, expected the default %s", lb.Scheduler(), SchedulerRR)
+	}
+
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	// Adding the same backend again is swallowed
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() of an existing backend error = %v", err)
+	}
+	backends, err := lb.ListBackends()
+	if err != nil {
+		t.Fatalf("ListBackends() error = %v", err)
+	}
+	if len(backends) != 1 || backends[0].Address != "10.0.0.1" || backends[0].Port != 6443 {
+		t.Fatalf("ListBackends() = %+v, expected a single backend 10.0.0.1:6443", backends)
+	}
+
+	if err := lb.RemoveBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	backends, err = lb.ListBackends()
+	if err != nil {
+		t.Fatalf("ListBackends() error = %v", err)
+	}
+	if len(backends) != 0 {
+		t.Fatalf("ListBackends() = %+v, expected no backends", backends)
+	}
+	// Removing the backend again succeeds
+	if err := lb.RemoveBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("RemoveBackend() of a removed backend error = %v, expected nil", err)
+	}
+}
+
+func TestConcurrentBackends(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+
+	var wg sync.WaitGroup
+	for x := 0; x < 50; x++ {
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			address := fmt.Sprintf("10.0.0.%d", x%10)
+			if err := lb.AddBackend(address, 6443); err != nil {
+				t.Errorf("AddBackend() error = %v", err)
+			}
+			if _, err := lb.ListBackends(); err != nil {
+				t.Errorf("ListBackends() error = %v", err)
+			}
+			// Another goroutine may have already removed this backend
+			_ = lb.RemoveBackend(address, 6443)
+			if _, err := lb.SyncBackends([]Backend{{Address: address, Port: 6443, Weight: 1}}); err != nil {
+				t.Errorf("SyncBackends() error = %v", err)
+			}
+		}(x)
+	}
+	wg.Wait()
+
+	backends, err := lb.ListBackends()
+	if err != nil {
+		t.Fatalf("ListBackends() error = %v", err)
+	}
+	if len(backends) > 10 {
+		t.Errorf("ListBackends() returned %d backends, expected at most 10", len(backends))
+	}
+}
+
+func TestRemoveIPVSLBTwice(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+
+	if err := lb.RemoveIPVSLB(); err != nil {
+		t.Fatalf("RemoveIPVSLB() error = %v", err)
+	}
+	if err := lb.RemoveIPVSLB(); err != nil {
+		t.Errorf("RemoveIPVSLB() on a removed service error = %v, expected nil", err)
+	}
+}
+
+// signallingClient is a fake client that signals when it is closed
+type signallingClient struct {
+	*fakeClient
+	closed chan struct{}
+}
+
+func (c *signallingClient) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestNewIPVSLBContextCancelled(t *testing.T) {
+	c := &signallingClient{fakeClient: newFakeClient(), closed: make(chan struct{})}
+	release := make(chan struct{})
+	defer func(f func() (Client, error)) { newOwnedClient = f }(newOwnedClient)
+	newOwnedClient = func() (Client, error) {
+		<-release
+		return c, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := NewIPVSLBContext(ctx, "192.168.0.1", 6443); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("NewIPVSLBContext() error = %v, expected context.DeadlineExceeded", err)
+	}
+
+	// The client created after the caller gave up is closed rather than leaked
+	close(release)
+	select {
+	case <-c.closed:
+	case <-time.After(time.Second):
+		t.Errorf("the abandoned IPVS client wasn't closed")
+	}
+}
+
+func TestHealthCheckQuiesce(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	if err := lb.AddBackendWithWeight("10.0.0.1", 6443, 5); err != nil {
+		t.Fatalf("AddBackendWithWeight() error = %v", err)
+	}
+	lb.health = map[string]*backendHealth{}
+
+	backend := Backend{Address: "10.0.0.1", Port: 6443, Weight: 5, FwdMethod: ipvs.Local}
+	failed := fmt.Errorf("connection refused")
+
+	lb.applyHealth(backend, failed, QuiescePolicy{FailureThreshold: 2}, 0)
+	backends, _ := lb.ListBackends()
+	if backends[0].Weight != 5 || !backends[0].Healthy {
+		t.Fatalf("backend quiesced before reaching the failure threshold: %+v", backends[0])
+	}
+
+	lb.applyHealth(backend, failed, QuiescePolicy{FailureThreshold: 2}, 0)
+	backends, _ = lb.ListBackends()
+	if backends[0].Weight != 0 || backends[0].Healthy {
+		t.Fatalf("backend not quiesced after reaching the failure threshold: %+v", backends[0])
+	}
+
+	lb.applyHealth(backends[0], nil, QuiescePolicy{FailureThreshold: 2}, 0)
+	backends, _ = lb.ListBackends()
+	if backends[0].Weight != 5 || !backends[0].Healthy {
+		t.Fatalf("backend weight not restored after recovering: %+v", backends[0])
+	}
+}
+
+func TestHealthCheckRemoveQuiesced(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	if err := lb.AddBackendWithWeight("10.0.0.1", 6443, 5); err != nil {
+		t.Fatalf("AddBackendWithWeight() error = %v", err)
+	}
+	lb.health = map[string]*backendHealth{}
+	backends, _ := lb.ListBackends()
+	lb.applyHealth(backends[0], fmt.Errorf("connection refused"), QuiescePolicy{FailureThreshold: 1}, 0)
+
+	// A quiesced backend that is removed and re-added starts out healthy with its new weight
+	if err := lb.RemoveBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	if err := lb.AddBackendWithWeight("10.0.0.1", 6443, 3); err != nil {
+		t.Fatalf("AddBackendWithWeight() error = %v", err)
+	}
+	if backends, _ = lb.ListBackends(); backends[0].Weight != 3 || !backends[0].Healthy {
+		t.Fatalf("re-added backend = %+v, expected it to be healthy with a weight of 3", backends[0])
+	}
+
+	if err := lb.UpdateBackendWeight("10.0.0.1", 6443, 7); err != nil {
+		t.Fatalf("UpdateBackendWeight() error = %v", err)
+	}
+	key := fakeDestinationKey(ipvs.Destination{Address: ipvs.NewIP(net.ParseIP("10.0.0.1").To4()), Port: 6443, Family: ipvs.INET})
+	c.mu.Lock()
+	weight := c.services[fakeServiceKey(lb.loadBalancerService)].dsts[key].Weight
+	c.mu.Unlock()
+	if weight != 7 {
+		t.Errorf("kernel weight = %d, expected the updated weight of 7", weight)
+	}
+}
+
+func TestHealthCheckDecay(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	if err := lb.AddBackendWithWeight("10.0.0.1", 6443, 8); err != nil {
+		t.Fatalf("AddBackendWithWeight() error = %v", err)
+	}
+	lb.health = map[string]*backendHealth{}
+
+	failed := fmt.Errorf("connection refused")
+	steps := []struct {
+		result  error
+		weight  int
+		healthy bool
+	}{
+		{failed, 4, false},
+		{failed, 2, false},
+		{nil, 8, true},
+		{failed, 4, false},
+		{failed, 2, false},
+		{failed, 1, false},
+		{failed, 0, false},
+		{failed, 0, false},
+		{nil, 8, true},
+		{nil, 8, true},
+	}
+	for x, step := range steps {
+		backends, _ := lb.ListBackends()
+		lb.applyHealth(backends[0], step.result, DecayPolicy{}, 0)
+		backends, _ = lb.ListBackends()
+		if backends[0].Weight != step.weight || backends[0].Healthy != step.healthy {
+			t.Fatalf("step %d: backend weight = %d (healthy %v), expected %d (healthy %v)", x, backends[0].Weight, backends[0].Healthy, step.weight, step.healthy)
+		}
+	}
+}
+
+func TestHealthCheckProber(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	for _, address := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if err := lb.AddBackend(address, 6443); err != nil {
+			t.Fatalf("AddBackend() error = %v", err)
+		}
+	}
+	lb.health = map[string]*backendHealth{}
+
+	// 10.0.0.2 fails its probe and 10.0.0.3 can't be probed so it is left unchanged
+	config := HealthCheckConfig{
+		Timeout: time.Second,
+		Policy:  QuiescePolicy{FailureThreshold: 1},
+		Prober: ProbeFunc(func(ctx context.Context, address string, port int) error {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Errorf("the probe context has no deadline")
+			}
+			switch address {
+			case "10.0.0.2":
+				return fmt.Errorf("no response")
+			case "10.0.0.3":
+				return ErrProbeUnsupported
+			}
+			return nil
+		}),
+	}
+	lb.runHealthCheck(config)
+	lb.runHealthCheck(config)
+
+	healthy := map[string]bool{}
+	backends, _ := lb.ListBackends()
+	for x := range backends {
+		healthy[backends[x].Address] = backends[x].Healthy && backends[x].Weight == DefaultWeight
+	}
+	if !healthy["10.0.0.1"] || healthy["10.0.0.2"] || !healthy["10.0.0.3"] {
+		t.Errorf("backends healthy = %v, expected only 10.0.0.2 to be quiesced", healthy)
+	}
+	if _, ok := lb.health["10.0.0.3:6443"]; ok {
+		t.Errorf("the unsupported probe should leave the health of the backend untouched")
+	}
+
+	fwmark, err := NewIPVSLBFwmarkWithClient(newFakeClient(), 1, ipvs.INET)
+	if err != nil {
+		t.Fatalf("NewIPVSLBFwmarkWithClient() error = %v", err)
+	}
+	if err = fwmark.StartHealthCheck(HealthCheckConfig{Interval: time.Second, Timeout: time.Second, FailureThreshold: 1}); err == nil {
+		t.Errorf("StartHealthCheck() of a firewall mark service without a Prober should return an error")
+	}
+}
+
+// fakeClock is a clock that only moves when it is advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+	stopped  bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{c: make(chan time.Time, 1), interval: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return &fakeClockTicker{clock: c, ticker: t}
+}
+
+// advance moves the clock forward and delivers a tick to every ticker that is due
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		if t.stopped || c.now.Before(t.next) {
+			continue
+		}
+		t.next = c.now.Add(t.interval)
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+}
+
+// interval returns the interval of the running ticker, or 0 if every ticker has been stopped
+func (c *fakeClock) interval() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range c.tickers {
+		if !t.stopped {
+			return t.interval
+		}
+	}
+	return 0
+}
+
+type fakeClockTicker struct {
+	clock  *fakeClock
+	ticker *fakeTicker
+}
+
+func (t *fakeClockTicker) C() <-chan time.Time { return t.ticker.c }
+
+func (t *fakeClockTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.ticker.stopped = true
+}
+
+// waitFor waits for the condition to be met by a background goroutine
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHealthCheckLoop(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	clock := newFakeClock()
+	lb.clock = clock
+	for _, address := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := lb.AddBackendWithWeight(address, 6443, 5); err != nil {
+			t.Fatalf("AddBackendWithWeight() error = %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	failing := map[string]bool{}
+	setFailing := func(addresses ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		failing = map[string]bool{}
+		for _, address := range addresses {
+			failing[address] = true
+		}
+	}
+	rounds := 0
+	config := HealthCheckConfig{
+		Interval:         time.Second,
+		Timeout:          time.Second,
+		FailureThreshold: 1,
+		GracePeriod:      3 * time.Second,
+		MaxBackoff:       4 * time.Second,
+		Prober: ProbeFunc(func(ctx context.Context, address string, port int) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if address == "10.0.0.1" {
+				rounds++
+			}
+			if failing[address] {
+				return fmt.Errorf("no response")
+			}
+			return nil
+		}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := lb.StartHealthCheckContext(ctx, config); err != nil {
+		t.Fatalf("StartHealthCheckContext() error = %v", err)
+	}
+	waitFor(t, "the health checker to start", func() bool { return clock.interval() == time.Second })
+	// tick advances the clock and waits for the round of probes to be applied
+	tick := func(d time.Duration, what string, cond func(weights map[string]int) bool) {
+		t.Helper()
+		clock.advance(d)
+		waitFor(t, what, func() bool {
+			weights := map[string]int{}
+			for _, backend := range mustListBackends(t, lb) {
+				weights[backend.Address] = backend.Weight
+			}
+			return cond(weights)
+		})
+	}
+	failures := func(address string) int {
+		lb.mu.RLock()
+		defer lb.mu.RUnlock()
+		if h, ok := lb.health[backendKey(address, 6443)]; ok {
+			return h.failures
+		}
+		return 0
+	}
+
+	// A failing backend isn't quiesced until it has been failing for the grace period
+	setFailing("10.0.0.2")
+	for x := 1; x <= 3; x++ {
+		x := x
+		tick(time.Second, "the failed probe", func(weights map[string]int) bool {
+			return failures("10.0.0.2") == x
+		})
+		if backend := backendsByKey(mustListBackends(t, lb))["10.0.0.2:6443"]; backend.Weight != 5 {
+			t.Fatalf("backend quiesced after %d failed probes within the grace period", x)
+		}
+	}
+	tick(time.Second, "the backend to be quiesced", func(weights map[string]int) bool {
+		return weights["10.0.0.2"] == 0
+	})
+
+	// Every backend failing is treated as a blip of the network, so the weights are left unchanged and the
+	// interval backs off up to the maximum
+	setFailing("10.0.0.1", "10.0.0.2")
+	for _, interval := range []time.Duration{2 * time.Second, 4 * time.Second} {
+		clock.advance(clock.interval())
+		waitFor(t, "the backoff", func() bool { return clock.interval() == interval })
+	}
+	mu.Lock()
+	before := rounds
+	mu.Unlock()
+	clock.advance(4 * time.Second)
+	waitFor(t, "the capped round", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return rounds > before
+	})
+	if backend := backendsByKey(mustListBackends(t, lb))["10.0.0.1:6443"]; backend.Weight != 5 {
+		t.Errorf("backend weight = %d during the outage, expected it to be left unchanged", backend.Weight)
+	}
+
+	// The interval is reset once a backend passes its probe, restoring the quiesced backend
+	setFailing()
+	tick(4*time.Second, "the backend to recover", func(weights map[string]int) bool {
+		return weights["10.0.0.2"] == 5
+	})
+	waitFor(t, "the interval to be reset", func() bool { return clock.interval() == time.Second })
+
+	// The health checker stops once its context is done, and can then be started again
+	cancel()
+	waitFor(t, "the health checker to stop", func() bool { return clock.interval() == 0 })
+	waitFor(t, "the health checker to be restartable", func() bool {
+		return lb.StartHealthCheck(config) == nil
+	})
+	lb.StopHealthCheck()
+
+	if err := lb.StartHealthCheck(HealthCheckConfig{Interval: 2 * time.Second, Timeout: time.Second, FailureThreshold: 1, MaxBackoff: time.Second}); err == nil {
+		t.Errorf("StartHealthCheck() with a maximum backoff below the interval should return an error")
+	}
+}
+
+func TestUDPProber(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// Only the ping is answered
+			if string(buf[:n]) == "ping" {
+				_, _ = conn.WriteTo([]byte("pong"), addr)
+			}
+		}
+	}()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	tests := []struct {
+		name    string
+		prober  UDPProber
+		wantErr bool
+	}{
+		{"empty datagram", UDPProber{}, false},
+		{"expected response", UDPProber{Request: []byte("ping"), Response: []byte("po")}, false},
+		{"unexpected response", UDPProber{Request: []byte("ping"), Response: []byte("ack")}, true},
+		{"no response", UDPProber{Request: []byte("hello")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			if err := tt.prober.Probe(ctx, "127.0.0.1", port); (err != nil) != tt.wantErr {
+				t.Errorf("Probe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+
+	if err := lb.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := lb.Close(); err != nil {
+		t.Errorf("Close() on a closed load balancer error = %v, expected nil", err)
+	}
+	if svcs, _ := c.Services(); len(svcs) != 0 {
+		t.Errorf("Close() left %d IPVS services, expected 0", len(svcs))
+	}
+}
+
+func TestValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		port    int
+		wantErr bool
+	}{
+		{"valid IPv4", "10.0.0.1", 6443, false},
+		{"valid IPv6", "fd00::1", 6443, false},
+		{"lowest port", "10.0.0.1", 1, false},
+		{"highest port", "10.0.0.1", 65535, false},
+		{"zero port", "10.0.0.1", 0, true},
+		{"negative port", "10.0.0.1", -1, true},
+		{"port too large", "10.0.0.1", 65536, true},
+		{"port wraps uint16", "10.0.0.1", 70000, true},
+		{"empty address", "", 6443, true},
+		{"malformed address", "10.0.0.256", 6443, true},
+		{"hostname", "node-1", 6443, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewIPVSLBWithClient(newFakeClient(), tt.address, tt.port)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewIPVSLBWithClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			lb := newTestLB(t, newFakeClient())
+			if strings.Contains(tt.address, ":") {
+				lb, _ = NewIPVSLBWithClient(newFakeClient(), "fd00::100", 6443)
+			}
+			if err := lb.AddBackend(tt.address, tt.port); (err != nil) != tt.wantErr {
+				t.Errorf("AddBackend() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := lb.RemoveBackend(tt.address, tt.port); (err != nil) != tt.wantErr {
+				t.Errorf("RemoveBackend() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAddress(t *testing.T) {
+	lb, err := NewIPVSLBWithClient(newFakeClient(), "fd00::100", 6443)
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	address := lb.Address()
+	if !address.Equal(net.ParseIP("fd00::100")) || lb.Port != 6443 {
+		t.Errorf("Address() = %s and Port = %d, expected fd00::100 and 6443", address, lb.Port)
+	}
+	// The address is a copy
+	address[0] = 0
+	if !lb.Address().Equal(net.ParseIP("fd00::100")) {
+		t.Errorf("Address() = %s after modifying the returned address, expected fd00::100", lb.Address())
+	}
+
+	if address = newTestLB(t, newFakeClient()).Address(); !address.Equal(net.ParseIP("192.168.0.1")) || len(address) != net.IPv4len {
+		t.Errorf("Address() = %v, expected 192.168.0.1", []byte(address))
+	}
+
+	fwmark, err := NewIPVSLBFwmarkWithClient(newFakeClient(), 10, ipvs.INET)
+	if err != nil {
+		t.Fatalf("NewIPVSLBFwmarkWithClient() error = %v", err)
+	}
+	if address = fwmark.Address(); address != nil {
+		t.Errorf("Address() of a firewall mark service = %s, expected nil", address)
+	}
+}
+
+func TestAddressUpdateVIP(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for x := 0; x < 50; x++ {
+			if err := lb.UpdateVIP(fmt.Sprintf("192.168.1.%d", x+1)); err != nil {
+				t.Errorf("UpdateVIP() error = %v", err)
+				return
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if address := lb.Address(); address == nil {
+			t.Fatalf("Address() = nil whilst the VIP is updated")
+		}
+		if protocol := lb.Protocol(); protocol != "tcp" {
+			t.Fatalf("Protocol() = %s whilst the VIP is updated, expected tcp", protocol)
+		}
+	}
+	if address := lb.Address(); !address.Equal(net.ParseIP("192.168.1.50")) {
+		t.Errorf("Address() = %s, expected the updated VIP 192.168.1.50", address)
+	}
+}
+
+func TestUpdateBackendWeight(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+
+	for _, weight := range []int{10, 0} {
+		if err := lb.UpdateBackendWeight("10.0.0.1", 6443, weight); err != nil {
+			t.Fatalf("UpdateBackendWeight() error = %v", err)
+		}
+		backends, _ := lb.ListBackends()
+		if backends[0].Weight != weight {
+			t.Errorf("UpdateBackendWeight() weight = %d, expected %d", backends[0].Weight, weight)
+		}
+	}
+
+	err := lb.UpdateBackendWeight("10.0.0.2", 6443, 1)
+	if !errors.Is(err, ErrBackendNotFound) {
+		t.Errorf("UpdateBackendWeight() of a missing backend error = %v, expected ErrBackendNotFound", err)
+	}
+}
+
+func TestCreateServiceAdoptsMatchingService(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+
+	// A matching service is adopted, so the existing backends are preserved
+	lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithOnServiceRecreated(func(string, int) {
+		t.Errorf("OnServiceRecreated called for an adopted service")
+	}))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	backends, _ := lb.ListBackends()
+	if len(backends) != 1 {
+		t.Errorf("matching service was not adopted, found %d backends, expected 1", len(backends))
+	}
+}
+
+func TestCreateServiceRecreatesDriftedService(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+
+	// The scheduler has drifted, so the service is re-created without the existing backends
+	var recreated string
+	onRecreated := WithOnServiceRecreated(func(vip string, port int) {
+		recreated = backendKey(vip, port)
+	})
+	lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithScheduler(SchedulerWLC), onRecreated)
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if recreated != "192.168.0.1:6443" {
+		t.Errorf("OnServiceRecreated called with [%s], expected 192.168.0.1:6443", recreated)
+	}
+	backends, _ := lb.ListBackends()
+	if len(backends) != 0 {
+		t.Errorf("drifted service was not re-created, found %d backends, expected 0", len(backends))
+	}
+	svc, _ := c.Service(lb.loadBalancerService)
+	if svc.Scheduler != "wlc" {
+		t.Errorf("re-created service scheduler = %s, expected wlc", svc.Scheduler)
+	}
+}
+
+func TestServiceStats(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	c.services[fakeServiceKey(lb.loadBalancerService)].stats = ipvs.Stats{Connections: 3, IncomingBytes: 1024}
+
+	// Stats are available without any backends registered
+	stats, err := lb.ServiceStats()
+	if err != nil {
+		t.Fatalf("ServiceStats() error = %v", err)
+	}
+	if stats.Connections != 3 || stats.IncomingBytes != 1024 {
+		t.Errorf("ServiceStats() = %+v, expected 3 connections and 1024 incoming bytes", stats)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	other, err := NewIPVSLBWithClient(c, "192.168.0.2", 6443)
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	c.services[fakeServiceKey(lb.loadBalancerService)].stats = ipvs.Stats{Connections: 3}
+	c.services[fakeServiceKey(other.loadBalancerService)].stats = ipvs.Stats{Connections: 5}
+
+	if err = lb.ResetStats(); err != nil {
+		t.Fatalf("ResetStats() error = %v", err)
+	}
+	if stats, _ := lb.ServiceStats(); stats.Connections != 0 {
+		t.Errorf("ServiceStats() = %+v after ResetStats(), expected zeroed counters", stats)
+	}
+	// The counters of other services are unchanged
+	if stats, _ := other.ServiceStats(); stats.Connections != 5 {
+		t.Errorf("ServiceStats() of another load balancer = %+v, expected 5 connections", stats)
+	}
+
+	c.injectErrors("ZeroService", syscall.EOPNOTSUPP)
+	if err = lb.ResetStats(); !errors.Is(err, syscall.EOPNOTSUPP) || !strings.Contains(err.Error(), "isn't supported by the kernel") {
+		t.Errorf("ResetStats() error = %v, expected the operation to be reported as unsupported", err)
+	}
+}
+
+func TestConnectionSync(t *testing.T) {
+	defer func(fn func(string) (*net.Interface, error)) { interfaceByName = fn }(interfaceByName)
+	interfaceByName = func(name string) (*net.Interface, error) {
+		if name != "eth0" {
+			return nil, errors.New("no such network interface")
+		}
+		return &net.Interface{Name: name}, nil
+	}
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+
+	for _, tt := range []struct{ role, iface string }{{"primary", "eth0"}, {SyncRoleMaster, ""}, {SyncRoleMaster, "eth1"}} {
+		if err := lb.StartConnectionSync(tt.role, tt.iface); err == nil {
+			t.Errorf("StartConnectionSync(%q, %q) expected an error", tt.role, tt.iface)
+		}
+	}
+	if len(c.daemons) != 0 {
+		t.Fatalf("StartConnectionSync() started %v after failing", c.daemons)
+	}
+
+	if err := lb.StartConnectionSync("Master", "eth0"); err != nil {
+		t.Fatalf("StartConnectionSync() error = %v", err)
+	}
+	if c.daemons[syncDaemonStates[SyncRoleMaster]] != "eth0" {
+		t.Errorf("StartConnectionSync() started %v, expected a master on eth0", c.daemons)
+	}
+	if err := lb.StartConnectionSync(SyncRoleBackup, "eth0"); err == nil {
+		t.Errorf("StartConnectionSync() whilst running expected an error")
+	}
+
+	if err := lb.StopConnectionSync(); err != nil {
+		t.Fatalf("StopConnectionSync() error = %v", err)
+	}
+	if len(c.daemons) != 0 {
+		t.Errorf("StopConnectionSync() left %v", c.daemons)
+	}
+	if err := lb.StopConnectionSync(); err != nil {
+		t.Errorf("StopConnectionSync() when stopped error = %v", err)
+	}
+
+	// A daemon already started by something else is reported
+	c.injectErrors("StartSyncDaemon", syscall.EEXIST)
+	if err := lb.StartConnectionSync(SyncRoleBackup, "eth0"); !errors.Is(err, syscall.EEXIST) || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("StartConnectionSync() error = %v, expected the running daemon to be reported", err)
+	}
+
+	// Close stops the daemon
+	if err := lb.StartConnectionSync(SyncRoleBackup, "eth0"); err != nil {
+		t.Fatalf("StartConnectionSync() error = %v", err)
+	}
+	if err := lb.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if len(c.daemons) != 0 {
+		t.Errorf("Close() left %v", c.daemons)
+	}
+}
+
+// closingClient counts how many times the client has been closed
+type closingClient struct {
+	*fakeClient
+	closed int
+}
+
+func (c *closingClient) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestSharedClient(t *testing.T) {
+	c := &closingClient{fakeClient: newFakeClient()}
+	shared := newSharedClient(c)
+
+	lb1, err := NewIPVSLBWithClient(shared, "192.168.0.1", 6443)
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	lb2, err := NewIPVSLBWithClient(shared, "192.168.0.2", 6443)
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+
+	// The client is only closed once every reference has been released
+	for _, closer := range []interface{ Close() error }{shared, lb1, lb2} {
+		if c.closed != 0 {
+			t.Fatalf("shared client closed whilst still referenced")
+		}
+		if err := closer.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+	}
+	if c.closed != 1 {
+		t.Errorf("shared client closed %d times, expected 1", c.closed)
+	}
+	if _, err := NewIPVSLBWithClient(shared, "192.168.0.3", 6443); err == nil {
+		t.Errorf("NewIPVSLBWithClient() with a closed shared client should return an error")
+	}
+
+	// A client that isn't shared remains owned by the caller
+	c = &closingClient{fakeClient: newFakeClient()}
+	lb := newTestLB(t, c)
+	if err := lb.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if c.closed != 0 {
+		t.Errorf("Close() closed a client owned by the caller")
+	}
+}
+
+func TestStructuredErrors(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	if err := lb.RemoveIPVSLB(); err != nil {
+		t.Fatalf("RemoveIPVSLB() error = %v", err)
+	}
+
+	err := lb.AddBackend("10.0.0.1", 8443)
+	var lbErr *Error
+	if !errors.As(err, &lbErr) {
+		t.Fatalf("AddBackend() error = %v, expected an *Error", err)
+	}
+	want := Error{Op: opAddBackend, VIP: "192.168.0.1", Port: 6443, Backend: "10.0.0.1:8443"}
+	if lbErr.Op != want.Op || lbErr.VIP != want.VIP || lbErr.Port != want.Port || lbErr.Backend != want.Backend {
+		t.Errorf("AddBackend() error = %+v, expected %+v", lbErr, want)
+	}
+	if !errors.Is(err, syscall.ESRCH) {
+		t.Errorf("AddBackend() error = %v, expected to unwrap to ESRCH", err)
+	}
+	if errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("AddBackend() error = %v, should not match ErrAlreadyExists", err)
+	}
+}
+
+func TestErrnoUnwrapping(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		errno  syscall.Errno
+		op     func(lb *IPVSLoadBalancer) error
+	}{
+		{"add backend", "CreateDestination", syscall.EINVAL, func(lb *IPVSLoadBalancer) error {
+			return lb.AddBackend("10.0.0.2", 6443)
+		}},
+		{"add backends", "CreateDestination", syscall.ENOMEM, func(lb *IPVSLoadBalancer) error {
+			return lb.AddBackends([]Backend{{Address: "10.0.0.2", Port: 6443, Weight: 1}})
+		}},
+		{"update backend", "UpdateDestination", syscall.EPERM, func(lb *IPVSLoadBalancer) error {
+			return lb.UpdateBackendWeight("10.0.0.1", 6443, 5)
+		}},
+		{"remove backend", "RemoveDestination", syscall.EPERM, func(lb *IPVSLoadBalancer) error {
+			return lb.RemoveBackend("10.0.0.1", 6443)
+		}},
+		{"list backends", "Destinations", syscall.ENOBUFS, func(lb *IPVSLoadBalancer) error {
+			_, err := lb.ListBackends()
+			return err
+		}},
+		{"add port", "Destinations", syscall.ENOMEM, func(lb *IPVSLoadBalancer) error {
+			return lb.AddPort(8443)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient()
+			lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithRetry(1, time.Millisecond))
+			if err != nil {
+				t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+			}
+			if err = lb.AddBackend("10.0.0.1", 6443); err != nil {
+				t.Fatalf("AddBackend() error = %v", err)
+			}
+			c.injectErrors(tt.method, tt.errno)
+			if err = tt.op(lb); !errors.Is(err, tt.errno) {
+				t.Errorf("error = %v, expected to unwrap to %v", err, tt.errno)
+			}
+		})
+	}
+
+	// The failure to create the service and to set the timeouts unwrap to the errno
+	c := newFakeClient()
+	c.injectErrors("CreateService", syscall.EPERM)
+	if _, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("NewIPVSLBWithClient() error = %v, expected to unwrap to EPERM", err)
+	}
+	c = newFakeClient()
+	c.injectErrors("SetTimeouts", syscall.EINVAL)
+	if _, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithTimeouts(Timeouts{TCP: time.Minute})); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("NewIPVSLBWithClient() WithTimeouts error = %v, expected to unwrap to EINVAL", err)
+	}
+}
+
+func TestFwmarkService(t *testing.T) {
+	c := newFakeClient()
+	lb, err := NewIPVSLBFwmarkWithClient(c, 100, ipvs.INET)
+	if err != nil {
+		t.Fatalf("NewIPVSLBFwmarkWithClient() error = %v", err)
+	}
+	svc, err := c.Service(ipvs.Service{Family: ipvs.INET, FWMark: 100})
+	if err != nil {
+		t.Fatalf("firewall mark service was not created: %v", err)
+	}
+	if svc.Port != 0 || svc.Address != (ipvs.IP{}) {
+		t.Errorf("firewall mark service = %+v, expected no address or port", svc.Service)
+	}
+
+	// Backends are managed in the same manner as an address service
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	if backends, _ := lb.ListBackends(); len(backends) != 1 {
+		t.Errorf("ListBackends() returned %d backends, expected 1", len(backends))
+	}
+	if err := lb.AddPort(8443); err == nil {
+		t.Errorf("AddPort() on a firewall mark service should return an error")
+	}
+
+	if _, err := NewIPVSLBFwmarkWithClient(newFakeClient(), 0, ipvs.INET); err == nil {
+		t.Errorf("NewIPVSLBFwmarkWithClient() with a zero firewall mark should return an error")
+	}
+
+	if _, err := newIPVSLB(context.Background(), newFakeClient(), ipvs.Service{Family: ipvs.INET, FWMark: 100, Port: 6443}); err == nil {
+		t.Errorf("newIPVSLB() with both a firewall mark and port should return an error")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	c := newFakeClient()
+	lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+
+	// Transient failures are retried until the change succeeds
+	c.injectErrors("CreateDestination", syscall.EBUSY, syscall.EBUSY)
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() after two transient failures error = %v", err)
+	}
+	if backends, _ := lb.ListBackends(); len(backends) != 1 {
+		t.Errorf("ListBackends() returned %d backends, expected 1", len(backends))
+	}
+
+	// The failure is returned once the attempts are exhausted
+	c.injectErrors("CreateDestination", syscall.EBUSY, syscall.EBUSY, syscall.EBUSY)
+	if err := lb.AddBackend("10.0.0.2", 6443); !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("AddBackend() error = %v, expected EBUSY once the attempts are exhausted", err)
+	}
+
+	// Permanent failures are not retried
+	c.injectErrors("RemoveDestination", syscall.EPERM)
+	if err := lb.RemoveBackend("10.0.0.1", 6443); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("RemoveBackend() error = %v, expected EPERM without retrying", err)
+	}
+}
+
+func TestBootRetry(t *testing.T) {
+	stale := ipvs.Service{Family: ipvs.INET, Protocol: ipvs.TCP, Address: ipvs.NewIP(net.ParseIP("192.168.0.1").To4()), Port: 6443, Scheduler: "wlc"}
+	newStale := func() *fakeClient {
+		c := newFakeClient()
+		if err := c.CreateService(stale); err != nil {
+			t.Fatalf("CreateService() error = %v", err)
+		}
+		return c
+	}
+
+	// The stale service is already gone when it is removed, the creation is retried once it has settled
+	c := newStale()
+	c.injectErrors("RemoveService", syscall.ESRCH)
+	lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithBootRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if svc, _ := c.Service(lb.loadBalancerService); svc.Scheduler != "rr" {
+		t.Errorf("IPVS service scheduler = %s, expected it to be re-created with rr", svc.Scheduler)
+	}
+
+	// The stale service hasn't been fully removed when it is re-created
+	c = newStale()
+	c.injectErrors("CreateService", nil, syscall.EEXIST)
+	if _, err = NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithBootRetry(3, time.Millisecond)); err != nil {
+		t.Fatalf("NewIPVSLBWithClient() after a re-create conflict error = %v", err)
+	}
+
+	// The failure is returned once the attempts are exhausted
+	c = newStale()
+	c.injectErrors("RemoveService", syscall.ESRCH)
+	if _, err = NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithBootRetry(1, time.Millisecond)); !errors.Is(err, syscall.ESRCH) {
+		t.Errorf("NewIPVSLBWithClient() error = %v, expected ESRCH without retrying", err)
+	}
+
+	// Permanent failures and conflicts that are configured to fail are not retried
+	c = newFakeClient()
+	c.injectErrors("CreateService", syscall.EPERM)
+	if _, err = NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithBootRetry(3, time.Millisecond)); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("NewIPVSLBWithClient() error = %v, expected EPERM without retrying", err)
+	}
+	if _, err = NewIPVSLBWithClient(newStale(), "192.168.0.1", 6443, WithBootRetry(3, time.Millisecond), WithConflictMode(ConflictFail)); !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("NewIPVSLBWithClient() error = %v, expected EEXIST without retrying", err)
+	}
+
+	if _, err = NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithBootRetry(0, time.Millisecond)); err == nil {
+		t.Errorf("WithBootRetry() with no attempts should return an error")
+	}
+}
+
+func TestNormalizeAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		vip       string
+		addresses []string
+		remove    string
+	}{
+		{"IPv4", "192.168.0.1", []string{"10.0.0.1", "::ffff:10.0.0.1", "010.000.000.001", " 10.0.0.1 "}, "::FFFF:10.0.0.1"},
+		{"IPv6", "fd00::100", []string{"fd00::1", "FD00:0:0::1", "fd00:0000::0001", "[fd00::1]"}, "fd00:0:0:0:0:0:0:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewIPVSLBWithClient(newFakeClient(), tt.vip, 6443)
+			if err != nil {
+				t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+			}
+			for _, address := range tt.addresses {
+				if err := lb.AddBackend(address, 6443); err != nil {
+					t.Fatalf("AddBackend(%q) error = %v", address, err)
+				}
+			}
+			backends, _ := lb.ListBackends()
+			if len(backends) != 1 {
+				t.Fatalf("ListBackends() = %+v, expected a single backend", backends)
+			}
+
+			if err := lb.RemoveBackend(tt.remove, 6443); err != nil {
+				t.Fatalf("RemoveBackend(%q) error = %v", tt.remove, err)
+			}
+			if backends, _ := lb.ListBackends(); len(backends) != 0 {
+				t.Errorf("ListBackends() = %+v, expected no backends", backends)
+			}
+		})
+	}
+}
+
+func TestServiceNotFound(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+
+	// The service is removed from underneath the load balancer
+	if err := c.RemoveService(lb.loadBalancerService); err != nil {
+		t.Fatalf("RemoveService() error = %v", err)
+	}
+	if err := lb.RemoveBackend("10.0.0.1", 6443); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("RemoveBackend() error = %v, expected ErrServiceNotFound", err)
+	}
+	if err := lb.AddBackend("10.0.0.2", 6443); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("AddBackend() error = %v, expected ErrServiceNotFound", err)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	if s := lb.String(); s != "tcp 192.168.0.1:6443 (rr)" {
+		t.Errorf("String() = %q, expected %q", s, "tcp 192.168.0.1:6443 (rr)")
+	}
+
+	if err := lb.AddPort(8443); err != nil {
+		t.Fatalf("AddPort() error = %v", err)
+	}
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	s, err := lb.Describe()
+	if err != nil {
+		t.Fatalf("Describe() error = %v", err)
+	}
+	if s != "tcp 192.168.0.1:6443,8443 (rr) with 1 backends" {
+		t.Errorf("Describe() = %q, expected %q", s, "tcp 192.168.0.1:6443,8443 (rr) with 1 backends")
+	}
+}
+
+func TestAdoptionTimeout(t *testing.T) {
+	adoptionPollInterval = time.Millisecond
+	stale := ipvs.Service{Family: ipvs.INET, Protocol: ipvs.TCP, Address: ipvs.NewIP(net.ParseIP("192.168.0.1").To4()), Port: 6443, Scheduler: "wlc"}
+
+	// The stale service disappears whilst waiting, so it is created rather than re-created (which would
+	// fail to remove it)
+	c := newFakeClient()
+	if err := c.CreateService(stale); err != nil {
+		t.Fatalf("CreateService() error = %v", err)
+	}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		c.mu.Lock()
+		delete(c.services, fakeServiceKey(stale))
+		c.mu.Unlock()
+	}()
+	c.injectErrors("RemoveService", syscall.EPERM)
+	if _, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithAdoptionTimeout(time.Second)); err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+
+	// The stale service remains, so it is re-created once the timeout has passed
+	c = newFakeClient()
+	if err := c.CreateService(stale); err != nil {
+		t.Fatalf("CreateService() error = %v", err)
+	}
+	lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithAdoptionTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if svc, _ := c.Service(lb.loadBalancerService); svc.Scheduler != "rr" {
+		t.Errorf("stale service scheduler = %s, expected it to be re-created with rr", svc.Scheduler)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	if lb.Origin() != ServiceCreated {
+		t.Errorf("Origin() = %s, expected created", lb.Origin())
+	}
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+
+	// A restarting load balancer adopts the matching service
+	adopted, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443)
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if adopted.Origin() != ServiceAdopted {
+		t.Errorf("Origin() = %s, expected adopted", adopted.Origin())
+	}
+
+	// A service with a different spec is re-created
+	recreated, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithScheduler(SchedulerWLC))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if recreated.Origin() != ServiceRecreated {
+		t.Errorf("Origin() = %s, expected recreated", recreated.Origin())
+	}
+}
+
+func TestAddressFamilies(t *testing.T) {
+	tests := []struct {
+		name    string
+		vip     string
+		backend string
+		fwd     ipvs.ForwardType
+		wantErr bool
+	}{
+		{"IPv4 backend of an IPv4 VIP", "192.168.0.1", "10.0.0.1", ipvs.Local, false},
+		{"IPv6 backend of an IPv6 VIP", "fd00::100", "fd00::1", ipvs.Local, false},
+		{"IPv6 backend of an IPv4 VIP", "192.168.0.1", "fd00::1", ipvs.Local, true},
+		{"IPv4 backend of an IPv6 VIP", "fd00::100", "10.0.0.1", ipvs.Masquarade, true},
+		{"tunnelled IPv6 backend of an IPv4 VIP", "192.168.0.1", "fd00::1", ipvs.Tunnel, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewIPVSLBWithClient(newFakeClient(), tt.vip, 6443)
+			if err != nil {
+				t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+			}
+			err = lb.AddBackendWithForwardMethod(tt.backend, 6443, 1, tt.fwd)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AddBackendWithForwardMethod() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && (!errors.Is(err, ErrFamilyMismatch) || !strings.Contains(err.Error(), tt.backend) || !strings.Contains(err.Error(), tt.vip)) {
+				t.Errorf("AddBackendWithForwardMethod() error = %v, expected an address family mismatch of both addresses", err)
+			}
+
+			err = lb.RemoveBackend(tt.backend, 6443)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RemoveBackend() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrFamilyMismatch) {
+				t.Errorf("RemoveBackend() error = %v, expected an address family mismatch", err)
+			}
+		})
+	}
+}
+
+func TestCleanupOrphaned(t *testing.T) {
+	c := newFakeClient()
+	for _, svc := range []struct {
+		vip  string
+		port int
+	}{
+		{"192.168.0.1", 6443},
+		{"192.168.0.1", 443},
+		{"192.168.0.2", 6443},
+		{"fd00::100", 6443},
+	} {
+		if _, err := NewIPVSLBWithClient(c, svc.vip, svc.port); err != nil {
+			t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+		}
+	}
+	if _, err := NewIPVSLBFwmarkWithClient(c, 10, ipvs.INET); err != nil {
+		t.Fatalf("NewIPVSLBFwmarkWithClient() error = %v", err)
+	}
+
+	removed, err := CleanupOrphanedWithClient(c, []string{"192.168.0.1", "fd00:0::100"})
+	if err != nil {
+		t.Fatalf("CleanupOrphanedWithClient() error = %v", err)
+	}
+	if removed != 3 {
+		t.Errorf("CleanupOrphanedWithClient() removed %d services, expected 3", removed)
+	}
+	services, _ := c.Services()
+	if len(services) != 2 {
+		t.Fatalf("%d services remain, expected the unmanaged VIP and fwmark services", len(services))
+	}
+	for _, svc := range services {
+		if svc.Service.FWMark == 0 && svc.Service.Address.Net(svc.Service.Family).String() != "192.168.0.2" {
+			t.Errorf("the managed service [%s] was not removed", svc.Service.Address.Net(svc.Service.Family))
+		}
+	}
+
+	if _, err := CleanupOrphanedWithClient(c, []string{"not-an-ip"}); err == nil {
+		t.Errorf("CleanupOrphanedWithClient() expected an error for an invalid VIP")
+	}
+}
+
+func TestUpdateScheduler(t *testing.T) {
+	tests := []struct {
+		name string
+		errs []error
+	}{
+		{"in place", nil},
+		{"unsupported edit falls back to re-creating", []error{syscall.EOPNOTSUPP}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient()
+			lb := newTestLB(t, c)
+			if err := lb.AddBackendWithWeight("10.0.0.1", 6443, 3); err != nil {
+				t.Fatalf("AddBackendWithWeight() error = %v", err)
+			}
+			c.injectErrors("UpdateService", tt.errs...)
+
+			if err := lb.UpdateScheduler(SchedulerWRR); err != nil {
+				t.Fatalf("UpdateScheduler() error = %v", err)
+			}
+			if lb.Scheduler() != SchedulerWRR {
+				t.Errorf("Scheduler() = %s, expected wrr", lb.Scheduler())
+			}
+			existing, err := c.Service(lb.loadBalancerService)
+			if err != nil {
+				t.Fatalf("Service() error = %v", err)
+			}
+			if existing.Service.Scheduler != "wrr" {
+				t.Errorf("IPVS service scheduler = %s, expected wrr", existing.Service.Scheduler)
+			}
+			backends, _ := lb.ListBackends()
+			if len(backends) != 1 || backends[0].Weight != 3 {
+				t.Errorf("ListBackends() = %+v, expected the backend to be preserved", backends)
+			}
+		})
+	}
+
+	lb := newTestLB(t, newFakeClient())
+	if err := lb.UpdateScheduler("bogus"); err == nil {
+		t.Errorf("UpdateScheduler() expected an error for an unknown scheduler")
+	}
+	if lb.Scheduler() != SchedulerRR {
+		t.Errorf("Scheduler() = %s, expected the scheduler to be unchanged", lb.Scheduler())
+	}
+	// An empty scheduler is round-robin
+	if err := lb.UpdateScheduler(SchedulerWRR); err != nil {
+		t.Fatalf("UpdateScheduler() error = %v", err)
+	}
+	if err := lb.UpdateScheduler(""); err != nil {
+		t.Fatalf("UpdateScheduler() of an empty scheduler error = %v", err)
+	}
+	if lb.Scheduler() != SchedulerRR {
+		t.Errorf("Scheduler() = %s, expected an empty scheduler to be rr", lb.Scheduler())
+	}
+}
+
+func TestServiceSpec(t *testing.T) {
+	lb, err := NewIPVSLBWithClient(newFakeClient(), "fd00::100", 443, WithScheduler(SchedulerSH), WithProtocol("udp"), WithPersistence(30*time.Second), WithSourceHashFlags(true, false), WithTimeouts(Timeouts{UDP: time.Minute}))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	expected := ServiceSpec{
+		Address:            "fd00::100",
+		Port:               443,
+		Protocol:           "udp",
+		Family:             ipvs.INET6,
+		Scheduler:          SchedulerSH,
+		Flags:              ipvs.ServicePersistent | shPort,
+		PersistenceTimeout: 30 * time.Second,
+		PersistenceNetmask: 128,
+		Timeouts:           Timeouts{UDP: time.Minute},
+	}
+	spec := lb.ServiceSpec()
+	if spec != expected {
+		t.Errorf("ServiceSpec() = %+v, expected %+v", spec, expected)
+	}
+
+	spec.Port = 80
+	if lb.ServiceSpec().Port != 443 {
+		t.Errorf("changing the returned spec changed the load balancer")
+	}
+
+	fwmark, err := NewIPVSLBFwmarkWithClient(newFakeClient(), 10, ipvs.INET)
+	if err != nil {
+		t.Fatalf("NewIPVSLBFwmarkWithClient() error = %v", err)
+	}
+	if spec := fwmark.ServiceSpec(); spec.FWMark != 10 || spec.Address != "" || spec.Protocol != "" {
+		t.Errorf("ServiceSpec() = %+v, expected a firewall mark spec", spec)
+	}
+}
+
+func TestRecreateFailureRestoresService(t *testing.T) {
+	tests := []struct {
+		name         string
+		errs         []error
+		wantRestored bool
+	}{
+		{"previous service restored", []error{nil, syscall.EPERM}, true},
+		{"previous service can't be restored", []error{nil, syscall.EPERM, syscall.EPERM}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient()
+			previous, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithScheduler(SchedulerWLC))
+			if err != nil {
+				t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+			}
+			if err = previous.AddBackend("10.0.0.1", 6443); err != nil {
+				t.Fatalf("AddBackend() error = %v", err)
+			}
+
+			c.injectErrors("CreateService", tt.errs...)
+			if _, err = NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithScheduler(SchedulerRR)); !errors.Is(err, syscall.EPERM) {
+				t.Fatalf("NewIPVSLBWithClient() error = %v, expected the re-create failure", err)
+			}
+
+			existing, err := c.Service(previous.loadBalancerService)
+			if !tt.wantRestored {
+				if err == nil {
+					t.Errorf("Service() found %+v, expected no service", existing.Service)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Service() error = %v, expected the previous service to be restored", err)
+			}
+			if existing.Service.Scheduler != "wlc" {
+				t.Errorf("restored service scheduler = %s, expected wlc", existing.Service.Scheduler)
+			}
+			if backends, _ := previous.ListBackends(); len(backends) != 1 {
+				t.Errorf("ListBackends() = %+v, expected the previous backend to be restored", backends)
+			}
+		})
+	}
+}
+
+func TestFailoverSchedulers(t *testing.T) {
+	for _, scheduler := range []Scheduler{SchedulerOVF, SchedulerFO} {
+		t.Run(string(scheduler), func(t *testing.T) {
+			c := newFakeClient()
+			lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithScheduler(scheduler))
+			if err != nil {
+				t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+			}
+			existing, err := c.Service(lb.loadBalancerService)
+			if err != nil {
+				t.Fatalf("Service() error = %v", err)
+			}
+			if existing.Service.Scheduler != string(scheduler) {
+				t.Errorf("IPVS service scheduler = %s, expected %s", existing.Service.Scheduler, scheduler)
+			}
+
+			// The kernel returns ENOENT when the scheduler module isn't available
+			c = newFakeClient()
+			c.injectErrors("CreateService", syscall.ENOENT)
+			_, err = NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithScheduler(scheduler))
+			if !errors.Is(err, syscall.ENOENT) || !strings.Contains(err.Error(), "isn't supported by the kernel") {
+				t.Errorf("NewIPVSLBWithClient() error = %v, expected the scheduler to be reported as unsupported", err)
+			}
+		})
+	}
+}
+
+func TestCheckIPVS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-vip-test")
+	if err != nil {
+		t.Fatalf("unable to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	procNet := filepath.Join(dir, "net")
+	if err = os.Mkdir(procNet, 0700); err != nil {
+		t.Fatalf("unable to create the directory: %v", err)
+	}
+	defer func(proc, module string) { ipvsProcPath, ipvsModulePath = proc, module }(ipvsProcPath, ipvsModulePath)
+	ipvsProcPath = filepath.Join(procNet, "ip_vs")
+	ipvsModulePath = filepath.Join(dir, "module", "ip_vs")
+
+	if err = checkIPVS(); !errors.Is(err, ErrIPVSUnavailable) {
+		t.Fatalf("checkIPVS() without the module error = %v, want ErrIPVSUnavailable", err)
+	}
+	if !strings.Contains(err.Error(), "modprobe ip_vs") {
+		t.Errorf("checkIPVS() error = %v, want the modprobe hint", err)
+	}
+
+	if err = os.MkdirAll(ipvsModulePath, 0700); err != nil {
+		t.Fatalf("unable to create the directory: %v", err)
+	}
+	if err = checkIPVS(); err != nil {
+		t.Errorf("checkIPVS() with /sys/module/ip_vs error = %v", err)
+	}
+	os.RemoveAll(ipvsModulePath)
+
+	if err = ioutil.WriteFile(ipvsProcPath, nil, 0600); err != nil {
+		t.Fatalf("unable to write the proc entry: %v", err)
+	}
+	if err = checkIPVS(); err != nil {
+		t.Errorf("checkIPVS() with /proc/net/ip_vs error = %v", err)
+	}
+
+	// The check is skipped when /proc/net isn't available
+	ipvsProcPath = filepath.Join(dir, "missing", "ip_vs")
+	if err = checkIPVS(); err != nil {
+		t.Errorf("checkIPVS() without /proc/net error = %v", err)
+	}
+}
+
+func TestUpdateVIP(t *testing.T) {
+	c := newFakeClient()
+	lb := newTestLB(t, c)
+	for _, address := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := lb.AddBackend(address, 6443); err != nil {
+			t.Fatalf("AddBackend() error = %v", err)
+		}
+	}
+	if err := lb.AddPort(8443); err != nil {
+		t.Fatalf("AddPort() error = %v", err)
+	}
+	previous := lb.services()
+
+	// The second port can't be created, so the first is rolled back and the VIP is unchanged
+	c.injectErrors("CreateService", nil, syscall.EPERM)
+	if err := lb.UpdateVIP("192.168.0.2"); err == nil {
+		t.Fatalf("UpdateVIP() should return the failure to create the service")
+	}
+	if len(c.services) != 2 || lb.ServiceSpec().Address != "192.168.0.1" {
+		t.Errorf("UpdateVIP() failure left %d IPVS services with VIP %s, expected the previous VIP", len(c.services), lb.ServiceSpec().Address)
+	}
+
+	if err := lb.UpdateVIP("192.168.0.2"); err != nil {
+		t.Fatalf("UpdateVIP() error = %v", err)
+	}
+	if lb.ServiceSpec().Address != "192.168.0.2" {
+		t.Errorf("ServiceSpec().Address = %s, expected 192.168.0.2", lb.ServiceSpec().Address)
+	}
+	for _, svc := range previous {
+		if _, ok := c.services[fakeServiceKey(svc)]; ok {
+			t.Errorf("the IPVS service of the previous VIP port %d wasn't removed", svc.Port)
+		}
+	}
+	for _, svc := range lb.services() {
+		s, ok := c.services[fakeServiceKey(svc)]
+		if !ok || len(s.dsts) != 2 {
+			t.Errorf("the IPVS service of the new VIP port %d should exist with the backends", svc.Port)
+		}
+	}
+
+	if err := lb.UpdateVIP("fd00::1"); !errors.Is(err, ErrFamilyMismatch) {
+		t.Errorf("UpdateVIP() of another address family error = %v, want ErrFamilyMismatch", err)
+	}
+	if err := lb.UpdateVIP("bogus"); err == nil {
+		t.Errorf("UpdateVIP() of an invalid address should return an error")
+	}
+}
+
+func TestSupportedSchedulers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-vip-test")
+	if err != nil {
+		t.Fatalf("unable to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string, newClient func() (Client, error)) {
+		ipvsSchedulerPath, newSchedulerProbeClient = path, newClient
+	}(ipvsSchedulerPath, newSchedulerProbeClient)
+
+	// The schedulers are read from the kernel when it lists them
+	ipvsSchedulerPath = filepath.Join(dir, "ip_vs_scheduler")
+	if err = ioutil.WriteFile(ipvsSchedulerPath, []byte("wrr\nrr\n\n"), 0600); err != nil {
+		t.Fatalf("unable to write the scheduler list: %v", err)
+	}
+	if got := strings.Join(detectSchedulers(), ","); got != "rr,wrr" {
+		t.Errorf("detectSchedulers() = %s, expected the listed schedulers", got)
+	}
+
+	// Otherwise they are probed, a scheduler that the kernel rejects isn't supported
+	os.Remove(ipvsSchedulerPath)
+	c := newFakeClient()
+	c.injectErrors("CreateService", nil, syscall.ENOENT)
+	newSchedulerProbeClient = func() (Client, error) { return c, nil }
+	got := detectSchedulers()
+	if strings.Join(got, ",") != "dh,lblc,lblcr,lc,ovf,rr,sh,wlc,wrr" {
+		t.Errorf("detectSchedulers() = %v, expected every known scheduler but fo", got)
+	}
+	if services, _ := c.Services(); len(services) != 0 {
+		t.Errorf("detectSchedulers() left %d probe services", len(services))
+	}
+
+	// Every known scheduler is assumed when they can't be probed
+	newSchedulerProbeClient = func() (Client, error) { return nil, ErrIPVSUnavailable }
+	if got = detectSchedulers(); len(got) != len(schedulers) {
+		t.Errorf("detectSchedulers() = %v, expected every known scheduler", got)
+	}
+
+	// The result is cached
+	first := SupportedSchedulers()
+	newSchedulerProbeClient = func() (Client, error) { return nil, errors.New("probed twice") }
+	first[0] = "modified"
+	if second := SupportedSchedulers(); len(second) == 0 || second[0] == "modified" {
+		t.Errorf("SupportedSchedulers() = %v, expected a copy of the cached schedulers", second)
+	}
+}
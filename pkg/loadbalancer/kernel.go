@@ -0,0 +1,231 @@
+//go:build linux
+// +build linux
+
+// The IPVS configuration commands that aren't part of the ipvs client are sent directly over the IPVS
+// generic netlink family, this is only supported on Linux so other OS's will use kernel_unsupported.go
+
+package loadbalancer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/ipvs"
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// IPVS generic netlink family, commands and attributes as defined in linux/ip_vs.h
+const (
+	ipvsGenlName    = "IPVS"
+	ipvsGenlVersion = 0x1
+
+	ipvsCmdSetDest   = 6
+	ipvsCmdNewDaemon = 9
+	ipvsCmdDelDaemon = 10
+	ipvsCmdSetConfig = 12
+	ipvsCmdZero      = 16
+
+	ipvsCmdAttrService       = 1
+	ipvsCmdAttrDest          = 2
+	ipvsCmdAttrDaemon        = 3
+	ipvsCmdAttrTimeoutTCP    = 4
+	ipvsCmdAttrTimeoutTCPFin = 5
+	ipvsCmdAttrTimeoutUDP    = 6
+
+	ipvsSvcAttrAF       = 1
+	ipvsSvcAttrProtocol = 2
+	ipvsSvcAttrAddr     = 3
+	ipvsSvcAttrPort     = 4
+	ipvsSvcAttrFWMark   = 5
+
+	ipvsDaemonAttrState    = 1
+	ipvsDaemonAttrMcastIfn = 2
+	ipvsDaemonAttrSyncID   = 3
+
+	ipvsDestAttrAddr       = 1
+	ipvsDestAttrPort       = 2
+	ipvsDestAttrFwdMethod  = 3
+	ipvsDestAttrWeight     = 4
+	ipvsDestAttrUThresh    = 5
+	ipvsDestAttrLThresh    = 6
+	ipvsDestAttrAddrFamily = 11
+	ipvsDestAttrTunType    = 13
+	ipvsDestAttrTunPort    = 14
+)
+
+// tunnelKernelVersions are the first kernel versions to support each tunnel type, older kernels silently
+// ignore the tunnel attributes so the version is checked instead
+var tunnelKernelVersions = map[TunnelType][2]int{
+	TunnelGUE: {5, 2},
+	TunnelGRE: {5, 3},
+}
+
+// setKernelTimeouts sets the IPVS connection timeouts (in seconds), a value of 0 leaves the current
+// kernel value unchanged
+func setKernelTimeouts(tcp, tcpFin, udp uint32) error {
+	return executeIPVSCommand(ipvsCmdSetConfig, func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(ipvsCmdAttrTimeoutTCP, tcp)
+		ae.Uint32(ipvsCmdAttrTimeoutTCPFin, tcpFin)
+		ae.Uint32(ipvsCmdAttrTimeoutUDP, udp)
+	})
+}
+
+// setKernelDestinationTunnel sets the tunnel type (and GUE port) of an existing destination, the whole
+// destination is sent as the kernel requires every attribute to edit it
+func setKernelDestinationTunnel(svc ipvs.Service, dst ipvs.Destination, tunnel Tunnel) error {
+	if err := kernelSupportsTunnel(tunnel.Type); err != nil {
+		return err
+	}
+	return executeIPVSCommand(ipvsCmdSetDest, func(ae *netlink.AttributeEncoder) {
+		ae.Do(ipvsCmdAttrService, serviceAttributes(svc))
+		ae.Do(ipvsCmdAttrDest, func() ([]byte, error) {
+			de := netlink.NewAttributeEncoder()
+			de.Uint16(ipvsDestAttrAddrFamily, uint16(dst.Family))
+			de.Bytes(ipvsDestAttrAddr, dst.Address[:])
+			de.Bytes(ipvsDestAttrPort, bigEndianPort(dst.Port))
+			de.Uint32(ipvsDestAttrFwdMethod, uint32(dst.FwdMethod))
+			de.Uint32(ipvsDestAttrWeight, dst.Weight)
+			de.Uint32(ipvsDestAttrUThresh, dst.UpperThreshold)
+			de.Uint32(ipvsDestAttrLThresh, dst.LowerThreshold)
+			de.Uint8(ipvsDestAttrTunType, uint8(tunnel.Type))
+			if tunnel.Type == TunnelGUE {
+				de.Bytes(ipvsDestAttrTunPort, bigEndianPort(uint16(tunnel.Port)))
+			}
+			return de.Encode()
+		})
+	})
+}
+
+// zeroKernelService zeroes the counters of a service and its destinations
+func zeroKernelService(svc ipvs.Service) error {
+	return executeIPVSCommand(ipvsCmdZero, func(ae *netlink.AttributeEncoder) {
+		ae.Do(ipvsCmdAttrService, serviceAttributes(svc))
+	})
+}
+
+// startKernelSyncDaemon starts the IPVS connection sync daemon in a state (master or backup) on an
+// interface, the kernel requires a sync ID and 0 is used as a backup with ID 0 accepts every master
+func startKernelSyncDaemon(state uint32, iface string) error {
+	return executeIPVSCommand(ipvsCmdNewDaemon, func(ae *netlink.AttributeEncoder) {
+		ae.Do(ipvsCmdAttrDaemon, func() ([]byte, error) {
+			de := netlink.NewAttributeEncoder()
+			de.Uint32(ipvsDaemonAttrState, state)
+			de.String(ipvsDaemonAttrMcastIfn, iface)
+			de.Uint32(ipvsDaemonAttrSyncID, 0)
+			return de.Encode()
+		})
+	})
+}
+
+// stopKernelSyncDaemon stops the IPVS connection sync daemon of a state (master or backup)
+func stopKernelSyncDaemon(state uint32) error {
+	return executeIPVSCommand(ipvsCmdDelDaemon, func(ae *netlink.AttributeEncoder) {
+		ae.Do(ipvsCmdAttrDaemon, func() ([]byte, error) {
+			de := netlink.NewAttributeEncoder()
+			de.Uint32(ipvsDaemonAttrState, state)
+			return de.Encode()
+		})
+	})
+}
+
+// serviceAttributes encodes the attributes that identify a service, its address, protocol and port or its
+// firewall mark
+func serviceAttributes(svc ipvs.Service) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		se := netlink.NewAttributeEncoder()
+		se.Uint16(ipvsSvcAttrAF, uint16(svc.Family))
+		if svc.FWMark != 0 {
+			se.Uint32(ipvsSvcAttrFWMark, svc.FWMark)
+		} else {
+			se.Uint16(ipvsSvcAttrProtocol, uint16(svc.Protocol))
+			se.Bytes(ipvsSvcAttrAddr, svc.Address[:])
+			se.Bytes(ipvsSvcAttrPort, bigEndianPort(svc.Port))
+		}
+		return se.Encode()
+	}
+}
+
+// bigEndianPort encodes a port in network byte order as IPVS expects
+func bigEndianPort(port uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, port)
+	return b
+}
+
+// kernelSupportsTunnel returns an error if the running kernel doesn't support the tunnel type
+func kernelSupportsTunnel(t TunnelType) error {
+	required, ok := tunnelKernelVersions[t]
+	if !ok {
+		return nil
+	}
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return fmt.Errorf("unable to determine the kernel version: %w", err)
+	}
+	release := unix.ByteSliceToString(uts.Release[:])
+	major, minor, ok := parseKernelVersion(release)
+	if !ok {
+		return fmt.Errorf("unable to parse the kernel version [%s]", release)
+	}
+	if major < required[0] || (major == required[0] && minor < required[1]) {
+		return fmt.Errorf("the %s tunnel type requires kernel %d.%d or newer, the kernel is %s", t, required[0], required[1], release)
+	}
+	return nil
+}
+
+// parseKernelVersion returns the major and minor version of a kernel release (such as 5.10.0-8-amd64)
+func parseKernelVersion(release string) (int, int, bool) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	// The minor version may be followed by a suffix when there is no patch version (such as 5.4-rc1)
+	minor := parts[1]
+	if i := strings.IndexFunc(minor, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minor = minor[:i]
+	}
+	m, err := strconv.Atoi(minor)
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, m, true
+}
+
+// executeIPVSCommand sends a single command with its attributes to the IPVS generic netlink family
+func executeIPVSCommand(command uint8, attributes func(ae *netlink.AttributeEncoder)) error {
+	c, err := genetlink.Dial(nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	family, err := c.GetFamily(ipvsGenlName)
+	if err != nil {
+		return err
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	attributes(ae)
+	b, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+
+	msg := genetlink.Message{
+		Header: genetlink.Header{
+			Command: command,
+			Version: ipvsGenlVersion,
+		},
+		Data: b,
+	}
+	_, err = c.Execute(msg, family.ID, netlink.Request|netlink.Acknowledge)
+	return err
+}
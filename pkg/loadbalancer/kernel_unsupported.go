@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+package loadbalancer
+
+import (
+	"fmt"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// setKernelTimeouts is only supported on Linux
+func setKernelTimeouts(tcp, tcpFin, udp uint32) error {
+	return fmt.Errorf("setting IPVS timeouts is only supported on Linux")
+}
+
+// setKernelDestinationTunnel is only supported on Linux
+func setKernelDestinationTunnel(svc ipvs.Service, dst ipvs.Destination, tunnel Tunnel) error {
+	return fmt.Errorf("setting the IPVS tunnel type is only supported on Linux")
+}
+
+// zeroKernelService is only supported on Linux
+func zeroKernelService(svc ipvs.Service) error {
+	return fmt.Errorf("zeroing the IPVS counters is only supported on Linux")
+}
+
+// startKernelSyncDaemon is only supported on Linux
+func startKernelSyncDaemon(state uint32, iface string) error {
+	return fmt.Errorf("the IPVS connection sync daemon is only supported on Linux")
+}
+
+// stopKernelSyncDaemon is only supported on Linux
+func stopKernelSyncDaemon(state uint32) error {
+	return fmt.Errorf("the IPVS connection sync daemon is only supported on Linux")
+}
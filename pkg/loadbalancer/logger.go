@@ -0,0 +1,71 @@
+package loadbalancer
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Fields are the structured fields of a log entry
+type Fields map[string]interface{}
+
+// Logger is the structured logger used by the load balancer, the default writes to the standard logrus
+// logger and an alternative (such as an adapter for the logger of the host application) can be passed
+// to the constructor WithLogger
+type Logger interface {
+	WithField(key string, value interface{}) Logger
+	WithFields(fields Fields) Logger
+
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// WithLogger sets the logger used by the load balancer (and its dry-run client), the default is the
+// standard logrus logger
+func WithLogger(logger Logger) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if logger == nil {
+			return fmt.Errorf("the logger must not be nil")
+		}
+		lb.logger = logger
+		return nil
+	}
+}
+
+// NewLogrusLogger returns a Logger that writes to a logrus logger
+func NewLogrusLogger(logger *log.Logger) Logger {
+	return logrusLogger{entry: log.NewEntry(logger)}
+}
+
+// defaultLogger is used when the load balancer is created without a logger
+var defaultLogger = NewLogrusLogger(log.StandardLogger())
+
+// logrusLogger is a Logger backed by a logrus entry
+type logrusLogger struct {
+	entry *log.Entry
+}
+
+func (l logrusLogger) WithField(key string, value interface{}) Logger {
+	return logrusLogger{entry: l.entry.WithField(key, value)}
+}
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{entry: l.entry.WithFields(log.Fields(fields))}
+}
+
+func (l logrusLogger) Debug(args ...interface{}) { l.entry.Debug(args...) }
+func (l logrusLogger) Info(args ...interface{})  { l.entry.Info(args...) }
+func (l logrusLogger) Warn(args ...interface{})  { l.entry.Warn(args...) }
+func (l logrusLogger) Error(args ...interface{}) { l.entry.Error(args...) }
+
+func (l logrusLogger) Debugf(format string, args ...interface{}) { l.entry.Debugf(format, args...) }
+func (l logrusLogger) Infof(format string, args ...interface{})  { l.entry.Infof(format, args...) }
+func (l logrusLogger) Warnf(format string, args ...interface{})  { l.entry.Warnf(format, args...) }
+func (l logrusLogger) Errorf(format string, args ...interface{}) { l.entry.Errorf(format, args...) }
@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package loadbalancer
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netns"
+)
+
+// runInNetNS will run fn with the calling thread inside the network namespace at the path, netlink sockets
+// opened by fn remain in the namespace once it has been left. The goroutine is locked to its OS thread
+// whilst inside the namespace, as Go would otherwise schedule other goroutines onto the thread.
+func runInNetNS(path string, fn func() error) error {
+	runtime.LockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("error getting the current network namespace: %w", err)
+	}
+	defer origin.Close()
+
+	target, err := netns.GetFromPath(path)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("error opening the network namespace [%s]: %w", path, err)
+	}
+	defer target.Close()
+
+	if err = netns.Set(target); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("error entering the network namespace [%s]: %w", path, err)
+	}
+	fnErr := fn()
+	if err = netns.Set(origin); err != nil {
+		// The thread is left locked so that it is terminated with the goroutine rather than reused
+		// whilst still inside the namespace
+		return fmt.Errorf("error restoring the network namespace: %w", err)
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package loadbalancer
+
+import "fmt"
+
+// runInNetNS is only supported on Linux
+func runInNetNS(path string, fn func() error) error {
+	return fmt.Errorf("network namespaces are only supported on Linux")
+}
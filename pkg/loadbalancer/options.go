@@ -0,0 +1,331 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// SchedulerFlags are the flags of an IPVS service that change how its connections are scheduled, see
+// WithSchedulerFlags
+type SchedulerFlags uint32
+
+// The scheduling flags supported by IPVS, each flag only applies to some schedulers or protocols and the
+// kernel silently ignores it otherwise. The remaining schedulers (such as wrr) have no flags.
+const (
+	// FlagSHFallback (sh-fallback) makes the source hashing (sh) scheduler select another backend when the
+	// hashed backend is unavailable (weight 0), it is only used by the sh scheduler
+	FlagSHFallback = SchedulerFlags(ipvs.ServiceSchedulerOpt1)
+	// FlagSHPort (sh-port) includes the source port in the hash of the source hashing (sh) scheduler as well
+	// as the source address, it is only used by the sh scheduler
+	FlagSHPort = SchedulerFlags(ipvs.ServiceSchedulerOpt2)
+	// FlagOnePacket (ops) schedules every UDP datagram on its own rather than as part of a connection, so the
+	// datagrams of a client are spread across the backends, it is used by every scheduler but only for UDP
+	FlagOnePacket = SchedulerFlags(ipvs.ServiceOnePacket)
+)
+
+// Flags of the source hashing (sh) scheduler
+const (
+	shFallback = ipvs.Flags(FlagSHFallback)
+	shPort     = ipvs.Flags(FlagSHPort)
+)
+
+// supportedSchedulerFlags are all of the scheduling flags
+const supportedSchedulerFlags = FlagSHFallback | FlagSHPort | FlagOnePacket
+
+// Option configures an optional setting of the load balancer when it is created
+type Option func(*IPVSLoadBalancer) error
+
+// optionsOf returns the settings of the options for the decisions made before the load balancer is created
+// (such as how to create the client), any invalid options are reported when the load balancer is created
+func optionsOf(opts []Option) *IPVSLoadBalancer {
+	lb := &IPVSLoadBalancer{}
+	for _, opt := range opts {
+		_ = opt(lb)
+	}
+	return lb
+}
+
+// WithScheduler sets the IPVS scheduler of the service, the default (or an empty scheduler) is round-robin (rr)
+func WithScheduler(scheduler Scheduler) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if scheduler == "" {
+			scheduler = SchedulerRR
+		}
+		if !schedulers[scheduler] {
+			return fmt.Errorf("unknown IPVS scheduler [%s]", scheduler)
+		}
+		lb.scheduler = scheduler
+		return nil
+	}
+}
+
+// WithProtocol sets the protocol (tcp, udp or sctp) of the service, the default is tcp
+func WithProtocol(protocol string) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		proto, ok := protocols[strings.ToLower(protocol)]
+		if !ok {
+			return fmt.Errorf("unknown IPVS protocol [%s], expected one of tcp, udp or sctp", protocol)
+		}
+		lb.protocol = proto
+		return nil
+	}
+}
+
+// WithPersistence enables persistence (sticky sessions) on the IPVS service, connections from the same
+// client will be sent to the same backend until the timeout has passed without activity. A timeout of
+// zero leaves persistence disabled.
+func WithPersistence(timeout time.Duration) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if timeout < 0 || (timeout > 0 && timeout < time.Second) {
+			return fmt.Errorf("invalid persistence timeout [%s], must be zero or at least one second", timeout)
+		}
+		lb.persistenceTimeout = timeout
+		return nil
+	}
+}
+
+// WithPersistenceNetmask sets the granularity of persistence as a prefix length, so that the clients within
+// the same network (such as /24) are sent to the same backend rather than only the same client address. It
+// is 1-32 for an IPv4 VIP and 1-128 for an IPv6 VIP, the default is the whole address (/32 or /128).
+// Persistence must be enabled WithPersistence.
+func WithPersistenceNetmask(prefixLength int) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if prefixLength < 1 || prefixLength > 128 {
+			return fmt.Errorf("invalid persistence netmask [/%d], must be 1-32 for IPv4 or 1-128 for IPv6", prefixLength)
+		}
+		lb.persistenceNetmask = prefixLength
+		return nil
+	}
+}
+
+// Timeouts are the IPVS connection timeouts, IPVS only supports setting these for the whole kernel
+// (within the network namespace) so they will apply to every IPVS service and not only this load balancer.
+// Connections to a persistent service are tracked by a persistence template that won't expire whilst any
+// connections remain, so these timeouts also bound how long a client stays pinned beyond the persistence
+// timeout. A zero value leaves the current kernel value unchanged.
+type Timeouts struct {
+	// TCP is the timeout of an established TCP connection
+	TCP time.Duration
+	// TCPFin is the timeout of a TCP connection after a FIN has been received
+	TCPFin time.Duration
+	// UDP is the timeout of UDP traffic without any packets
+	UDP time.Duration
+}
+
+// WithTimeouts sets the IPVS connection timeouts when the load balancer is created
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		for _, timeout := range []time.Duration{timeouts.TCP, timeouts.TCPFin, timeouts.UDP} {
+			if timeout < 0 || (timeout > 0 && timeout < time.Second) {
+				return fmt.Errorf("invalid connection timeout [%s], must be zero or at least one second", timeout)
+			}
+		}
+		lb.timeouts = timeouts
+		return nil
+	}
+}
+
+// WithSourceHashFlags sets the flags of the source hashing (sh) scheduler, hashPort includes the client
+// port in the hash so that connections from the same client can be spread across backends, and fallback
+// picks another backend when the hashed backend is quiesced. The load balancer must be created with the
+// sh scheduler when either flag is set.
+func WithSourceHashFlags(hashPort, fallback bool) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		lb.schedulerFlags &^= shPort | shFallback
+		if hashPort {
+			lb.schedulerFlags |= shPort
+		}
+		if fallback {
+			lb.schedulerFlags |= shFallback
+		}
+		return nil
+	}
+}
+
+// WithSchedulerFlags sets the scheduling flags of the IPVS service (replacing any set WithSourceHashFlags),
+// the flags must be used by the scheduler and protocol of the load balancer. FlagSHFallback and FlagSHPort
+// require the sh scheduler, and FlagOnePacket requires a udp (or firewall mark) service.
+func WithSchedulerFlags(flags SchedulerFlags) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if flags&^supportedSchedulerFlags != 0 {
+			return fmt.Errorf("unknown IPVS scheduling flags [%#x]", uint32(flags&^supportedSchedulerFlags))
+		}
+		lb.schedulerFlags = ipvs.Flags(flags)
+		return nil
+	}
+}
+
+// WithNetNS manages IPVS within the network namespace at the path (such as /var/run/netns/foo) rather
+// than the namespace of the process. The namespace is only entered (with the goroutine locked to its OS
+// thread) whilst the netlink sockets are opened and the IPVS connection timeouts are set, it is restored
+// immediately afterwards and the sockets continue to operate within the namespace until Close. Entering a
+// namespace requires CAP_SYS_ADMIN as well as the CAP_NET_ADMIN needed to manage IPVS. The namespace isn't
+// applied to the client passed to NewIPVSLBWithClient, which must already be opened within the namespace.
+func WithNetNS(path string) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if path == "" {
+			return fmt.Errorf("the network namespace path must not be empty")
+		}
+		lb.netns = path
+		return nil
+	}
+}
+
+// WithSourceAddress sets the local address that traffic to the backends should be sent from on a multi-homed
+// host, so that it egresses from the interface the backends expect and replies aren't routed asymmetrically.
+// The address must be assigned to an interface (within the network namespace of the load balancer) and be
+// of the address family of the VIP. IPVS has no source address of its own: the health check probes are sent
+// from it, and the co-located forwarder described in ipvs.go should bind its connections to SourceAddress.
+// With the Local forwarding method IPVS delivers the connection to a local socket with the client address
+// unchanged, so the source address only applies to connections that the forwarder makes onwards, whilst
+// Masquarade, Tunnel and DirectRoute traffic leaves with the source chosen by the routing table.
+func WithSourceAddress(address string) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		ip, _, err := parseAddress(address)
+		if err != nil {
+			return err
+		}
+		lb.sourceAddress = ip
+		return nil
+	}
+}
+
+// WithDefaultWeight sets the weight of the backends that are added without a weight (such as by AddBackend),
+// the default is DefaultWeight
+func WithDefaultWeight(weight int) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if err := validateWeight(weight, 1); err != nil {
+			return err
+		}
+		lb.defaultWeight = weight
+		return nil
+	}
+}
+
+// WeightFunc computes the weight of a backend, such as from the capacity of its node so that bigger nodes
+// receive more connections. The backend has the weight that it would otherwise be given.
+type WeightFunc func(backend Backend) int
+
+// WithWeightFunc sets a function that computes the weights of the backends as they are added by AddBackend
+// and reconciled by SyncBackends, replacing the default weight and the desired weights respectively. A
+// backend added with an explicit weight (such as by AddBackendWithWeight) keeps that weight. Without a
+// function every backend has the default weight (see WithDefaultWeight).
+func WithWeightFunc(fn WeightFunc) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		lb.weightFunc = fn
+		return nil
+	}
+}
+
+// WithBackendPort sets the port of the backends for the common case where every backend listens on the same
+// port (which may differ from the port of the VIP, such as VIP 443 to backend 6443), so that they can be
+// added with AddBackendDefault. Once it is set the backend port is the only port accepted, a backend added
+// with an explicit port (such as by AddBackend) must use the same port or it is rejected as a conflict.
+func WithBackendPort(port int) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if err := validatePort(port); err != nil {
+			return err
+		}
+		lb.backendPort = port
+		return nil
+	}
+}
+
+// WithStrict returns an error matching ErrAlreadyExists (with errors.Is) when a backend that is already
+// registered is added. By default adding an existing backend succeeds without changing it, as the node
+// watcher may apply the same backend multiple times, but that also hides a conflicting destination that
+// was registered by something else (possibly with a different weight or forwarding method). In strict
+// mode a backend that fails WithTopologyValidation is rejected rather than logged.
+func WithStrict() Option {
+	return func(lb *IPVSLoadBalancer) error {
+		lb.strict = true
+		return nil
+	}
+}
+
+// WithRemoveGracePeriod makes RemoveBackend quiesce a backend (weight 0) so that it receives no new
+// connections, and wait for the grace period before removing it, which gives in-flight requests a brief
+// chance to complete without every caller having to use DrainBackend. By default a backend is removed
+// immediately.
+func WithRemoveGracePeriod(grace time.Duration) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if grace < 0 {
+			return fmt.Errorf("invalid remove grace period [%s], must not be negative", grace)
+		}
+		lb.removeGracePeriod = grace
+		return nil
+	}
+}
+
+// ConflictMode is how the load balancer handles an IPVS service that already exists when it is created
+type ConflictMode int
+
+const (
+	// ConflictAdopt adopts an existing service that matches the desired spec (preserving its backends and
+	// connections), a service that doesn't match is removed and re-created. This is the default.
+	ConflictAdopt ConflictMode = iota
+	// ConflictRecreate always removes and re-creates an existing service, even if it matches
+	ConflictRecreate
+	// ConflictFail adopts an existing service that matches the desired spec, a service that doesn't match
+	// is left in place and the constructor returns an error matching ErrAlreadyExists
+	ConflictFail
+)
+
+// WithConflictMode sets how an IPVS service that already exists is handled when the load balancer is
+// created, the default is ConflictAdopt
+func WithConflictMode(mode ConflictMode) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if mode < ConflictAdopt || mode > ConflictFail {
+			return fmt.Errorf("unknown conflict mode [%d]", mode)
+		}
+		lb.conflictMode = mode
+		return nil
+	}
+}
+
+// WithAdoptionTimeout waits up to the timeout for a conflicting IPVS service (such as a stale service left by
+// a previous instance) to match the desired spec so that it can be adopted, or to be removed, before it is
+// removed and re-created. By default a conflicting service that doesn't match is re-created immediately.
+func WithAdoptionTimeout(timeout time.Duration) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if timeout < 0 {
+			return fmt.Errorf("invalid adoption timeout [%s], must not be negative", timeout)
+		}
+		lb.adoptionTimeout = timeout
+		return nil
+	}
+}
+
+// WithOnServiceRecreated sets a callback that is called when a conflicting IPVS service is removed and
+// re-created, as any connections through the previous service will have been reset
+func WithOnServiceRecreated(fn func(vip string, port int)) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		lb.onServiceRecreated = fn
+		return nil
+	}
+}
+
+// WithOnNoBackends sets a callback that is called when the last backend of the load balancer is removed
+// (such as by RemoveBackend or SyncBackends), as the VIP will silently drop traffic until a backend is added.
+// It is only called on the transition to no backends, and is called whilst the load balancer is locked so it
+// must not call the load balancer.
+func WithOnNoBackends(fn func(vip string, port int)) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		lb.onNoBackends = fn
+		return nil
+	}
+}
+
+// WithBackends registers an initial set of backends (in the same manner as AddBackends) once the IPVS
+// service has been created, so that the load balancer is fully populated when it is returned. If any of the
+// backends fail then the IPVS service is removed (including a service that was adopted) and the error is
+// returned, so a load balancer is never returned with only some of its initial backends.
+func WithBackends(backends []Backend) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		lb.initialBackends = append([]Backend(nil), backends...)
+		return nil
+	}
+}
@@ -0,0 +1,788 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/ipvs"
+)
+
+func TestConstructorOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		want    ServiceSpec
+		wantErr bool
+	}{
+		{"defaults", nil, ServiceSpec{Address: "192.168.0.1", Port: 6443, Family: ipvs.INET, Protocol: "tcp", Scheduler: SchedulerRR}, false},
+		{"scheduler and protocol", []Option{WithScheduler(SchedulerWLC), WithProtocol("UDP")},
+			ServiceSpec{Address: "192.168.0.1", Port: 6443, Family: ipvs.INET, Protocol: "udp", Scheduler: SchedulerWLC}, false},
+		{"persistence and timeouts", []Option{WithProtocol("sctp"), WithPersistence(time.Minute), WithTimeouts(Timeouts{TCP: time.Hour})},
+			ServiceSpec{Address: "192.168.0.1", Port: 6443, Family: ipvs.INET, Protocol: "sctp", Scheduler: SchedulerRR, Flags: ipvs.ServicePersistent, PersistenceTimeout: time.Minute, PersistenceNetmask: 32, Timeouts: Timeouts{TCP: time.Hour}}, false},
+		{"the last option wins", []Option{WithScheduler(SchedulerSH), WithScheduler(SchedulerLC)},
+			ServiceSpec{Address: "192.168.0.1", Port: 6443, Family: ipvs.INET, Protocol: "tcp", Scheduler: SchedulerLC}, false},
+		{"an empty scheduler is round-robin", []Option{WithScheduler("")},
+			ServiceSpec{Address: "192.168.0.1", Port: 6443, Family: ipvs.INET, Protocol: "tcp", Scheduler: SchedulerRR}, false},
+		{"unknown scheduler", []Option{WithScheduler("bogus")}, ServiceSpec{}, true},
+		{"unknown protocol", []Option{WithProtocol("icmp")}, ServiceSpec{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewIPVSLBWithClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if spec := lb.ServiceSpec(); !reflect.DeepEqual(spec, tt.want) {
+				t.Errorf("ServiceSpec() = %+v, expected %+v", spec, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewIPVSLBFwmarkWithClient(newFakeClient(), 10, ipvs.INET, WithProtocol("tcp")); err == nil {
+		t.Errorf("NewIPVSLBFwmarkWithClient() WithProtocol should return an error")
+	}
+	lb, err := NewIPVSLBFwmarkWithClient(newFakeClient(), 10, ipvs.INET, WithScheduler(SchedulerWRR))
+	if err != nil {
+		t.Fatalf("NewIPVSLBFwmarkWithClient() error = %v", err)
+	}
+	if spec := lb.ServiceSpec(); spec.Scheduler != SchedulerWRR || spec.Protocol != "" {
+		t.Errorf("ServiceSpec() = %+v, expected a wrr firewall mark service", spec)
+	}
+}
+
+func TestWithTimeouts(t *testing.T) {
+	c := newFakeClient()
+	timeouts := Timeouts{TCP: 15 * time.Minute, TCPFin: 2 * time.Minute}
+	if _, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithTimeouts(timeouts)); err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if c.timeouts != timeouts {
+		t.Errorf("WithTimeouts() set %+v, expected %+v", c.timeouts, timeouts)
+	}
+
+	if _, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithTimeouts(Timeouts{UDP: -time.Second})); err == nil {
+		t.Errorf("WithTimeouts() with a negative timeout should return an error")
+	}
+}
+
+func TestWithSourceHashFlags(t *testing.T) {
+	c := newFakeClient()
+	lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithScheduler(SchedulerSH), WithSourceHashFlags(true, true))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	svc, _ := c.Service(lb.loadBalancerService)
+	if svc.Flags&(shPort|shFallback) != shPort|shFallback {
+		t.Errorf("WithSourceHashFlags() set flags %#x, expected sh-port and sh-fallback", svc.Flags)
+	}
+
+	if _, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithScheduler(SchedulerRR), WithSourceHashFlags(true, false)); err == nil {
+		t.Errorf("WithSourceHashFlags() with the rr scheduler should return an error")
+	}
+}
+
+func TestWithDryRun(t *testing.T) {
+	c := newFakeClient()
+	lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithDryRun(), WithTimeouts(Timeouts{TCP: time.Minute}))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	if err := lb.AddBackend("10.0.0.2", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	if err := lb.RemoveBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+
+	// The simulated state is returned whilst the client is never used
+	backends, err := lb.ListBackends()
+	if err != nil {
+		t.Fatalf("ListBackends() error = %v", err)
+	}
+	if len(backends) != 1 || backends[0].Address != "10.0.0.2" {
+		t.Errorf("ListBackends() = %+v, expected the simulated backend 10.0.0.2", backends)
+	}
+	if svcs, _ := c.Services(); len(svcs) != 0 || c.timeouts != (Timeouts{}) {
+		t.Errorf("dry-run load balancer modified the IPVS client")
+	}
+}
+
+func TestWithNetNS(t *testing.T) {
+	if _, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithNetNS("")); err == nil {
+		t.Errorf("WithNetNS() with an empty path should return an error")
+	}
+
+	// The timeouts are set within the namespace, which doesn't exist
+	_, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithNetNS("/var/run/netns/missing"), WithTimeouts(Timeouts{TCP: time.Minute}))
+	if err == nil {
+		t.Errorf("WithNetNS() with a missing namespace should return an error")
+	}
+}
+
+func TestWithBackends(t *testing.T) {
+	backends := []Backend{
+		{Address: "10.0.0.1", Port: 6443, Weight: 1},
+		{Address: "10.0.0.2", Port: 6443, Weight: 2},
+	}
+	lb, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithBackends(backends))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if registered, _ := lb.ListBackends(); len(registered) != 2 {
+		t.Errorf("WithBackends() registered %d backends, expected 2", len(registered))
+	}
+
+	// A failed backend rolls back the service
+	c := newFakeClient()
+	backends = append(backends, Backend{Address: "node-1", Port: 6443, Weight: 1})
+	if _, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithBackends(backends)); err == nil {
+		t.Fatalf("WithBackends() with an invalid backend should return an error")
+	}
+	if svcs, _ := c.Services(); len(svcs) != 0 {
+		t.Errorf("WithBackends() left %d IPVS services after a failed backend, expected 0", len(svcs))
+	}
+}
+
+// recordingLogger is a Logger that records the messages and fields of every entry
+type recordingLogger struct {
+	fields  Fields
+	entries *[]Fields
+}
+
+func newRecordingLogger() recordingLogger {
+	return recordingLogger{fields: Fields{}, entries: &[]Fields{}}
+}
+
+func (l recordingLogger) WithField(key string, value interface{}) Logger {
+	return l.WithFields(Fields{key: value})
+}
+
+func (l recordingLogger) WithFields(fields Fields) Logger {
+	merged := Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return recordingLogger{fields: merged, entries: l.entries}
+}
+
+func (l recordingLogger) record(msg string) {
+	entry := l.WithField("msg", msg).(recordingLogger).fields
+	*l.entries = append(*l.entries, entry)
+}
+
+func (l recordingLogger) Debug(args ...interface{}) { l.record(fmt.Sprint(args...)) }
+func (l recordingLogger) Info(args ...interface{})  { l.record(fmt.Sprint(args...)) }
+func (l recordingLogger) Warn(args ...interface{})  { l.record(fmt.Sprint(args...)) }
+func (l recordingLogger) Error(args ...interface{}) { l.record(fmt.Sprint(args...)) }
+
+func (l recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record(fmt.Sprintf(format, args...))
+}
+func (l recordingLogger) Infof(format string, args ...interface{}) {
+	l.record(fmt.Sprintf(format, args...))
+}
+func (l recordingLogger) Warnf(format string, args ...interface{}) {
+	l.record(fmt.Sprintf(format, args...))
+}
+func (l recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record(fmt.Sprintf(format, args...))
+}
+
+func TestWithLogger(t *testing.T) {
+	logger := newRecordingLogger()
+	lb, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithLogger(logger))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if err = lb.RemoveIPVSLB(); err != nil {
+		t.Fatalf("RemoveIPVSLB() error = %v", err)
+	}
+
+	entries := *logger.entries
+	if len(entries) != 2 {
+		t.Fatalf("logged %d entries, expected the service to be created and removed: %v", len(entries), entries)
+	}
+	if entries[0]["msg"] != "created IPVS service" || entries[0]["vip"] != "192.168.0.1" || entries[0]["operation"] != opCreateService {
+		t.Errorf("logged %v, expected the service to be created", entries[0])
+	}
+
+	if _, err = NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithLogger(nil)); err == nil {
+		t.Errorf("NewIPVSLBWithClient() expected an error for a nil logger")
+	}
+
+	logger = newRecordingLogger()
+	if _, err = NewIPVSLB("192.168.0.1", 6443, WithDryRun(), WithLogger(logger)); err != nil {
+		t.Fatalf("NewIPVSLB() error = %v", err)
+	}
+	if entries = *logger.entries; len(entries) == 0 || entries[0]["dry_run"] != true {
+		t.Errorf("logged %v, expected the dry-run client to use the logger", entries)
+	}
+}
+
+func TestWithBackendPort(t *testing.T) {
+	lb, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 443, WithBackendPort(6443))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if err = lb.AddBackendDefault("10.0.0.1"); err != nil {
+		t.Fatalf("AddBackendDefault() error = %v", err)
+	}
+	if err = lb.AddBackend("10.0.0.2", 6443); err != nil {
+		t.Errorf("AddBackend() error = %v, expected the backend port to be accepted", err)
+	}
+	if err = lb.AddBackend("10.0.0.3", 443); err == nil {
+		t.Errorf("AddBackend() expected an error for a port that conflicts with the backend port")
+	}
+	backends, _ := lb.ListBackends()
+	if len(backends) != 2 || backends[0].Port != 6443 || backends[1].Port != 6443 {
+		t.Errorf("ListBackends() = %+v, expected two backends on port 6443", backends)
+	}
+
+	if err = newTestLB(t, newFakeClient()).AddBackendDefault("10.0.0.1"); err == nil {
+		t.Errorf("AddBackendDefault() expected an error without a backend port")
+	}
+	if _, err = NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 443, WithBackendPort(0)); err == nil {
+		t.Errorf("NewIPVSLBWithClient() expected an error for an invalid backend port")
+	}
+}
+
+func TestWithStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{"lenient", nil, false},
+		{"strict", []Option{WithStrict()}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, tt.opts...)
+			if err != nil {
+				t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+			}
+			if err = lb.AddBackend("10.0.0.1", 6443); err != nil {
+				t.Fatalf("AddBackend() error = %v", err)
+			}
+			err = lb.AddBackendWithWeight("10.0.0.1", 6443, 5)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddBackendWithWeight() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, ErrAlreadyExists) {
+				t.Errorf("AddBackendWithWeight() error = %v, expected ErrAlreadyExists", err)
+			}
+			if backends, _ := lb.ListBackends(); len(backends) != 1 || backends[0].Weight != 1 {
+				t.Errorf("ListBackends() = %+v, expected the existing backend to be unchanged", backends)
+			}
+		})
+	}
+}
+
+func TestWithConflictMode(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      ConflictMode
+		scheduler Scheduler
+		wantErr   bool
+		wantKept  bool
+	}{
+		{"adopt matching", ConflictAdopt, SchedulerRR, false, true},
+		{"adopt re-creates a mismatch", ConflictAdopt, SchedulerWLC, false, false},
+		{"recreate matching", ConflictRecreate, SchedulerRR, false, false},
+		{"recreate mismatch", ConflictRecreate, SchedulerWLC, false, false},
+		{"fail adopts matching", ConflictFail, SchedulerRR, false, true},
+		{"fail on a mismatch", ConflictFail, SchedulerWLC, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient()
+			previous, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithScheduler(SchedulerRR))
+			if err != nil {
+				t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+			}
+			if err = previous.AddBackend("10.0.0.1", 6443); err != nil {
+				t.Fatalf("AddBackend() error = %v", err)
+			}
+
+			recreated := false
+			_, err = NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithScheduler(tt.scheduler), WithConflictMode(tt.mode), WithOnServiceRecreated(func(string, int) { recreated = true }))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewIPVSLBWithClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, ErrAlreadyExists) {
+				t.Errorf("NewIPVSLBWithClient() error = %v, expected ErrAlreadyExists", err)
+			}
+			if recreated == tt.wantKept {
+				t.Errorf("service re-created = %v, expected %v", recreated, !tt.wantKept)
+			}
+			// The backend of the previous service only survives if the service wasn't re-created
+			if backends, _ := previous.ListBackends(); (len(backends) == 1) != tt.wantKept {
+				t.Errorf("ListBackends() = %+v, expected the previous service to be kept = %v", backends, tt.wantKept)
+			}
+		})
+	}
+
+	if _, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithConflictMode(ConflictMode(10))); err == nil {
+		t.Errorf("NewIPVSLBWithClient() expected an error for an unknown conflict mode")
+	}
+}
+
+func TestWithSchedulerFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		scheduler Scheduler
+		protocol  string
+		flags     SchedulerFlags
+		wantErr   bool
+	}{
+		{"sh flags", SchedulerSH, "tcp", FlagSHPort | FlagSHFallback, false},
+		{"sh flags with wrr", SchedulerWRR, "tcp", FlagSHFallback, true},
+		{"one-packet udp", SchedulerWRR, "udp", FlagOnePacket, false},
+		{"one-packet tcp", SchedulerRR, "tcp", FlagOnePacket, true},
+		{"sh and one-packet udp", SchedulerSH, "udp", FlagSHPort | FlagOnePacket, false},
+		{"unknown flag", SchedulerRR, "tcp", SchedulerFlags(ipvs.ServicePersistent), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFakeClient()
+			lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithScheduler(tt.scheduler), WithProtocol(tt.protocol), WithSchedulerFlags(tt.flags))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewIPVSLBWithClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			existing, err := c.Service(lb.loadBalancerService)
+			if err != nil {
+				t.Fatalf("Service() error = %v", err)
+			}
+			if existing.Service.Flags != ipvs.Flags(tt.flags) {
+				t.Errorf("IPVS service flags = %#x, expected %#x", existing.Service.Flags, tt.flags)
+			}
+		})
+	}
+}
+
+// fakeResolver resolves hostnames from a map and counts the lookups
+type fakeResolver struct {
+	hosts   map[string][]string
+	lookups int
+}
+
+func (r *fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups++
+	addresses, ok := r.hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host")
+	}
+	addrs := make([]net.IPAddr, 0, len(addresses))
+	for _, address := range addresses {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(address)})
+	}
+	return addrs, nil
+}
+
+func TestWithHostnameResolution(t *testing.T) {
+	r := &fakeResolver{hosts: map[string][]string{
+		"node-1":  {"fd00::1", "10.0.0.1"},
+		"node-v6": {"fd00::2"},
+	}}
+	lb, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithHostnameResolution(r, time.Minute))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+
+	if err = lb.AddBackend("node-1", 6443); err != nil {
+		t.Fatalf("AddBackend() by hostname error = %v", err)
+	}
+	if ok, _ := lb.HasBackend("10.0.0.1", 6443); !ok {
+		t.Errorf("AddBackend() by hostname didn't register the IPv4 address")
+	}
+	if err = lb.AddBackend("node-1", 6443); err != nil || r.lookups != 1 {
+		t.Errorf("AddBackend() again error = %v with %d lookups, the address should be cached", err, r.lookups)
+	}
+
+	if err = lb.AddBackend("node-v6", 6443); !errors.Is(err, ErrFamilyMismatch) {
+		t.Errorf("AddBackend() of a hostname without an IPv4 address error = %v, want ErrFamilyMismatch", err)
+	}
+	if err = lb.AddBackend("missing", 6443); err == nil {
+		t.Errorf("AddBackend() of an unresolvable hostname should return an error")
+	}
+	// An IP address is never resolved
+	lookups := r.lookups
+	if err = lb.AddBackend("10.0.0.2", 6443); err != nil || r.lookups != lookups {
+		t.Errorf("AddBackend() by IP error = %v, lookups %d want %d", err, r.lookups, lookups)
+	}
+
+	// Once the TTL has passed the hostname is resolved again, but removal uses the address that was added
+	entry := lb.resolver.cache["node-1"]
+	entry.expires = time.Now().Add(-time.Second)
+	lb.resolver.cache["node-1"] = entry
+	r.hosts["node-1"] = []string{"10.0.0.3"}
+	if err = lb.RemoveBackend("node-1", 6443); err != nil {
+		t.Fatalf("RemoveBackend() by hostname error = %v", err)
+	}
+	if ok, _ := lb.HasBackend("10.0.0.1", 6443); ok {
+		t.Errorf("RemoveBackend() by hostname didn't remove the cached address")
+	}
+	if err = lb.AddBackend("node-1", 6443); err != nil {
+		t.Fatalf("AddBackend() after the TTL error = %v", err)
+	}
+	if ok, _ := lb.HasBackend("10.0.0.3", 6443); !ok {
+		t.Errorf("AddBackend() after the TTL didn't resolve the new address")
+	}
+
+	if _, err = NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithHostnameResolution(nil, 0)); err == nil {
+		t.Errorf("WithHostnameResolution() with a zero TTL should return an error")
+	}
+}
+
+func TestWithOnNoBackends(t *testing.T) {
+	logger := newRecordingLogger()
+	var calls []string
+	lb, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithLogger(logger), WithOnNoBackends(func(vip string, port int) { calls = append(calls, backendKey(vip, port)) }))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	warnings := func() int {
+		count := 0
+		for _, entry := range *logger.entries {
+			if strings.Contains(entry["msg"].(string), "no backends") {
+				count++
+			}
+		}
+		return count
+	}
+
+	// A load balancer that starts without backends isn't reported
+	if _, err = lb.SyncBackends(nil); err != nil {
+		t.Fatalf("SyncBackends() error = %v", err)
+	}
+	for _, address := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err = lb.AddBackend(address, 6443); err != nil {
+			t.Fatalf("AddBackend() error = %v", err)
+		}
+	}
+	if err = lb.RemoveBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	if len(calls) != 0 || warnings() != 0 {
+		t.Fatalf("the callback was called %d times with %d warnings before the last backend was removed", len(calls), warnings())
+	}
+
+	if err = lb.RemoveBackend("10.0.0.2", 6443); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	if _, err = lb.SyncBackends(nil); err != nil {
+		t.Fatalf("SyncBackends() error = %v", err)
+	}
+	if len(calls) != 1 || calls[0] != "192.168.0.1:6443" || warnings() != 1 {
+		t.Errorf("the callback was called with %v and %d warnings, expected once on removing the last backend", calls, warnings())
+	}
+
+	// Once a backend is added again the next transition to no backends is reported
+	if err = lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	if _, err = lb.SyncBackends(nil); err != nil {
+		t.Fatalf("SyncBackends() error = %v", err)
+	}
+	if len(calls) != 2 || warnings() != 2 {
+		t.Errorf("the callback was called %d times with %d warnings, expected twice", len(calls), warnings())
+	}
+}
+
+// stuckClient is a fake client whose CreateDestination blocks until it is released
+type stuckClient struct {
+	*fakeClient
+	release chan struct{}
+}
+
+func (c *stuckClient) CreateDestination(svc ipvs.Service, dst ipvs.Destination) error {
+	<-c.release
+	return c.fakeClient.CreateDestination(svc, dst)
+}
+
+func TestWithOperationTimeout(t *testing.T) {
+	c := &stuckClient{fakeClient: newFakeClient(), release: make(chan struct{})}
+	lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithOperationTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+
+	start := time.Now()
+	err = lb.AddBackend("10.0.0.1", 6443)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("AddBackend() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("AddBackend() returned after %s, expected the timeout", elapsed)
+	}
+	// The load balancer isn't left locked by the stuck call
+	if _, err = lb.ListBackends(); err != nil {
+		t.Errorf("ListBackends() error = %v", err)
+	}
+	close(c.release)
+
+	if _, err = NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithOperationTimeout(0)); err == nil {
+		t.Errorf("WithOperationTimeout() with a zero timeout should return an error")
+	}
+}
+
+// stuckDestinationsClient is a fake client whose Destinations blocks until it is released
+type stuckDestinationsClient struct {
+	*fakeClient
+	release chan struct{}
+}
+
+func (c *stuckDestinationsClient) Destinations(svc ipvs.Service) ([]ipvs.DestinationExtended, error) {
+	<-c.release
+	return c.fakeClient.Destinations(svc)
+}
+
+func TestOperationTimeoutResult(t *testing.T) {
+	c := &stuckDestinationsClient{fakeClient: newFakeClient(), release: make(chan struct{})}
+	lb := newTestLB(t, c.fakeClient)
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	timeout := &timeoutClient{Client: c, timeout: 20 * time.Millisecond}
+
+	// The result of a call that timed out is never returned, even once the call completes
+	dsts, err := timeout.Destinations(lb.loadBalancerService)
+	if !errors.Is(err, context.DeadlineExceeded) || dsts != nil {
+		t.Fatalf("Destinations() = %+v, %v, expected no destinations and context.DeadlineExceeded", dsts, err)
+	}
+	close(c.release)
+
+	if dsts, err = timeout.Destinations(lb.loadBalancerService); err != nil || len(dsts) != 1 {
+		t.Errorf("Destinations() = %+v, %v, expected the backend", dsts, err)
+	}
+}
+
+func TestWithSourceAddress(t *testing.T) {
+	lb, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithSourceAddress("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if !lb.SourceAddress().Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("SourceAddress() = %s, expected 127.0.0.1", lb.SourceAddress())
+	}
+	if p, ok := defaultProber(lb.Protocol(), lb.SourceAddress()).(TCPProber); !ok || !p.Source.Equal(lb.SourceAddress()) {
+		t.Errorf("the default prober should be sent from the source address")
+	}
+
+	// The TCP probe is sent from the source address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = (TCPProber{Source: lb.SourceAddress()}).Probe(ctx, "127.0.0.1", listener.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Errorf("Probe() from the source address error = %v", err)
+	}
+
+	if _, err = NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithSourceAddress("192.0.2.250")); err == nil {
+		t.Errorf("WithSourceAddress() of an address that isn't local should return an error")
+	}
+	if _, err = NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithSourceAddress("::1")); !errors.Is(err, ErrFamilyMismatch) {
+		t.Errorf("WithSourceAddress() of another address family error = %v, want ErrFamilyMismatch", err)
+	}
+	if _, err = NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithSourceAddress("bogus")); err == nil {
+		t.Errorf("WithSourceAddress() of an invalid address should return an error")
+	}
+}
+
+func TestWithPersistenceNetmask(t *testing.T) {
+	c := newFakeClient()
+	lb, err := NewIPVSLBWithClient(c, "192.168.0.1", 6443, WithPersistence(time.Minute), WithPersistenceNetmask(24))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	svc, _ := c.Service(lb.loadBalancerService)
+	if svc.Netmask != (ipvs.IPMask{255, 255, 255, 0}) {
+		t.Errorf("WithPersistenceNetmask() set netmask %v, expected 255.255.255.0", svc.Netmask)
+	}
+	if n := lb.ServiceSpec().PersistenceNetmask; n != 24 {
+		t.Errorf("ServiceSpec().PersistenceNetmask = %d, expected 24", n)
+	}
+
+	if _, err = NewIPVSLBWithClient(newFakeClient(), "fd00::1", 6443, WithPersistence(time.Minute), WithPersistenceNetmask(64)); err != nil {
+		t.Errorf("WithPersistenceNetmask() of an IPv6 prefix error = %v", err)
+	}
+	if _, err = NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithPersistence(time.Minute), WithPersistenceNetmask(64)); !errors.Is(err, ErrFamilyMismatch) {
+		t.Errorf("WithPersistenceNetmask() of an IPv6 prefix for an IPv4 VIP error = %v, want ErrFamilyMismatch", err)
+	}
+	if _, err = NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithPersistenceNetmask(24)); err == nil {
+		t.Errorf("WithPersistenceNetmask() without persistence should return an error")
+	}
+	if _, err = NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithPersistence(time.Minute), WithPersistenceNetmask(0)); err == nil {
+		t.Errorf("WithPersistenceNetmask() of an invalid prefix length should return an error")
+	}
+}
+
+func TestWithRegistry(t *testing.T) {
+	unregistered := newTestLB(t, newFakeClient())
+	first, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithRegistry())
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	second, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.2", 6443, WithRegistry())
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+
+	managed := ListManagedBalancers()
+	if len(managed) != 2 || managed[0] != first || managed[1] != second {
+		t.Fatalf("ListManagedBalancers() = %v, expected the registered load balancers", managed)
+	}
+	if err = unregistered.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if err = first.RemoveIPVSLB(); err != nil {
+		t.Fatalf("RemoveIPVSLB() error = %v", err)
+	}
+	if managed = ListManagedBalancers(); len(managed) != 1 || managed[0] != second {
+		t.Errorf("ListManagedBalancers() = %v, expected the removed load balancer to be deregistered", managed)
+	}
+	if err = second.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if managed = ListManagedBalancers(); len(managed) != 0 {
+		t.Errorf("ListManagedBalancers() = %v, expected the closed load balancer to be deregistered", managed)
+	}
+}
+
+func TestWithTopologyValidation(t *testing.T) {
+	defer func(fn func() ([]net.Addr, error)) { interfaceAddrs = fn }(interfaceAddrs)
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("192.168.0.10"), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("192.168.0.1"), Mask: net.CIDRMask(32, 32)},
+		}, nil
+	}
+
+	tests := []struct {
+		name    string
+		vip     string
+		backend string
+		fwd     ipvs.ForwardType
+		problem bool
+	}{
+		{"local with a local VIP", "192.168.0.1", "10.0.0.1", ipvs.Local, false},
+		{"local without a local VIP", "192.168.1.1", "10.0.0.1", ipvs.Local, true},
+		{"direct routing on the VIP subnet", "192.168.0.1", "192.168.0.20", ipvs.DirectRoute, false},
+		{"direct routing off the VIP subnet", "192.168.0.1", "10.0.0.1", ipvs.DirectRoute, true},
+		{"direct routing to a loopback", "192.168.1.1", "127.0.0.2", ipvs.DirectRoute, true},
+		{"masquerading isn't checked", "192.168.1.1", "10.0.0.1", ipvs.Masquarade, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := newRecordingLogger()
+			lb, err := NewIPVSLBWithClient(newFakeClient(), tt.vip, 6443, WithTopologyValidation(), WithLogger(logger))
+			if err != nil {
+				t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+			}
+			if err = lb.AddBackendWithForwardMethod(tt.backend, 6443, 1, tt.fwd); err != nil {
+				t.Fatalf("AddBackendWithForwardMethod() error = %v, expected only a warning", err)
+			}
+			warned := false
+			for _, entry := range *logger.entries {
+				if strings.Contains(fmt.Sprint(entry["msg"]), "likely misconfigured") {
+					warned = true
+				}
+			}
+			if warned != tt.problem {
+				t.Errorf("warned = %t, expected %t", warned, tt.problem)
+			}
+
+			strict, err := NewIPVSLBWithClient(newFakeClient(), tt.vip, 6443, WithTopologyValidation(), WithStrict())
+			if err != nil {
+				t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+			}
+			if err = strict.AddBackendWithForwardMethod(tt.backend, 6443, 1, tt.fwd); (err != nil) != tt.problem {
+				t.Errorf("AddBackendWithForwardMethod() in strict mode error = %v, expected a problem %t", err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestWithRemoveGracePeriod(t *testing.T) {
+	if _, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithRemoveGracePeriod(-time.Second)); err == nil {
+		t.Errorf("WithRemoveGracePeriod() accepted a negative grace period")
+	}
+
+	// By default the backend is removed immediately
+	lb := newTestLB(t, newFakeClient())
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	if err := lb.RemoveBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	if backends := mustListBackends(t, lb); len(backends) != 0 {
+		t.Errorf("RemoveBackend() left %+v, expected no backends", backends)
+	}
+
+	// With a grace period the backend is quiesced before it is removed
+	lb, err := NewIPVSLBWithClient(newFakeClient(), "192.168.0.1", 6443, WithRemoveGracePeriod(time.Minute))
+	if err != nil {
+		t.Fatalf("NewIPVSLBWithClient() error = %v", err)
+	}
+	if err = lb.AddBackendWithWeight("10.0.0.1", 6443, 5); err != nil {
+		t.Fatalf("AddBackendWithWeight() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- lb.RemoveBackendContext(ctx, "10.0.0.1", 6443) }()
+	waitFor(t, "the backend to be quiesced", func() bool {
+		backend, ok := backendsByKey(mustListBackends(t, lb))["10.0.0.1:6443"]
+		return ok && backend.Weight == 0
+	})
+	cancel()
+	if err = <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("RemoveBackendContext() error = %v, expected the context error", err)
+	}
+	if ok, _ := lb.HasBackend("10.0.0.1", 6443); !ok {
+		t.Errorf("RemoveBackendContext() removed the backend before the grace period passed")
+	}
+
+	lb.removeGracePeriod = time.Millisecond
+	if err = lb.RemoveBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	if backends := mustListBackends(t, lb); len(backends) != 0 {
+		t.Errorf("RemoveBackend() left %+v, expected no backends", backends)
+	}
+	if err = lb.RemoveBackend("10.0.0.1", 6443); err != nil {
+		t.Errorf("RemoveBackend() of a missing backend error = %v, expected nil", err)
+	}
+}
@@ -0,0 +1,170 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/cloudflare/ipvs"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// AddPort will create an IPVS service for an additional port on the VIP, the new port will share the
+// backends of the load balancer and any existing backends are added to it
+func (lb *IPVSLoadBalancer) AddPort(port int) error {
+	if err := validatePort(port); err != nil {
+		return err
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.loadBalancerService.FWMark != 0 {
+		return fmt.Errorf("a firewall mark service matches every port, additional ports can't be added")
+	}
+	if _, ok := lb.portServices[port]; ok || port == lb.Port {
+		return fmt.Errorf("port [%d] is already configured on the load balancer", port)
+	}
+
+	svc := lb.loadBalancerService
+	svc.Port = uint16(port)
+	err := lb.retry(context.Background(), opCreateService, func() error { return lb.client.CreateService(svc) })
+	if err != nil {
+		return newError(opCreateService, svc, "", err)
+	}
+
+	// Copy the existing backends to the new port, the port is only registered once every backend has been
+	// copied so that a failure leaves the load balancer unchanged
+	if err = lb.copyBackends(svc); err != nil {
+		if rmErr := lb.retry(context.Background(), opRemoveService, func() error { return lb.client.RemoveService(svc) }); rmErr != nil && !isNotFound(rmErr) {
+			return fmt.Errorf("%w, unable to remove the service of the port [%v]", err, rmErr)
+		}
+		return err
+	}
+	lb.portServices[port] = svc
+	return nil
+}
+
+// copyBackends adds the backends of the primary service to the service of an additional port, the caller
+// must hold the write lock
+func (lb *IPVSLoadBalancer) copyBackends(svc ipvs.Service) error {
+	dsts, err := lb.client.Destinations(lb.loadBalancerService)
+	if err != nil {
+		return newError(opAddBackend, svc, "", fmt.Errorf("error listing backends: %w", err))
+	}
+	for x := range dsts {
+		dst := dsts[x].Destination
+		err = lb.retry(context.Background(), opAddBackend, func() error { return lb.client.CreateDestination(svc, dst) })
+		if err != nil && !isExists(err) {
+			backend := backendKey(dsts[x].Address.Net(dsts[x].Family).String(), int(dsts[x].Port))
+			return newError(opAddBackend, svc, backend, err)
+		}
+	}
+	return nil
+}
+
+// RemovePort will remove the IPVS service for an additional port, the port the load balancer was
+// created with can only be removed with RemoveIPVSLB
+func (lb *IPVSLoadBalancer) RemovePort(port int) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if port == lb.Port {
+		return fmt.Errorf("port [%d] is the primary port of the load balancer, use RemoveIPVSLB to remove it", port)
+	}
+	svc, ok := lb.portServices[port]
+	if !ok {
+		return fmt.Errorf("port [%d] is not configured on the load balancer", port)
+	}
+
+	err := lb.retry(context.Background(), opRemoveService, func() error { return lb.client.RemoveService(svc) })
+	if err != nil {
+		return newError(opRemoveService, svc, "", err)
+	}
+	delete(lb.portServices, port)
+	return nil
+}
+
+// RemoveBackendAllPorts will remove every backend with the address (such as a node that has gone) from the
+// service of every port of the VIP, whichever port the backends listen on. A backend that isn't registered
+// with a service is treated as removed, the failures of every service are returned together.
+func (lb *IPVSLoadBalancer) RemoveBackendAllPorts(address string) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+
+	resolved, err := lb.resolveBackend(context.Background(), address, true)
+	if err != nil {
+		return err
+	}
+	ip, _, err := parseAddress(resolved)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	failed := map[string]bool{}
+	for _, svc := range lb.services() {
+		svc := svc
+		dsts, err := lb.client.Destinations(svc)
+		if err != nil {
+			errs = append(errs, newError(opRemoveBackend, svc, "", err))
+			continue
+		}
+		for x := range dsts {
+			dst := dsts[x].Destination
+			if !dst.Address.Net(dst.Family).Equal(ip) {
+				continue
+			}
+			key := backendKey(ip.String(), int(dst.Port))
+			err = lb.retry(context.Background(), opRemoveBackend, func() error { return lb.client.RemoveDestination(svc, dst) })
+			if err != nil && !isNotFound(err) {
+				recordOperation(opRemoveBackend, err)
+				errs = append(errs, newError(opRemoveBackend, svc, key, err))
+				failed[key] = true
+				continue
+			}
+			recordOperation(opRemoveBackend, nil)
+		}
+	}
+
+	// The backends are only forgotten once they have been removed from every port
+	for key, backend := range lb.desired {
+		if !failed[key] && net.ParseIP(backend.Address).Equal(ip) {
+			delete(lb.sctpAddresses, key)
+			delete(lb.health, key)
+			delete(lb.desired, key)
+			lb.logEntry(opRemoveBackend).WithField("backend", key).Debug("removed backend from every port")
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// Ports returns all of the ports that the load balancer is serving, starting with the primary port
+func (lb *IPVSLoadBalancer) Ports() []int {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	var ports []int
+	for _, svc := range lb.services() {
+		ports = append(ports, int(svc.Port))
+	}
+	return ports
+}
+
+// services returns the IPVS services for every port, starting with the primary service, the caller
+// must hold the lock
+func (lb *IPVSLoadBalancer) services() []ipvs.Service {
+	ports := make([]int, 0, len(lb.portServices))
+	for port := range lb.portServices {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	svcs := []ipvs.Service{lb.loadBalancerService}
+	for _, port := range ports {
+		svcs = append(svcs, lb.portServices[port])
+	}
+	return svcs
+}
@@ -0,0 +1,52 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// ErrIPVSUnavailable is returned when the IPVS kernel module isn't loaded
+var ErrIPVSUnavailable = errors.New("the IPVS kernel module isn't loaded, load it with `modprobe ip_vs`")
+
+var (
+	// ipvsProcPath is created by the kernel for every network namespace once IPVS is loaded
+	ipvsProcPath = "/proc/net/ip_vs"
+	// ipvsModulePath exists once IPVS is loaded (as a module or built into the kernel)
+	ipvsModulePath = "/sys/module/ip_vs"
+)
+
+// checkIPVS returns ErrIPVSUnavailable if the IPVS kernel module isn't loaded, so that the cause is clear
+// rather than the netlink error from a missing IPVS family. The check is skipped (returning nil) when it
+// can't be determined, such as when /proc isn't mounted.
+func checkIPVS() error {
+	if _, err := os.Stat(ipvsProcPath); err == nil || !os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Dir(ipvsProcPath)); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(ipvsModulePath); err == nil {
+		return nil
+	}
+	return ErrIPVSUnavailable
+}
+
+// newIPVSClient will check that IPVS is available and create an IPVS client
+func newIPVSClient() (ipvs.Client, error) {
+	if err := checkIPVS(); err != nil {
+		return nil, err
+	}
+	c, err := ipvs.New()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// The generic netlink family doesn't exist without the module
+			return nil, fmt.Errorf("error creating IPVS client, the IPVS kernel module may not be loaded (modprobe ip_vs): %w", err)
+		}
+		return nil, fmt.Errorf("error creating IPVS client: %w", err)
+	}
+	return c, nil
+}
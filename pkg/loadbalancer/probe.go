@@ -0,0 +1,134 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ErrProbeUnsupported is returned by a Prober that can't probe a backend on this host (such as SCTP without
+// kernel support), the health checker logs it and leaves the health of the backend unchanged
+var ErrProbeUnsupported = errors.New("health check probe is not supported")
+
+// Prober probes the health of a single backend, the context is done once the probe timeout has passed.
+// A nil error is a healthy backend, any other error is a failed probe apart from ErrProbeUnsupported.
+type Prober interface {
+	Probe(ctx context.Context, address string, port int) error
+}
+
+// ProbeFunc is a function that satisfies Prober
+type ProbeFunc func(ctx context.Context, address string, port int) error
+
+// Probe calls the function
+func (f ProbeFunc) Probe(ctx context.Context, address string, port int) error {
+	return f(ctx, address, port)
+}
+
+// TCPProber probes a backend by establishing a TCP connection
+type TCPProber struct {
+	// Source is the local address the probe is sent from, the kernel chooses it when it is nil
+	Source net.IP
+}
+
+// Probe will connect to the backend
+func (p TCPProber) Probe(ctx context.Context, address string, port int) error {
+	d := net.Dialer{}
+	if p.Source != nil {
+		d.LocalAddr = &net.TCPAddr{IP: p.Source}
+	}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// UDPProber probes a UDP backend. Without a Request an empty datagram is sent and only an explicit rejection
+// (ICMP port unreachable) is considered a failure, as most UDP services don't respond to unknown datagrams.
+// With a Request (an application level probe, such as a DNS query) the backend must respond before the
+// timeout, and the response must begin with Response if it is set.
+type UDPProber struct {
+	Request  []byte
+	Response []byte
+	// Source is the local address the probe is sent from, the kernel chooses it when it is nil
+	Source net.IP
+}
+
+// Probe will send the request to the backend
+func (p UDPProber) Probe(ctx context.Context, address string, port int) error {
+	d := net.Dialer{}
+	if p.Source != nil {
+		d.LocalAddr = &net.UDPAddr{IP: p.Source}
+	}
+	conn, err := d.DialContext(ctx, "udp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	if _, err = conn.Write(p.Request); err != nil {
+		return err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if len(p.Request) == 0 {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("no response to the UDP probe: %w", err)
+	}
+	if !bytes.HasPrefix(buf[:n], p.Response) {
+		return fmt.Errorf("unexpected response to the UDP probe")
+	}
+	return nil
+}
+
+// SCTPProber probes a backend by establishing an SCTP association, it requires SCTP support in the kernel
+// (the sctp module) and otherwise returns ErrProbeUnsupported
+type SCTPProber struct {
+	// Source is the local address the probe is sent from, the kernel chooses it when it is nil
+	Source net.IP
+}
+
+// Probe will establish (and shut down) an association with the backend
+func (p SCTPProber) Probe(ctx context.Context, address string, port int) error {
+	ip, _, err := parseAddress(address)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return ctx.Err()
+		}
+	}
+	return probeSCTP(p.Source, ip, port, timeout)
+}
+
+// defaultProber returns the prober used for a protocol when the health check config has no Prober, sending
+// the probes from the source address (if set). Nil is returned for a firewall mark service as it has no
+// single protocol.
+func defaultProber(protocol string, source net.IP) Prober {
+	switch protocol {
+	case "tcp":
+		return TCPProber{Source: source}
+	case "udp":
+		return UDPProber{Source: source}
+	case "sctp":
+		return SCTPProber{Source: source}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+// SCTP isn't supported by the Go net package so the association is established with the socket API directly,
+// this is only supported on Linux so other OS's will use probe_sctp_unsupported.go
+
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// probeSCTP establishes an SCTP association with a backend within the timeout (0 is no timeout), from the
+// source address if it is set
+func probeSCTP(source, ip net.IP, port int, timeout time.Duration) error {
+	family := unix.AF_INET6
+	if ip.To4() != nil {
+		family = unix.AF_INET
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err != nil {
+		if errors.Is(err, unix.EPROTONOSUPPORT) || errors.Is(err, unix.ESOCKTNOSUPPORT) || errors.Is(err, unix.EAFNOSUPPORT) {
+			return fmt.Errorf("%w, the kernel doesn't support SCTP (modprobe sctp): %v", ErrProbeUnsupported, err)
+		}
+		return err
+	}
+	defer unix.Close(fd)
+
+	if source != nil {
+		if err = unix.Bind(fd, sockaddr(source, 0)); err != nil {
+			return fmt.Errorf("unable to bind the SCTP probe to the source address [%s]: %w", source, err)
+		}
+	}
+	err = unix.Connect(fd, sockaddr(ip, port))
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, unix.EINPROGRESS) {
+		return err
+	}
+
+	ms := -1
+	if timeout > 0 {
+		ms = int(timeout / time.Millisecond)
+	}
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+	for {
+		n, err := unix.Poll(fds, ms)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("SCTP association with [%s] timed out", backendKey(ip.String(), port))
+		}
+		break
+	}
+	soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if soErr != 0 {
+		return unix.Errno(soErr)
+	}
+	return nil
+}
+
+// sockaddr returns the socket address of an IP and port
+func sockaddr(ip net.IP, port int) unix.Sockaddr {
+	if ip4 := ip.To4(); ip4 != nil {
+		addr := &unix.SockaddrInet4{Port: port}
+		copy(addr.Addr[:], ip4)
+		return addr
+	}
+	addr := &unix.SockaddrInet6{Port: port}
+	copy(addr.Addr[:], ip.To16())
+	return addr
+}
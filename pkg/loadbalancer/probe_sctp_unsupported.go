@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// probeSCTP is only supported on Linux
+func probeSCTP(source, ip net.IP, port int, timeout time.Duration) error {
+	return fmt.Errorf("%w, SCTP probes are only supported on Linux", ErrProbeUnsupported)
+}
@@ -0,0 +1,92 @@
+package loadbalancer
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// backendsGauge is the number of backends registered with each IPVS service
+	backendsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kube_vip",
+		Subsystem: "ipvs",
+		Name:      "backends",
+		Help:      "Number of backends registered with the IPVS service",
+	}, []string{"vip", "port"})
+
+	// noBackendsGauge is 1 whilst the IPVS service of the VIP has no backends (so it black-holes traffic)
+	noBackendsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kube_vip",
+		Subsystem: "ipvs",
+		Name:      "no_backends",
+		Help:      "Whether the IPVS service has no backends and is dropping traffic (1) or not (0)",
+	}, []string{"vip", "port"})
+
+	// operationsCounter counts the operations applied to IPVS categorised by operation
+	operationsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kube_vip",
+		Subsystem: "ipvs",
+		Name:      "operations_total",
+		Help:      "Count all operations applied to IPVS categorised by operation",
+	}, []string{"operation"})
+
+	// operationErrorsCounter counts the operations that failed categorised by operation
+	operationErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kube_vip",
+		Subsystem: "ipvs",
+		Name:      "operation_errors_total",
+		Help:      "Count all failed operations applied to IPVS categorised by operation",
+	}, []string{"operation"})
+)
+
+// Operations that are recorded in the metrics and logs
+const (
+	opCreateService = "create_service"
+	opAddBackend    = "add_backend"
+	opRemoveBackend = "remove_backend"
+	opUpdateBackend = "update_backend"
+	opRemoveService = "remove_service"
+	opUpdateService = "update_service"
+	opDrainBackend  = "drain_backend"
+	opSyncBackends  = "sync_backends"
+)
+
+// PrometheusCollector defines the IPVS load balancer metrics
+func PrometheusCollector() []prometheus.Collector {
+	return []prometheus.Collector{backendsGauge, noBackendsGauge, operationsCounter, operationErrorsCounter}
+}
+
+// recordOperation counts an operation and whether it failed
+func recordOperation(operation string, err error) {
+	operationsCounter.With(prometheus.Labels{"operation": operation}).Inc()
+	if err != nil {
+		operationErrorsCounter.With(prometheus.Labels{"operation": operation}).Inc()
+	}
+}
+
+// updateBackendsGauge sets the number of backends for each service once the backends have been modified,
+// returning the number of backends of the primary service (or -1 if they couldn't be read). The caller must
+// hold the lock.
+func (lb *IPVSLoadBalancer) updateBackendsGauge() int {
+	count := -1
+	for _, svc := range lb.services() {
+		dsts, err := lb.client.Destinations(svc)
+		if err != nil {
+			continue
+		}
+		backendsGauge.With(lb.serviceLabels(int(svc.Port))).Set(float64(len(dsts)))
+		if svc == lb.loadBalancerService {
+			count = len(dsts)
+		}
+	}
+	return count
+}
+
+// serviceLabels returns the metric labels for a service port
+func (lb *IPVSLoadBalancer) serviceLabels(port int) prometheus.Labels {
+	return prometheus.Labels{
+		"vip":  lb.loadBalancerService.Address.Net(lb.loadBalancerService.Family).String(),
+		"port": strconv.Itoa(port),
+	}
+}
@@ -0,0 +1,233 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/ipvs"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// opReconcile is the operation used in the reconciler logs
+const opReconcile = "reconcile"
+
+// maxReconcileBackoff is the longest interval that RunReconciler backs off to whilst SyncBackends is
+// failing, unless the interval itself is longer
+const maxReconcileBackoff = 5 * time.Minute
+
+// Reconcile will compare the IPVS destinations of every port of the load balancer with the backends as
+// they were last applied by the load balancer, and correct any drift (such as a backend changed with
+// ipvsadm). Missing backends are re-added, unknown backends are removed and any changed weight, forwarding
+// method or thresholds is restored (along with the tunnel of a re-added or restored tunnelled backend, as
+// the ipvs client can't read it), each correction is logged. Only the services of the load balancer
+// are read and changed, so other IPVS services are never touched. The weight of a backend quiesced by
+// the health checker is left to the health checker.
+func (lb *IPVSLoadBalancer) Reconcile() (SyncResult, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+
+	var result SyncResult
+	var errs []error
+	added, removed, updated := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, svc := range lb.services() {
+		svc := svc
+		dsts, err := lb.client.Destinations(svc)
+		if err != nil {
+			return result, newError(opReconcile, svc, "", fmt.Errorf("error listing backends: %w", err))
+		}
+
+		actual := make(map[string]ipvs.DestinationExtended, len(dsts))
+		for x := range dsts {
+			actual[backendKey(dsts[x].Address.Net(dsts[x].Family).String(), int(dsts[x].Port))] = dsts[x]
+		}
+
+		for key, backend := range lb.desired {
+			dst, err := backendDestination(backend)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			logEntry := lb.serviceLog(svc, opReconcile).WithField("backend", key)
+
+			existing, ok := actual[key]
+			if !ok {
+				if lb.isQuiesced(key) {
+					dst.Weight = 0
+				}
+				err = lb.retry(context.Background(), opAddBackend, func() error { return lb.client.CreateDestination(svc, dst) })
+				if err != nil && !isExists(err) {
+					errs = append(errs, newError(opAddBackend, svc, key, err))
+					continue
+				}
+				if err = lb.reapplyTunnel(svc, key, dst, backend); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				logEntry.Warn("backend was removed from IPVS outside of the load balancer, re-added it")
+				if !added[key] {
+					added[key] = true
+					result.Added = append(result.Added, backend)
+				}
+				continue
+			}
+
+			if lb.isQuiesced(key) {
+				dst.Weight = existing.Weight
+			}
+			if existing.Destination == dst {
+				continue
+			}
+			err = lb.retry(context.Background(), opUpdateBackend, func() error { return lb.client.UpdateDestination(svc, dst) })
+			if err != nil {
+				errs = append(errs, newError(opUpdateBackend, svc, key, err))
+				continue
+			}
+			if err = lb.reapplyTunnel(svc, key, dst, backend); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			logEntry.WithFields(Fields{"weight": existing.Weight, "desired_weight": dst.Weight}).Warn("backend was changed in IPVS outside of the load balancer, restored it")
+			if !updated[key] {
+				updated[key] = true
+				result.Updated = append(result.Updated, backend)
+			}
+		}
+
+		for key, existing := range actual {
+			if _, ok := lb.desired[key]; ok {
+				continue
+			}
+			dst := existing.Destination
+			err = lb.retry(context.Background(), opRemoveBackend, func() error { return lb.client.RemoveDestination(svc, dst) })
+			if err != nil && !isNotFound(err) {
+				errs = append(errs, newError(opRemoveBackend, svc, key, err))
+				continue
+			}
+			lb.serviceLog(svc, opReconcile).WithField("backend", key).Warn("backend was added to IPVS outside of the load balancer, removed it")
+			if !removed[key] {
+				removed[key] = true
+				result.Removed = append(result.Removed, destinationBackend(existing.Destination))
+			}
+		}
+	}
+	return result, utilerrors.NewAggregate(errs)
+}
+
+// RunReconciler is a control loop that calls SyncBackends with the backends returned by desiredFn
+// immediately and then every interval, until the context is done (the context error is returned). A failed
+// sync is logged and the loop keeps running, backing off by doubling the interval up to 5 minutes (or the
+// interval if it is longer) until a sync succeeds. The desired function is called from the loop, so it
+// must be safe to call from another goroutine.
+func (lb *IPVSLoadBalancer) RunReconciler(ctx context.Context, interval time.Duration, desiredFn func() []Backend) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid reconcile interval [%s], must be a positive duration", interval)
+	}
+	if desiredFn == nil {
+		return fmt.Errorf("the reconciler requires a function returning the desired backends")
+	}
+	maxBackoff := maxReconcileBackoff
+	if interval > maxBackoff {
+		maxBackoff = interval
+	}
+
+	current := interval
+	t := lb.clock.NewTicker(current)
+	defer func() { t.Stop() }()
+	failures := 0
+	for {
+		next := interval
+		result, err := lb.SyncBackends(desiredFn())
+		if err != nil {
+			failures++
+			next = current * 2
+			if next > maxBackoff {
+				next = maxBackoff
+			}
+			lb.logEntry(opReconcile).WithFields(Fields{"failures": failures, "interval": next}).Errorf("unable to sync the backends [%v]", err)
+		} else {
+			if failures != 0 {
+				lb.logEntry(opReconcile).WithField("failures", failures).Info("synced the backends after failing")
+			}
+			failures = 0
+			if len(result.Added)+len(result.Removed)+len(result.Updated) != 0 {
+				lb.logEntry(opReconcile).WithFields(Fields{"added": len(result.Added), "removed": len(result.Removed), "updated": len(result.Updated)}).
+					Info("synced the backends")
+			}
+		}
+		if next != current {
+			t.Stop()
+			current = next
+			t = lb.clock.NewTicker(current)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C():
+		}
+	}
+}
+
+// reapplyTunnel sets the tunnel of a backend again once its destination has been re-added or updated, as
+// the ipvs client doesn't send the tunnel so the kernel resets it to IPIP. The caller must hold the write lock.
+func (lb *IPVSLoadBalancer) reapplyTunnel(svc ipvs.Service, key string, dst ipvs.Destination, backend Backend) error {
+	if backend.FwdMethod != ipvs.Tunnel || backend.Tunnel.Type == TunnelIPIP {
+		return nil
+	}
+	return lb.setBackendTunnel(svc, key, dst, backend.Tunnel)
+}
+
+// setDesired records a backend as it has been applied, the caller must hold the write lock
+func (lb *IPVSLoadBalancer) setDesired(backend Backend) {
+	if lb.desired == nil {
+		lb.desired = map[string]Backend{}
+	}
+	lb.desired[backendKey(backend.Address, backend.Port)] = Backend{
+		Address:        backend.Address,
+		Port:           backend.Port,
+		Weight:         backend.Weight,
+		FwdMethod:      backend.FwdMethod,
+		UpperThreshold: backend.UpperThreshold,
+		LowerThreshold: backend.LowerThreshold,
+		Tunnel:         backend.Tunnel,
+	}
+}
+
+// setDesiredWeight records the weight of a backend as it has been applied, the caller must hold the write lock
+func (lb *IPVSLoadBalancer) setDesiredWeight(key string, weight int) {
+	if backend, ok := lb.desired[key]; ok {
+		backend.Weight = weight
+		lb.desired[key] = backend
+	}
+}
+
+// backendDestination returns the IPVS destination of a backend
+func backendDestination(backend Backend) (ipvs.Destination, error) {
+	ip, family, err := parseAddress(backend.Address)
+	if err != nil {
+		return ipvs.Destination{}, err
+	}
+	return ipvs.Destination{
+		Address:        ipvs.NewIP(ip),
+		Port:           uint16(backend.Port),
+		Family:         family,
+		Weight:         uint32(backend.Weight),
+		FwdMethod:      backend.FwdMethod,
+		UpperThreshold: uint32(backend.UpperThreshold),
+		LowerThreshold: uint32(backend.LowerThreshold),
+	}, nil
+}
+
+// destinationBackend returns the backend of an IPVS destination
+func destinationBackend(dst ipvs.Destination) Backend {
+	return Backend{
+		Address:        dst.Address.Net(dst.Family).String(),
+		Port:           int(dst.Port),
+		Weight:         int(dst.Weight),
+		FwdMethod:      dst.FwdMethod,
+		UpperThreshold: int(dst.UpperThreshold),
+		LowerThreshold: int(dst.LowerThreshold),
+	}
+}
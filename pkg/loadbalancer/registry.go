@@ -0,0 +1,46 @@
+package loadbalancer
+
+import "sync"
+
+// registry tracks the live load balancers that were created WithRegistry
+var registry = struct {
+	mu        sync.Mutex
+	balancers []*IPVSLoadBalancer
+}{}
+
+// WithRegistry registers the load balancer in the package registry once it has been created, so that it is
+// returned by ListManagedBalancers (such as for an inventory of the VIPs served by the process) until it is
+// removed with RemoveIPVSLB or Close
+func WithRegistry() Option {
+	return func(lb *IPVSLoadBalancer) error {
+		lb.registered = true
+		return nil
+	}
+}
+
+// ListManagedBalancers returns the live load balancers that were created WithRegistry in the order that
+// they were created
+func ListManagedBalancers() []*IPVSLoadBalancer {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return append([]*IPVSLoadBalancer(nil), registry.balancers...)
+}
+
+// register adds the load balancer to the registry
+func (lb *IPVSLoadBalancer) register() {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.balancers = append(registry.balancers, lb)
+}
+
+// deregister removes the load balancer from the registry, a load balancer that isn't registered is ignored
+func (lb *IPVSLoadBalancer) deregister() {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for x := range registry.balancers {
+		if registry.balancers[x] == lb {
+			registry.balancers = append(registry.balancers[:x], registry.balancers[x+1:]...)
+			return
+		}
+	}
+}
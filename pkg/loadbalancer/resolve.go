@@ -0,0 +1,90 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// Resolver looks up the addresses of a hostname, *net.Resolver satisfies it
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// resolvedHost is the cached address of a backend hostname
+type resolvedHost struct {
+	address string
+	expires time.Time
+}
+
+// hostResolver resolves backend hostnames to an address of the service's family, caching each address
+// for the TTL
+type hostResolver struct {
+	resolver Resolver
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]resolvedHost
+}
+
+// WithHostnameResolution allows backends to be added (and removed) by hostname as well as by IP, such as when
+// the node watcher only knows the hostname of a node. A hostname is resolved with the resolver (or
+// net.DefaultResolver if it is nil) to the first of its addresses in the address family of the VIP, and the
+// address is cached for the TTL before the hostname is resolved again. A hostname without an address of the
+// VIP's family is rejected. Removing a backend by hostname uses the cached address, even once it has
+// expired, so that the backend that was added is removed if the hostname has since changed address.
+func WithHostnameResolution(resolver Resolver, ttl time.Duration) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if ttl <= 0 {
+			return fmt.Errorf("invalid hostname resolution TTL [%s], must be a positive duration", ttl)
+		}
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		lb.resolver = &hostResolver{resolver: resolver, ttl: ttl, cache: map[string]resolvedHost{}}
+		return nil
+	}
+}
+
+// resolveBackend returns the address of a backend, an IP address is returned unchanged and a hostname is
+// resolved if the load balancer was created WithHostnameResolution. When cached is true an expired cached
+// address is returned rather than resolving the hostname again.
+func (lb *IPVSLoadBalancer) resolveBackend(ctx context.Context, address string, cached bool) (string, error) {
+	if lb.resolver == nil {
+		return address, nil
+	}
+	if _, _, err := parseAddress(address); err == nil {
+		return address, nil
+	}
+	return lb.resolver.resolve(ctx, address, lb.loadBalancerService.Family, cached)
+}
+
+// resolve returns the address of a hostname in the address family, using the cached address until it expires
+func (r *hostResolver) resolve(ctx context.Context, host string, family ipvs.AddressFamily, cached bool) (string, error) {
+	r.mu.Lock()
+	entry, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && (cached || time.Now().Before(entry.expires)) {
+		return entry.address, nil
+	}
+
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve backend [%s]: %w", host, err)
+	}
+	for _, addr := range addrs {
+		ip, addrFamily, err := parseAddress(addr.IP.String())
+		if err != nil || addrFamily != family {
+			continue
+		}
+		r.mu.Lock()
+		r.cache[host] = resolvedHost{address: ip.String(), expires: time.Now().Add(r.ttl)}
+		r.mu.Unlock()
+		return ip.String(), nil
+	}
+	return "", fmt.Errorf("%w, backend [%s] has no %s address", ErrFamilyMismatch, host, familyName(family))
+}
@@ -0,0 +1,132 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/ipvs"
+	"github.com/jpillora/backoff"
+)
+
+const (
+	// defaultRetryAttempts is the number of attempts made for an IPVS change that fails transiently
+	defaultRetryAttempts = 3
+	// defaultRetryDelay is the delay before the first retry, it doubles for each subsequent retry
+	defaultRetryDelay = 50 * time.Millisecond
+	// maxRetryDelay bounds the delay between retries
+	maxRetryDelay = 2 * time.Second
+	// defaultBootRetryAttempts is the number of attempts made to create the IPVS service when the load
+	// balancer is created
+	defaultBootRetryAttempts = 5
+	// defaultBootRetryDelay is the delay before the first attempt to create the IPVS service is retried
+	defaultBootRetryDelay = 200 * time.Millisecond
+)
+
+// WithRetry sets how the changes to IPVS are retried when netlink fails transiently (such as EBUSY or
+// EINTR under heavy churn), a change is attempted up to the number of attempts with an exponential backoff
+// starting from the base delay. Permanent failures (such as EEXIST) are never retried. An attempts value of
+// 1 disables retrying, the default is 3 attempts starting with a 50ms delay.
+func WithRetry(attempts int, baseDelay time.Duration) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if attempts < 1 {
+			return fmt.Errorf("invalid retry attempts [%d], must be at least 1", attempts)
+		}
+		if baseDelay <= 0 {
+			return fmt.Errorf("invalid retry delay [%s], must be a positive duration", baseDelay)
+		}
+		lb.retryAttempts = attempts
+		lb.retryDelay = baseDelay
+		return nil
+	}
+}
+
+// WithBootRetry sets how the creation of the IPVS service is retried when the load balancer is created. On
+// a fast restart the kernel may not have finished removing the previous service, so its removal and
+// re-creation can conflict (EEXIST) or find it already gone (ESRCH) until it has settled. The whole creation
+// (including the recovery of a conflicting service) is attempted up to the number of attempts with an
+// exponential backoff starting from the base delay, each retry is logged. Permanent failures (such as
+// EPERM or an unsupported scheduler) are never retried. An attempts value of 1 disables retrying, the
+// default is 5 attempts starting with a 200ms delay.
+func WithBootRetry(attempts int, baseDelay time.Duration) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if attempts < 1 {
+			return fmt.Errorf("invalid boot retry attempts [%d], must be at least 1", attempts)
+		}
+		if baseDelay <= 0 {
+			return fmt.Errorf("invalid boot retry delay [%s], must be a positive duration", baseDelay)
+		}
+		lb.bootRetryAttempts = attempts
+		lb.bootRetryDelay = baseDelay
+		return nil
+	}
+}
+
+// isRetryable returns true if the error is a transient netlink failure that is worth retrying
+func isRetryable(err error) bool {
+	return errors.Is(err, syscall.EBUSY) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.ENOBUFS)
+}
+
+// retry will run a change to IPVS, retrying it with a backoff whilst it fails transiently. The context
+// error is returned if the context is done before the change succeeds.
+func (lb *IPVSLoadBalancer) retry(ctx context.Context, operation string, fn func() error) error {
+	b := backoff.Backoff{
+		Factor: 2,
+		Jitter: true,
+		Min:    lb.retryDelay,
+		Max:    maxRetryDelay,
+	}
+	for attempt := 1; ; attempt++ {
+		err := runWithContext(ctx, fn)
+		if err == nil || !isRetryable(err) || attempt >= lb.retryAttempts {
+			return err
+		}
+
+		dur := b.Duration()
+		lb.logEntry(operation).WithFields(Fields{"attempt": attempt, "delay": dur}).Debugf("transient IPVS failure [%v], retrying", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(dur):
+		}
+	}
+}
+
+// isBootRetryable returns true if the creation of the IPVS service failed due to the previous service not
+// having settled, a conflict that the load balancer was configured to fail on is permanent
+func (lb *IPVSLoadBalancer) isBootRetryable(err error) bool {
+	if isExists(err) {
+		return lb.conflictMode != ConflictFail
+	}
+	return errors.Is(err, syscall.ESRCH) || isRetryable(err)
+}
+
+// createServiceOnBoot will create the IPVS service of a new load balancer, retrying the creation with a
+// backoff whilst it fails due to a race with a previous service that hasn't been fully removed
+func (lb *IPVSLoadBalancer) createServiceOnBoot(ctx context.Context, svc ipvs.Service) error {
+	b := backoff.Backoff{
+		Factor: 2,
+		Jitter: true,
+		Min:    lb.bootRetryDelay,
+		Max:    maxRetryDelay,
+	}
+	for attempt := 1; ; attempt++ {
+		err := lb.createService(ctx, svc)
+		if err == nil || !lb.isBootRetryable(err) || attempt >= lb.bootRetryAttempts {
+			return err
+		}
+
+		dur := b.Duration()
+		lb.serviceLog(svc, opCreateService).WithFields(Fields{"attempt": attempt, "delay": dur}).Warnf("unable to create the IPVS service [%v], retrying", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(dur):
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/ipvs"
+)
+
+var (
+	// ipvsSchedulerPath lists the schedulers of the running kernel (one per line) when it is exposed
+	ipvsSchedulerPath = "/proc/net/ip_vs_scheduler"
+	// schedulerProbeFWMark is the firewall mark of the temporary service used to probe the schedulers, it is
+	// chosen to be unlikely to clash with a mark in use
+	schedulerProbeFWMark uint32 = 0xfffffff0
+	// newSchedulerProbeClient creates the IPVS client used to probe the schedulers
+	newSchedulerProbeClient = func() (Client, error) { return newIPVSClient() }
+)
+
+// supportedSchedulers caches the result of SupportedSchedulers
+var supportedSchedulers struct {
+	once  sync.Once
+	names []string
+}
+
+// SupportedSchedulers returns the sorted names of the IPVS schedulers that the running kernel accepts, so a
+// scheduler can be checked before it is configured rather than failing when the service is created. They
+// are read from /proc/net/ip_vs_scheduler if it is available, otherwise each known scheduler is probed by
+// creating (and immediately removing) a temporary firewall mark service. If neither is possible then every
+// known scheduler is returned. The result is cached for the lifetime of the process.
+func SupportedSchedulers() []string {
+	supportedSchedulers.once.Do(func() {
+		supportedSchedulers.names = detectSchedulers()
+	})
+	return append([]string(nil), supportedSchedulers.names...)
+}
+
+// detectSchedulers reads or probes the schedulers of the running kernel, falling back to the known schedulers
+func detectSchedulers() []string {
+	if names, err := readSchedulers(ipvsSchedulerPath); err == nil && len(names) != 0 {
+		return names
+	}
+
+	c, err := newSchedulerProbeClient()
+	if err == nil {
+		defer closeClient(c)
+		var names []string
+		if names, err = probeSchedulers(c); err == nil {
+			return names
+		}
+	}
+	defaultLogger.WithField("operation", "supported_schedulers").Debugf("unable to probe the IPVS schedulers, assuming every known scheduler [%v]", err)
+	return knownSchedulers()
+}
+
+// readSchedulers reads the names of the schedulers from a file with one scheduler per line
+func readSchedulers(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) != 0 {
+			names = append(names, fields[0])
+		}
+	}
+	sort.Strings(names)
+	return names, scanner.Err()
+}
+
+// probeSchedulers creates a temporary firewall mark service with each known scheduler, the schedulers that
+// the kernel accepts are returned. An error is only returned if no scheduler is accepted, as IPVS itself is
+// then unusable (such as without the privileges to configure it).
+func probeSchedulers(c Client) ([]string, error) {
+	var names []string
+	var lastErr error
+	for _, name := range knownSchedulers() {
+		svc := ipvs.Service{FWMark: schedulerProbeFWMark, Family: ipvs.INET, Scheduler: name}
+		if err := c.CreateService(svc); err != nil {
+			lastErr = err
+			continue
+		}
+		names = append(names, name)
+		if err := c.RemoveService(svc); err != nil {
+			defaultLogger.WithField("operation", "supported_schedulers").Warnf("unable to remove the scheduler probe service [%v]", err)
+		}
+	}
+	if len(names) == 0 {
+		return nil, lastErr
+	}
+	return names, nil
+}
+
+// knownSchedulers returns the sorted names of every scheduler known to the load balancer
+func knownSchedulers() []string {
+	names := make([]string, 0, len(schedulers))
+	for scheduler := range schedulers {
+		names = append(names, string(scheduler))
+	}
+	sort.Strings(names)
+	return names
+}
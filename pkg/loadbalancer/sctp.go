@@ -0,0 +1,57 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// AddSCTPBackend will add a multi-homed SCTP backend, IPVS has no concept of a destination with multiple
+// addresses so only the primary address is registered and scheduled. The additional addresses are
+// advertised by the backend itself when the association is set up, so the client reaches them directly.
+//
+// This only works when the backend replies to the client directly, so multi-homed backends require the
+// DirectRoute or Tunnel forwarding methods. Masquarade (NAT) rewrites the packet headers but not the
+// addresses within the SCTP INIT and INIT-ACK chunks, and Local terminates the association on this host,
+// so neither can be used with additional addresses. A single-homed SCTP backend works with every
+// forwarding method and can be added with AddBackend.
+func (lb *IPVSLoadBalancer) AddSCTPBackend(primary string, additional []string, port, weight int, fwd ipvs.ForwardType) error {
+	if len(additional) != 0 && fwd != ipvs.DirectRoute && fwd != ipvs.Tunnel {
+		return fmt.Errorf("multi-homed SCTP backends require the DirectRoute or Tunnel forwarding method, not [%s]", fwd)
+	}
+
+	addresses := make([]string, 0, len(additional))
+	for x := range additional {
+		ip, _, err := parseAddress(additional[x])
+		if err != nil {
+			return err
+		}
+		addresses = append(addresses, ip.String())
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if protocol := lb.protocolName(); protocol != "sctp" {
+		return fmt.Errorf("multi-homed backends require an sctp load balancer, not [%s]", protocol)
+	}
+	defer lb.backendsChanged()
+
+	if err := lb.addBackend(context.Background(), primary, port, weight, fwd); err != nil {
+		return err
+	}
+	// The primary address may be a hostname, it has just been resolved so the cached address is used
+	resolved, err := lb.resolveBackend(context.Background(), primary, true)
+	if err != nil {
+		return err
+	}
+	ip, _, err := parseAddress(resolved)
+	if err != nil {
+		return err
+	}
+	if lb.sctpAddresses == nil {
+		lb.sctpAddresses = map[string][]string{}
+	}
+	lb.sctpAddresses[backendKey(ip.String(), port)] = addresses
+	return nil
+}
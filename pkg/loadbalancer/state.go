@@ -0,0 +1,247 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cloudflare/ipvs"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// stateVersion is the version of the serialized state, it is increased whenever the format changes. Version
+// 2 added the tunnels and additional SCTP addresses of the backends, the state of version 1 is still restored.
+const stateVersion = 2
+
+// state is the serialized state of a load balancer, see MarshalState
+type state struct {
+	Version   int            `json:"version"`
+	VIP       string         `json:"vip,omitempty"`
+	Port      int            `json:"port,omitempty"`
+	FWMark    uint32         `json:"fwmark,omitempty"`
+	Protocol  string         `json:"protocol,omitempty"`
+	Scheduler Scheduler      `json:"scheduler"`
+	Backends  []stateBackend `json:"backends"`
+}
+
+// stateBackend is the serialized state of a backend
+type stateBackend struct {
+	Address        string           `json:"address"`
+	Port           int              `json:"port"`
+	Weight         int              `json:"weight"`
+	FwdMethod      ipvs.ForwardType `json:"forward_method"`
+	UpperThreshold int              `json:"upper_threshold,omitempty"`
+	LowerThreshold int              `json:"lower_threshold,omitempty"`
+	TunnelType     TunnelType       `json:"tunnel_type,omitempty"`
+	TunnelPort     int              `json:"tunnel_port,omitempty"`
+	// AdditionalAddresses are the additional addresses of a multi-homed SCTP backend
+	AdditionalAddresses []string `json:"additional_addresses,omitempty"`
+}
+
+// MarshalState returns the state of the load balancer (the VIP, port, scheduler and the backends as they
+// were applied) so that a restarting process can restore it with RestoreState. The weights of backends
+// quiesced by the health checker are their configured weights rather than 0.
+func (lb *IPVSLoadBalancer) MarshalState() ([]byte, error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	spec := lb.loadBalancerService
+	s := state{
+		Version:   stateVersion,
+		Port:      int(spec.Port),
+		FWMark:    spec.FWMark,
+		Protocol:  lb.protocolName(),
+		Scheduler: lb.scheduler,
+		Backends:  make([]stateBackend, 0, len(lb.desired)),
+	}
+	if spec.FWMark == 0 {
+		s.VIP = spec.Address.Net(spec.Family).String()
+	}
+
+	keys := make([]string, 0, len(lb.desired))
+	for key := range lb.desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		backend := lb.desired[key]
+		if h, ok := lb.health[key]; ok && h.quiesced {
+			backend.Weight = h.weight
+		}
+		s.Backends = append(s.Backends, stateBackend{
+			Address:             backend.Address,
+			Port:                backend.Port,
+			Weight:              backend.Weight,
+			FwdMethod:           backend.FwdMethod,
+			UpperThreshold:      backend.UpperThreshold,
+			LowerThreshold:      backend.LowerThreshold,
+			TunnelType:          backend.Tunnel.Type,
+			TunnelPort:          backend.Tunnel.Port,
+			AdditionalAddresses: lb.sctpAddresses[key],
+		})
+	}
+	return json.Marshal(s)
+}
+
+// RestoreState will restore the backends from the state returned by MarshalState, it is intended to be used
+// after a restart once the load balancer has been created (adopting the existing IPVS service) so that the
+// backends are applied without rebuilding the service. Backends that are already registered with the same
+// spec are left untouched so their connections are preserved, changed backends are updated, missing
+// backends are added and any backend that isn't in the state is removed. The tunnels of the backends are
+// re-applied as the ipvs client can't read them back. The state must be of a load balancer with the same
+// VIP, port, protocol and scheduler.
+func (lb *IPVSLoadBalancer) RestoreState(data []byte) error {
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("error parsing the load balancer state: %w", err)
+	}
+	if s.Version != 1 && s.Version != stateVersion {
+		return fmt.Errorf("unsupported load balancer state version [%d]", s.Version)
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+
+	spec := lb.loadBalancerService
+	vip := ""
+	if spec.FWMark == 0 {
+		vip = spec.Address.Net(spec.Family).String()
+	}
+	if s.VIP != vip || s.Port != int(spec.Port) || s.FWMark != spec.FWMark || s.Protocol != lb.protocolName() {
+		return fmt.Errorf("the state of [%s %s:%d] doesn't match the load balancer [%s]", s.Protocol, s.VIP, s.Port, lb.describe())
+	}
+	if s.Scheduler != lb.scheduler {
+		return fmt.Errorf("the state scheduler [%s] doesn't match the load balancer scheduler [%s]", s.Scheduler, lb.scheduler)
+	}
+
+	current, err := lb.listBackends(false)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]Backend, len(current))
+	for x := range current {
+		existing[backendKey(current[x].Address, current[x].Port)] = current[x]
+	}
+
+	var errs []error
+	restored := make(map[string]bool, len(s.Backends))
+	for _, b := range s.Backends {
+		backend := Backend{
+			Address:        b.Address,
+			Port:           b.Port,
+			Weight:         b.Weight,
+			FwdMethod:      b.FwdMethod,
+			UpperThreshold: b.UpperThreshold,
+			LowerThreshold: b.LowerThreshold,
+			Tunnel:         Tunnel{Type: b.TunnelType, Port: b.TunnelPort},
+		}
+		key := backendKey(b.Address, b.Port)
+		restored[key] = true
+
+		found, ok := existing[key]
+		switch {
+		case !ok:
+			err = lb.addBackendWithThresholds(context.Background(), b.Address, b.Port, b.Weight, b.FwdMethod, b.UpperThreshold, b.LowerThreshold)
+		case found.Weight != b.Weight || found.FwdMethod != b.FwdMethod ||
+			found.UpperThreshold != b.UpperThreshold || found.LowerThreshold != b.LowerThreshold:
+			err = lb.updateDestination(opUpdateBackend, backend)
+		default:
+			err = nil
+		}
+		// A new destination is created with an IPIP tunnel, any other tunnel (or a changed tunnel) is set
+		if err == nil && b.FwdMethod == ipvs.Tunnel && backend.Tunnel != found.Tunnel {
+			err = lb.restoreTunnel(key, backend)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		lb.setDesired(backend)
+		if len(b.AdditionalAddresses) != 0 {
+			if lb.sctpAddresses == nil {
+				lb.sctpAddresses = map[string][]string{}
+			}
+			lb.sctpAddresses[key] = b.AdditionalAddresses
+		} else {
+			delete(lb.sctpAddresses, key)
+		}
+	}
+
+	for key, backend := range existing {
+		if restored[key] {
+			continue
+		}
+		if err = lb.removeBackend(context.Background(), backend.Address, backend.Port); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// restoreTunnel sets the tunnel of a restored backend on every port, the caller must hold the write lock
+func (lb *IPVSLoadBalancer) restoreTunnel(key string, backend Backend) error {
+	if err := backend.Tunnel.validate(); err != nil {
+		return newError(opUpdateBackend, lb.loadBalancerService, key, err)
+	}
+	dst, err := backendDestination(backend)
+	if err != nil {
+		return err
+	}
+	for _, svc := range lb.services() {
+		if err = lb.setBackendTunnel(svc, key, dst, backend.Tunnel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BalancerState is a point-in-time copy of the state of a load balancer, see Snapshot
+type BalancerState struct {
+	// Time is when the snapshot was taken
+	Time time.Time
+	// Spec is the spec of the IPVS service of the primary port and Ports are every port of the VIP
+	Spec  ServiceSpec
+	Ports []int
+	// ForwardMethod is the default forwarding method of new backends
+	ForwardMethod ipvs.ForwardType
+	// Backends are sorted by address and port, their weights are the configured weights (a backend quiesced
+	// by the health checker isn't Healthy and has a weight of 0 in IPVS until it recovers)
+	Backends []Backend
+}
+
+// Snapshot returns a consistent copy of the state of the load balancer (its spec, ports and backends) for
+// diagnostics, such as a debug endpoint. It is taken whilst holding the lock from the state that the load
+// balancer maintains in memory, so it doesn't read IPVS and won't show any drift made outside of the load
+// balancer (see Reconcile) or the connection counts (see ListBackendsWithStats).
+func (lb *IPVSLoadBalancer) Snapshot() BalancerState {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	s := BalancerState{
+		Time:          time.Now(),
+		Spec:          lb.serviceSpec(),
+		ForwardMethod: lb.forwardMethod,
+		Backends:      make([]Backend, 0, len(lb.desired)),
+	}
+	for _, svc := range lb.services() {
+		s.Ports = append(s.Ports, int(svc.Port))
+	}
+
+	keys := make([]string, 0, len(lb.desired))
+	for key := range lb.desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		backend := lb.desired[key]
+		backend.Healthy = !lb.isQuiesced(key)
+		if addresses := lb.sctpAddresses[key]; len(addresses) != 0 {
+			backend.AdditionalAddresses = append([]string(nil), addresses...)
+		}
+		s.Backends = append(s.Backends, backend)
+	}
+	return s
+}
@@ -0,0 +1,104 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// opResetStats is the operation used when the counters are zeroed
+const opResetStats = "reset_stats"
+
+// zeroClient can optionally be implemented by a Client to zero the counters of a service, otherwise they
+// are zeroed directly over netlink as the ipvs client doesn't support it
+type zeroClient interface {
+	ZeroService(ipvs.Service) error
+}
+
+// zeroService will zero the counters of a service using the client if it supports it
+func zeroService(c Client, svc ipvs.Service) error {
+	if zc, ok := c.(zeroClient); ok {
+		return zc.ZeroService(svc)
+	}
+	return zeroKernelService(svc)
+}
+
+// Stats are the traffic counters of the IPVS service, the totals are counted since the service was
+// created and the rates are the kernel's estimates per second
+type Stats struct {
+	Connections     uint64
+	IncomingPackets uint64
+	OutgoingPackets uint64
+	IncomingBytes   uint64
+	OutgoingBytes   uint64
+
+	ConnectionRate     uint64
+	IncomingPacketRate uint64
+	OutgoingPacketRate uint64
+	IncomingByteRate   uint64
+	OutgoingByteRate   uint64
+}
+
+// ServiceStats will return the traffic counters of the load balancer, when multiple ports are configured
+// the counters of every port are summed. The counters are kept by IPVS for the service itself, so they are
+// available even when no backends are registered.
+func (lb *IPVSLoadBalancer) ServiceStats() (Stats, error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	var stats Stats
+	for _, svc := range lb.services() {
+		svcExt, err := lb.client.Service(svc)
+		if err != nil {
+			return Stats{}, fmt.Errorf("error reading IPVS service stats: %w", err)
+		}
+		stats.add(serviceStats(svcExt))
+	}
+	return stats, nil
+}
+
+// ResetStats will zero the traffic counters of every port of the load balancer and of its backends, such
+// as to start a clean measurement window for ServiceStats. Only the counters of the IPVS services of this
+// load balancer are zeroed, the counters of other services and the system-wide IPVS totals are unchanged.
+func (lb *IPVSLoadBalancer) ResetStats() error {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	for _, svc := range lb.services() {
+		svc := svc
+		err := inNetNS(lb.netns, func() error { return zeroService(lb.client, svc) })
+		recordOperation(opResetStats, err)
+		if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EINVAL) {
+			err = fmt.Errorf("zeroing the counters isn't supported by the kernel: %w", err)
+		}
+		if err != nil {
+			return newError(opResetStats, svc, "", err)
+		}
+	}
+	lb.logEntry(opResetStats).Debug("zeroed the counters")
+	return nil
+}
+
+// serviceStats returns the 64-bit counters of a service, older kernels only report the 32-bit counters
+func serviceStats(svc ipvs.ServiceExtended) ipvs.Stats {
+	if svc.Stats64 != (ipvs.Stats{}) {
+		return svc.Stats64
+	}
+	return svc.Stats
+}
+
+// add sums the counters of an IPVS service into the stats
+func (s *Stats) add(stats ipvs.Stats) {
+	s.Connections += stats.Connections
+	s.IncomingPackets += stats.IncomingPackets
+	s.OutgoingPackets += stats.OutgoingPackets
+	s.IncomingBytes += stats.IncomingBytes
+	s.OutgoingBytes += stats.OutgoingBytes
+	s.ConnectionRate += stats.ConnectionRate
+	s.IncomingPacketRate += stats.IncomingPacketRate
+	s.OutgoingPacketRate += stats.OutgoingPacketRate
+	s.IncomingByteRate += stats.IncomingByteRate
+	s.OutgoingByteRate += stats.OutgoingByteRate
+}
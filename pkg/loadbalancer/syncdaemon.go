@@ -0,0 +1,117 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// opConnectionSync is the operation used in the connection sync logs
+const opConnectionSync = "connection_sync"
+
+// The roles of the IPVS connection sync daemon, see StartConnectionSync
+const (
+	// SyncRoleMaster sends the connections of this node to the backups
+	SyncRoleMaster = "master"
+	// SyncRoleBackup receives the connections of the master
+	SyncRoleBackup = "backup"
+)
+
+// syncDaemonStates are the kernel states (IP_VS_STATE_MASTER and IP_VS_STATE_BACKUP) of each role
+var syncDaemonStates = map[string]uint32{
+	SyncRoleMaster: 1,
+	SyncRoleBackup: 2,
+}
+
+// interfaceByName returns a local interface, it is replaced by the tests
+var interfaceByName = net.InterfaceByName
+
+// syncDaemonClient can optionally be implemented by a Client to control the connection sync daemon,
+// otherwise it is controlled directly over netlink as the ipvs client doesn't support it
+type syncDaemonClient interface {
+	StartSyncDaemon(state uint32, iface string) error
+	StopSyncDaemon(state uint32) error
+}
+
+// startSyncDaemon will start the connection sync daemon using the client if it supports it
+func startSyncDaemon(c Client, state uint32, iface string) error {
+	if sc, ok := c.(syncDaemonClient); ok {
+		return sc.StartSyncDaemon(state, iface)
+	}
+	return startKernelSyncDaemon(state, iface)
+}
+
+// stopSyncDaemon will stop the connection sync daemon using the client if it supports it
+func stopSyncDaemon(c Client, state uint32) error {
+	if sc, ok := c.(syncDaemonClient); ok {
+		return sc.StopSyncDaemon(state)
+	}
+	return stopKernelSyncDaemon(state)
+}
+
+// StartConnectionSync will start the IPVS connection sync daemon in a role (SyncRoleMaster or
+// SyncRoleBackup) on an interface, so that a backup node learns the connections of the master and they
+// survive a failover. The master multicasts the connections on the interface (to 224.0.0.81 port 8848)
+// and the backups listen on it, so the interface must support multicast and the nodes must share its
+// network. The daemon is run by the kernel (which must have IPVS with connection sync support), it requires
+// CAP_NET_ADMIN and there is one daemon of each role per network namespace that syncs the connections of
+// every IPVS service rather than only those of this load balancer. The sync ID is 0, so a backup accepts
+// the connections of every master.
+//
+// Only one daemon can be started by a load balancer, it must be stopped with StopConnectionSync (or Close)
+// before it is started in another role. It is safe to call concurrently with the other methods.
+func (lb *IPVSLoadBalancer) StartConnectionSync(role, iface string) (err error) {
+	role = strings.ToLower(role)
+	state, ok := syncDaemonStates[role]
+	if !ok {
+		return fmt.Errorf("invalid connection sync role [%s], must be %s or %s", role, SyncRoleMaster, SyncRoleBackup)
+	}
+	if iface == "" {
+		return fmt.Errorf("the connection sync daemon requires an interface")
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.syncRole != "" {
+		return fmt.Errorf("the connection sync daemon is already running as %s on [%s]", lb.syncRole, lb.syncInterface)
+	}
+
+	defer func() { recordOperation(opConnectionSync, err) }()
+	err = inNetNS(lb.netns, func() error {
+		if _, err := interfaceByName(iface); err != nil {
+			return fmt.Errorf("invalid connection sync interface [%s]: %w", iface, err)
+		}
+		return startSyncDaemon(lb.client, state, iface)
+	})
+	if errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("a %s connection sync daemon is already running: %w", role, err)
+	}
+	if err != nil {
+		return fmt.Errorf("error starting the %s connection sync daemon on [%s]: %w", role, iface, err)
+	}
+	lb.syncRole, lb.syncInterface = role, iface
+	lb.logEntry(opConnectionSync).WithFields(Fields{"role": role, "interface": iface}).Info("started the connection sync daemon")
+	return nil
+}
+
+// StopConnectionSync will stop the connection sync daemon started by StartConnectionSync, it does nothing
+// if the daemon isn't running. It is safe to call concurrently with the other methods.
+func (lb *IPVSLoadBalancer) StopConnectionSync() (err error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.syncRole == "" {
+		return nil
+	}
+
+	defer func() { recordOperation(opConnectionSync, err) }()
+	err = inNetNS(lb.netns, func() error { return stopSyncDaemon(lb.client, syncDaemonStates[lb.syncRole]) })
+	// The daemon has already been stopped (such as with ipvsadm) if it isn't running (ESRCH)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("error stopping the %s connection sync daemon: %w", lb.syncRole, err)
+	}
+	lb.logEntry(opConnectionSync).WithField("role", lb.syncRole).Info("stopped the connection sync daemon")
+	lb.syncRole, lb.syncInterface = "", ""
+	return nil
+}
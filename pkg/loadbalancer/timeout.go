@@ -0,0 +1,145 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// WithOperationTimeout bounds every IPVS netlink call of the load balancer, so that a call stuck in the
+// kernel fails with an error matching context.DeadlineExceeded (with errors.Is) rather than blocking the
+// caller (and the load balancer lock) forever. A call that times out is abandoned rather than cancelled,
+// so it may still complete (or have partially applied, such as a backend added to only some ports) after
+// the error is returned, ListBackends or Reconcile can be used to find the state that was applied. The
+// default is no timeout.
+func WithOperationTimeout(timeout time.Duration) Option {
+	return func(lb *IPVSLoadBalancer) error {
+		if timeout <= 0 {
+			return fmt.Errorf("invalid operation timeout [%s], must be a positive duration", timeout)
+		}
+		lb.operationTimeout = timeout
+		return nil
+	}
+}
+
+// timeoutClient is a Client that fails any call that doesn't complete within the timeout, the call continues
+// in its own goroutine until the kernel returns
+type timeoutClient struct {
+	Client
+	timeout time.Duration
+	// netns is the network namespace of the load balancer, the commands that aren't part of the ipvs client
+	// open their own netlink socket so it must be entered by the goroutine that runs them
+	netns string
+}
+
+// call runs a netlink call of the client, returning an error once the timeout has passed
+func (c *timeoutClient) call(method string, fn func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	err := runWithContext(ctx, fn)
+	if err != nil && err == ctx.Err() {
+		return fmt.Errorf("the IPVS %s call didn't complete within %s and may have been partially applied: %w", method, c.timeout, err)
+	}
+	return err
+}
+
+// Services, Service and Destinations only read the result of the call once it has returned, as a call that
+// times out is still running and may write its result at any time
+func (c *timeoutClient) Services() ([]ipvs.ServiceExtended, error) {
+	var svcs []ipvs.ServiceExtended
+	if err := c.call("Services", func() (err error) {
+		svcs, err = c.Client.Services()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return svcs, nil
+}
+
+func (c *timeoutClient) Service(svc ipvs.Service) (ipvs.ServiceExtended, error) {
+	var existing ipvs.ServiceExtended
+	if err := c.call("Service", func() (err error) {
+		existing, err = c.Client.Service(svc)
+		return err
+	}); err != nil {
+		return ipvs.ServiceExtended{}, err
+	}
+	return existing, nil
+}
+
+func (c *timeoutClient) CreateService(svc ipvs.Service) error {
+	return c.call("CreateService", func() error { return c.Client.CreateService(svc) })
+}
+
+func (c *timeoutClient) UpdateService(svc ipvs.Service) error {
+	return c.call("UpdateService", func() error { return c.Client.UpdateService(svc) })
+}
+
+func (c *timeoutClient) RemoveService(svc ipvs.Service) error {
+	return c.call("RemoveService", func() error { return c.Client.RemoveService(svc) })
+}
+
+func (c *timeoutClient) Destinations(svc ipvs.Service) ([]ipvs.DestinationExtended, error) {
+	var dsts []ipvs.DestinationExtended
+	if err := c.call("Destinations", func() (err error) {
+		dsts, err = c.Client.Destinations(svc)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return dsts, nil
+}
+
+func (c *timeoutClient) CreateDestination(svc ipvs.Service, dst ipvs.Destination) error {
+	return c.call("CreateDestination", func() error { return c.Client.CreateDestination(svc, dst) })
+}
+
+func (c *timeoutClient) UpdateDestination(svc ipvs.Service, dst ipvs.Destination) error {
+	return c.call("UpdateDestination", func() error { return c.Client.UpdateDestination(svc, dst) })
+}
+
+func (c *timeoutClient) RemoveDestination(svc ipvs.Service, dst ipvs.Destination) error {
+	return c.call("RemoveDestination", func() error { return c.Client.RemoveDestination(svc, dst) })
+}
+
+// SetTimeouts sets the IPVS connection timeouts using the underlying client
+func (c *timeoutClient) SetTimeouts(timeouts Timeouts) error {
+	return c.call("SetTimeouts", func() error {
+		return inNetNS(c.netns, func() error { return setTimeouts(c.Client, timeouts) })
+	})
+}
+
+// SetDestinationTunnel sets the tunnel of a destination using the underlying client
+func (c *timeoutClient) SetDestinationTunnel(svc ipvs.Service, dst ipvs.Destination, tunnel Tunnel) error {
+	return c.call("SetDestinationTunnel", func() error {
+		return inNetNS(c.netns, func() error { return setTunnel(c.Client, svc, dst, tunnel) })
+	})
+}
+
+// ZeroService zeroes the counters of a service using the underlying client
+func (c *timeoutClient) ZeroService(svc ipvs.Service) error {
+	return c.call("ZeroService", func() error {
+		return inNetNS(c.netns, func() error { return zeroService(c.Client, svc) })
+	})
+}
+
+// StartSyncDaemon starts the connection sync daemon using the underlying client
+func (c *timeoutClient) StartSyncDaemon(state uint32, iface string) error {
+	return c.call("StartSyncDaemon", func() error {
+		return inNetNS(c.netns, func() error { return startSyncDaemon(c.Client, state, iface) })
+	})
+}
+
+// StopSyncDaemon stops the connection sync daemon using the underlying client
+func (c *timeoutClient) StopSyncDaemon(state uint32) error {
+	return c.call("StopSyncDaemon", func() error {
+		return inNetNS(c.netns, func() error { return stopSyncDaemon(c.Client, state) })
+	})
+}
+
+// Close closes the underlying client, it isn't bounded by the timeout
+func (c *timeoutClient) Close() error {
+	return closeClient(c.Client)
+}
@@ -0,0 +1,98 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// interfaceAddrs returns the addresses of the local interfaces, it is replaced by the tests
+var interfaceAddrs = net.InterfaceAddrs
+
+// WithTopologyValidation checks that the forwarding method of each backend is likely to work with the
+// topology of the host when the backend is added, as a misconfigured forwarding method silently drops the
+// traffic. The Local method requires the VIP to be assigned to a local interface and the DirectRoute method
+// requires the backends to be on the local network of the VIP (as their replies bypass the load balancer
+// and the VIP must be configured on their loopback). The checks are best-effort, a problem is logged as a
+// warning unless the load balancer is created WithStrict when the backend is rejected.
+func WithTopologyValidation() Option {
+	return func(lb *IPVSLoadBalancer) error {
+		lb.topologyValidation = true
+		return nil
+	}
+}
+
+// validateTopology checks that a backend with the forwarding method is likely to work with the topology,
+// a problem is only returned in strict mode. The caller must hold the lock.
+func (lb *IPVSLoadBalancer) validateTopology(backend net.IP, fwd ipvs.ForwardType) error {
+	if fwd != ipvs.Local && fwd != ipvs.DirectRoute {
+		return nil
+	}
+	var addrs []net.Addr
+	err := inNetNS(lb.netns, func() (err error) {
+		addrs, err = interfaceAddrs()
+		return err
+	})
+	if err != nil {
+		lb.logEntry(opAddBackend).Warnf("unable to list the local addresses to validate the forwarding method [%v]", err)
+		return nil
+	}
+
+	problem := topologyProblem(lb.loadBalancerService, backend, fwd, addrs)
+	if problem == "" {
+		return nil
+	}
+	if lb.strict {
+		return fmt.Errorf("the %s forwarding method is likely misconfigured, %s", fwd, problem)
+	}
+	lb.logEntry(opAddBackend).WithFields(Fields{"backend": backend.String(), "forward_method": fwd.String()}).Warnf("the forwarding method is likely misconfigured, %s", problem)
+	return nil
+}
+
+// topologyProblem describes why a backend with the forwarding method is unlikely to work with the local
+// addresses, or returns an empty string if no problem is found
+func topologyProblem(svc ipvs.Service, backend net.IP, fwd ipvs.ForwardType, addrs []net.Addr) string {
+	var vip net.IP
+	if svc.FWMark == 0 {
+		vip = svc.Address.Net(svc.Family)
+	}
+
+	var networks, vipNetworks []*net.IPNet
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if vip != nil && ipNet.IP.Equal(vip) && fwd == ipvs.Local {
+			return ""
+		}
+		// A host route (such as a VIP assigned as a /32) or the loopback has no network of backends
+		if ones, bits := ipNet.Mask.Size(); ones == bits || ipNet.IP.IsLoopback() {
+			continue
+		}
+		networks = append(networks, ipNet)
+		if vip != nil && ipNet.Contains(vip) {
+			vipNetworks = append(vipNetworks, ipNet)
+		}
+	}
+
+	if fwd == ipvs.Local {
+		if vip == nil {
+			return ""
+		}
+		return fmt.Sprintf("the VIP [%s] isn't assigned to a local interface", vip)
+	}
+	if len(vipNetworks) != 0 {
+		networks = vipNetworks
+	}
+	for _, ipNet := range networks {
+		if ipNet.Contains(backend) {
+			return ""
+		}
+	}
+	if len(vipNetworks) != 0 {
+		return fmt.Sprintf("the backend [%s] isn't on the same subnet as the VIP [%s]", backend, vip)
+	}
+	return fmt.Sprintf("the backend [%s] isn't on a local network", backend)
+}
@@ -0,0 +1,131 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cloudflare/ipvs"
+)
+
+// TunnelType is the encapsulation of the traffic tunnelled to a backend with the Tunnel forwarding method
+type TunnelType uint8
+
+// The tunnel types as defined in linux/ip_vs.h
+const (
+	// TunnelIPIP is IP in IP encapsulation, it is the default and is supported by every kernel
+	TunnelIPIP TunnelType = 0
+	// TunnelGUE is Generic UDP Encapsulation to the port of the tunnel, it requires kernel 5.2
+	TunnelGUE TunnelType = 1
+	// TunnelGRE is Generic Routing Encapsulation, it requires kernel 5.3
+	TunnelGRE TunnelType = 2
+)
+
+func (t TunnelType) String() string {
+	switch t {
+	case TunnelIPIP:
+		return "ipip"
+	case TunnelGUE:
+		return "gue"
+	case TunnelGRE:
+		return "gre"
+	}
+	return fmt.Sprintf("TunnelType(%d)", uint8(t))
+}
+
+// Tunnel is the encapsulation of a backend that uses the Tunnel forwarding method
+type Tunnel struct {
+	Type TunnelType
+	// Port is the UDP port of the backend that receives GUE traffic, it is required for (and only used by) GUE
+	Port int
+}
+
+// validate returns an error if the tunnel type and port aren't a valid combination
+func (t Tunnel) validate() error {
+	switch t.Type {
+	case TunnelGUE:
+		if t.Port == 0 {
+			return fmt.Errorf("a GUE tunnel requires the UDP port of the backend")
+		}
+		return validatePort(t.Port)
+	case TunnelIPIP, TunnelGRE:
+		if t.Port != 0 {
+			return fmt.Errorf("a tunnel port is only used by GUE, not %s", t.Type)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown tunnel type [%d], expected ipip, gue or gre", uint8(t.Type))
+}
+
+// tunnelClient can optionally be implemented by a Client to set the tunnel of a destination, otherwise it is
+// set directly over netlink as the ipvs client doesn't support tunnel types
+type tunnelClient interface {
+	SetDestinationTunnel(ipvs.Service, ipvs.Destination, Tunnel) error
+}
+
+// setTunnel will set the tunnel of a destination using the client if it supports it
+func setTunnel(c Client, svc ipvs.Service, dst ipvs.Destination, tunnel Tunnel) error {
+	if tc, ok := c.(tunnelClient); ok {
+		return tc.SetDestinationTunnel(svc, dst, tunnel)
+	}
+	return setKernelDestinationTunnel(svc, dst, tunnel)
+}
+
+// AddBackendWithTunnel will add a backend with a weight that uses the Tunnel forwarding method with a specific
+// tunnel type, such as GUE to place backends in another subnet where IPIP isn't routed. The tunnel types
+// other than IPIP require a newer kernel (GUE 5.2 and GRE 5.3), if the kernel doesn't support the tunnel
+// type (or it can't be set) then the backend is removed again and the error is returned. The ipvs client
+// doesn't report the tunnel type, so ListBackends returns the tunnel as it was applied by this load balancer.
+func (lb *IPVSLoadBalancer) AddBackendWithTunnel(address string, port, weight int, tunnel Tunnel) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	defer lb.backendsChanged()
+
+	if err := tunnel.validate(); err != nil {
+		return newError(opAddBackend, lb.loadBalancerService, backendKey(address, port), err)
+	}
+
+	if err := lb.addBackend(context.Background(), address, port, weight, ipvs.Tunnel); err != nil {
+		return err
+	}
+	resolved, err := lb.resolveBackend(context.Background(), address, true)
+	if err != nil {
+		return err
+	}
+	ip, _, err := parseAddress(resolved)
+	if err != nil {
+		return err
+	}
+	key := backendKey(ip.String(), port)
+	backend := lb.desired[key]
+	backend.Tunnel = tunnel
+	if tunnel.Type == TunnelIPIP {
+		lb.desired[key] = backend
+		return nil
+	}
+
+	dst, err := backendDestination(backend)
+	if err != nil {
+		return err
+	}
+	for _, svc := range lb.services() {
+		if err = lb.setBackendTunnel(svc, key, dst, tunnel); err != nil {
+			if rmErr := lb.removeBackend(context.Background(), backend.Address, backend.Port); rmErr != nil {
+				return fmt.Errorf("%w, unable to remove the backend [%v]", err, rmErr)
+			}
+			return err
+		}
+	}
+	lb.desired[key] = backend
+	return nil
+}
+
+// setBackendTunnel sets the tunnel of a destination of a service, the caller must hold the write lock
+func (lb *IPVSLoadBalancer) setBackendTunnel(svc ipvs.Service, key string, dst ipvs.Destination, tunnel Tunnel) error {
+	err := lb.retry(context.Background(), opUpdateBackend, func() error {
+		return inNetNS(lb.netns, func() error { return setTunnel(lb.client, svc, dst, tunnel) })
+	})
+	if err != nil {
+		return newError(opUpdateBackend, svc, key, fmt.Errorf("error setting the %s tunnel: %w", tunnel.Type, err))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+)
+
+// WatchBackends returns a channel that receives the current backends immediately and then whenever they
+// are changed through the load balancer (such as AddBackend, RemoveBackend or SyncBackends). The backends
+// are those known to this process, changes made to IPVS by anything else are not watched. A slow receiver
+// only misses intermediate sets, the latest set is always delivered. The channel is closed once the context
+// is done or the load balancer is closed.
+func (lb *IPVSLoadBalancer) WatchBackends(ctx context.Context) (<-chan []Backend, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.closed {
+		return nil, fmt.Errorf("the load balancer has been closed")
+	}
+	backends, err := lb.listBackends(false)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan []Backend, 1)
+	ch <- backends
+	if lb.watchers == nil {
+		lb.watchers = map[chan []Backend]struct{}{}
+	}
+	lb.watchers[ch] = struct{}{}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-lb.done:
+		}
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		delete(lb.watchers, ch)
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// notifyWatchers sends the current backends to every watcher, replacing any set that hasn't been received
+// yet, the caller must hold the write lock
+func (lb *IPVSLoadBalancer) notifyWatchers() {
+	if len(lb.watchers) == 0 {
+		return
+	}
+	backends, err := lb.listBackends(false)
+	if err != nil {
+		lb.logEntry("watch_backends").Errorf("unable to list backends for watchers [%v]", err)
+		return
+	}
+	for ch := range lb.watchers {
+		select {
+		case <-ch:
+		default:
+		}
+		// Only the holder of the write lock sends, so the channel is always empty here
+		ch <- backends
+	}
+}
+
+// backendsChanged updates the metrics and watchers once the backends have been modified, the caller must
+// hold the write lock
+func (lb *IPVSLoadBalancer) backendsChanged() {
+	if count := lb.updateBackendsGauge(); count >= 0 {
+		lb.checkNoBackends(count)
+	}
+	lb.notifyWatchers()
+}
+
+// checkNoBackends warns once the last backend has been removed, as the VIP will accept connections that
+// IPVS silently drops, the caller must hold the write lock
+func (lb *IPVSLoadBalancer) checkNoBackends(count int) {
+	svc := lb.loadBalancerService
+	labels := lb.serviceLabels(int(svc.Port))
+	if count != 0 {
+		noBackendsGauge.With(labels).Set(0)
+		lb.hasBackends = true
+		return
+	}
+	noBackendsGauge.With(labels).Set(1)
+	if !lb.hasBackends {
+		return
+	}
+	lb.hasBackends = false
+	lb.serviceLog(svc, opRemoveBackend).WithField("backends", 0).
+		Warn("the load balancer has no backends, traffic to the VIP will be dropped until a backend is added")
+	if lb.onNoBackends != nil {
+		lb.onNoBackends(svc.Address.Net(svc.Family).String(), int(svc.Port))
+	}
+}
@@ -0,0 +1,49 @@
+package loadbalancer
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWatchBackends(t *testing.T) {
+	lb := newTestLB(t, newFakeClient())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := lb.WatchBackends(ctx)
+	if err != nil {
+		t.Fatalf("WatchBackends() error = %v", err)
+	}
+	if backends := <-ch; len(backends) != 0 {
+		t.Errorf("WatchBackends() initial set = %+v, expected no backends", backends)
+	}
+
+	if err := lb.AddBackend("10.0.0.1", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	if err := lb.AddBackend("10.0.0.2", 6443); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	// The intermediate set is replaced by the latest set
+	if backends := <-ch; len(backends) != 2 {
+		t.Errorf("WatchBackends() set = %+v, expected 2 backends", backends)
+	}
+
+	cancel()
+	for range ch {
+	}
+
+	// Closing the load balancer closes the channel
+	ch, err = lb.WatchBackends(context.Background())
+	if err != nil {
+		t.Fatalf("WatchBackends() error = %v", err)
+	}
+	if err := lb.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	for range ch {
+	}
+	if _, err := lb.WatchBackends(context.Background()); err == nil {
+		t.Errorf("WatchBackends() on a closed load balancer should return an error")
+	}
+}